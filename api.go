@@ -5,6 +5,8 @@ import (
 	"encoding/json"
 	"fmt"
 	"io/ioutil"
+	"os"
+	"reflect"
 	"strings"
 	"time"
 
@@ -29,7 +31,7 @@ type display struct {
 }
 type faces struct {
 	Detections    []FaceDetection `json:"detections" api:"maximum=50"`
-	People        People          `json:"people"`
+	People        People          `json:"people" api:"sensitive"`
 	MaxDetections int             `json:"maxDetections"`
 }
 
@@ -37,7 +39,7 @@ type FaceDetection struct {
 	DateTime   time.Time `json:"dateTime"`
 	Confidence float32   `json:"confidence"`
 	Name       string    `json:"name"`
-	Image      DataURI   `json:"image"`
+	Image      BlobRef   `json:"image" api:"sensitive"`
 }
 
 type DataURI struct {
@@ -119,20 +121,75 @@ type State struct {
 	Streams  streams  `json:"streams"`
 }
 
+// writeFileAtomic writes data to a temporary file and renames it over path so
+// a crash mid-write never leaves a truncated file behind
+func writeFileAtomic(path string, data []byte) error {
+	tmpPath := path + ".tmp"
+	if err := ioutil.WriteFile(tmpPath, data, 0660); err != nil {
+		return err
+	}
+	return os.Rename(tmpPath, path)
+}
+
 func (s *State) Save(statePath string) error {
-	if b, err := json.MarshalIndent(s, "", "  "); err != nil {
+	if b, err := s.marshalVersioned(nil); err != nil {
 		return err
-	} else if err := ioutil.WriteFile(statePath, b, 0660); err != nil {
+	} else if err := writeFileAtomic(statePath, b); err != nil {
 		return err
 	}
 	return nil
 }
 
-func (s *State) Load(statePath string) error {
-	if b, err := ioutil.ReadFile(statePath); err != nil {
+// SaveSnapshot writes the state to statePath marked with the journals it
+// includes
+func (s *State) SaveSnapshot(statePath string, mark journalMark) error {
+	if b, err := s.marshalVersioned(&mark); err != nil {
 		return err
-	} else if err := json.Unmarshal(b, s); err != nil {
+	} else if err := writeFileAtomic(statePath, b); err != nil {
 		return err
 	}
 	return nil
 }
+
+// marshalVersioned encodes the state with the current schema version and, for
+// a snapshot, its journal mark
+func (s *State) marshalVersioned(mark *journalMark) ([]byte, error) {
+	doc := struct {
+		Version int          `json:"version"`
+		Journal *journalMark `json:"journal,omitempty"`
+		*State
+	}{stateVersion(), mark, s}
+
+	b, err := json.MarshalIndent(doc, "", "  ")
+	if err != nil {
+		return nil, err
+	}
+	return encryption.SealDocument(b, reflect.TypeOf(State{}))
+}
+
+// Load reads the state from statePath, migrating it from older schema
+// versions.  The file is backed up before it is upgraded for the first time.
+func (s *State) Load(statePath string) error {
+	b, err := ioutil.ReadFile(statePath)
+	if err != nil {
+		return err
+	}
+
+	opened, err := encryption.OpenDocument(b)
+	if err != nil {
+		return err
+	}
+	migrated, version, err := migrateState(opened)
+	if err != nil {
+		return err
+	}
+
+	if version != stateVersion() {
+		backupPath := fmt.Sprintf("%s.v%d", statePath, version)
+		if err := ioutil.WriteFile(backupPath, b, 0660); err != nil {
+			return err
+		}
+	}
+
+	return json.Unmarshal(migrated, s)
+}
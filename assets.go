@@ -0,0 +1,140 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"embed"
+	"encoding/hex"
+	"fmt"
+	"io/fs"
+	"net/http"
+	"os"
+	"path"
+	"strings"
+	"sync"
+	"time"
+)
+
+// embeddedClient is the page, scripts, fonts and icons, so the binary runs
+// from anywhere
+//
+//go:embed client
+var embeddedClient embed.FS
+
+// ClientFS returns the client files from dir, for working on them without
+// rebuilding, or the ones built in if dir is empty
+func ClientFS(dir string) (fs.FS, error) {
+	if dir == "" {
+		return fs.Sub(embeddedClient, "client")
+	}
+	if info, err := os.Stat(dir); err != nil {
+		return nil, err
+	} else if !info.IsDir() {
+		return nil, fmt.Errorf("%s is not a directory", dir)
+	}
+	return os.DirFS(dir), nil
+}
+
+// staticAsset is a file's content with its ETag, which is kept until the
+// file's size or modification time change
+type staticAsset struct {
+	content []byte
+	etag    string
+	modTime time.Time
+	size    int64
+}
+
+// StaticFiles serves files from an fs.FS with ETags, so browsers can check
+// they're up to date without downloading them again
+type StaticFiles struct {
+	fsys fs.FS
+	dev  bool
+
+	locker sync.Locker
+	assets map[string]staticAsset
+}
+
+// NewStaticFiles serves the files in fsys.  In dev mode browsers are told to
+// check for changes every time.
+func NewStaticFiles(fsys fs.FS, dev bool) *StaticFiles {
+	return &StaticFiles{
+		fsys:   fsys,
+		dev:    dev,
+		locker: &sync.Mutex{},
+		assets: make(map[string]staticAsset),
+	}
+}
+
+// cacheControl lets fonts and icons be cached for a day; the page and its
+// scripts change with each release so are always revalidated
+func (s *StaticFiles) cacheControl(name string) string {
+	if s.dev {
+		return "no-cache"
+	}
+	switch path.Ext(name) {
+	case ".html", ".js", ".css":
+		return "no-cache"
+	}
+	return "public, max-age=86400"
+}
+
+// load returns the file at name, reading it again if it changed
+func (s *StaticFiles) load(name string) (staticAsset, error) {
+	info, err := fs.Stat(s.fsys, name)
+	if err != nil {
+		return staticAsset{}, err
+	} else if info.IsDir() {
+		return staticAsset{}, fs.ErrNotExist
+	}
+
+	s.locker.Lock()
+	a, ok := s.assets[name]
+	s.locker.Unlock()
+	if ok && a.size == info.Size() && a.modTime.Equal(info.ModTime()) {
+		return a, nil
+	}
+
+	content, err := fs.ReadFile(s.fsys, name)
+	if err != nil {
+		return staticAsset{}, err
+	}
+	sum := sha256.Sum256(content)
+	a = staticAsset{
+		content: content,
+		etag:    `"` + hex.EncodeToString(sum[:16]) + `"`,
+		modTime: info.ModTime(),
+		size:    info.Size(),
+	}
+
+	s.locker.Lock()
+	s.assets[name] = a
+	s.locker.Unlock()
+	return a, nil
+}
+
+func (s *StaticFiles) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		http.Error(w, "method not supported", http.StatusMethodNotAllowed)
+		return
+	}
+
+	name := strings.TrimPrefix(path.Clean("/"+r.URL.Path), "/")
+	if !fs.ValidPath(name) || name == "." {
+		http.NotFound(w, r)
+		return
+	}
+
+	a, err := s.load(name)
+	if os.IsNotExist(err) {
+		http.NotFound(w, r)
+		return
+	} else if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("ETag", a.etag)
+	w.Header().Set("Cache-Control", s.cacheControl(name))
+	// ServeContent answers If-None-Match with 304 Not Modified
+	http.ServeContent(w, r, name, a.modTime, bytes.NewReader(a.content))
+}
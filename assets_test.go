@@ -0,0 +1,47 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestStaticFiles(t *testing.T) {
+	client, err := ClientFS("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	files := NewStaticFiles(client, false)
+
+	get := func(target, etag string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(http.MethodGet, target, nil)
+		if etag != "" {
+			r.Header.Set("If-None-Match", etag)
+		}
+		w := httptest.NewRecorder()
+		files.ServeHTTP(w, r)
+		return w
+	}
+
+	w := get("/app.js", "")
+	etag := w.Header().Get("ETag")
+	if w.Code != http.StatusOK || w.Body.Len() == 0 || etag == "" {
+		t.Fatalf("expected the built in app.js with an ETag, got %d %v", w.Code, w.Header())
+	}
+	if cc := w.Header().Get("Cache-Control"); cc != "no-cache" {
+		t.Errorf("expected scripts to be revalidated, got '%s'", cc)
+	}
+
+	if w := get("/app.js", etag); w.Code != http.StatusNotModified || w.Body.Len() != 0 {
+		t.Errorf("expected 304 for a matching ETag, got %d", w.Code)
+	}
+	if w := get("/icons/clear-day.svg", ""); w.Code != http.StatusOK || w.Header().Get("Cache-Control") != "public, max-age=86400" {
+		t.Errorf("expected a cacheable icon, got %d %v", w.Code, w.Header())
+	}
+
+	for _, target := range []string{"/missing.js", "/icons", "/../main.go"} {
+		if w := get(target, ""); w.Code != http.StatusNotFound {
+			t.Errorf("%s: expected 404, got %d", target, w.Code)
+		}
+	}
+}
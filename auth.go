@@ -0,0 +1,525 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"math/big"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/donniet/mirror.4/state"
+	"github.com/gorilla/websocket"
+)
+
+// Role decides what a token may do
+type Role string
+
+const (
+	// RoleNone may do nothing, for refusing anonymous requests
+	RoleNone Role = "none"
+	// RoleViewer may read the state
+	RoleViewer Role = "viewer"
+	// RoleRemote may read the state and control the display and streams
+	RoleRemote Role = "remote"
+	// RoleSensor may only add detections
+	RoleSensor Role = "sensor"
+	// RoleAdmin may do anything, including managing tokens
+	RoleAdmin Role = "admin"
+)
+
+// ParseRole validates a role name
+func ParseRole(s string) (Role, error) {
+	switch r := Role(s); r {
+	case RoleNone, RoleViewer, RoleRemote, RoleSensor, RoleAdmin:
+		return r, nil
+	}
+	return "", fmt.Errorf("unknown role '%s'", s)
+}
+
+// AccessRule allows methods on paths and everything below them.  "*" matches
+// any method, or any one path segment.
+type AccessRule struct {
+	Methods []string `json:"methods"`
+	Paths   []string `json:"paths"`
+}
+
+// defaultRoles are the rules for each role unless the tokens file overrides
+// them
+var defaultRoles = map[Role][]AccessRule{
+	RoleViewer: {
+		{Methods: []string{http.MethodGet}, Paths: []string{""}},
+	},
+	RoleRemote: {
+		{Methods: []string{http.MethodGet}, Paths: []string{""}},
+		{Methods: []string{http.MethodPost, http.MethodPut, http.MethodDelete}, Paths: []string{"display", "streams"}},
+	},
+	RoleSensor: {
+		{Methods: []string{http.MethodPut}, Paths: []string{"faces/detections", "motion/detections"}},
+	},
+	RoleAdmin: {
+		{Methods: []string{"*"}, Paths: []string{""}},
+	},
+}
+
+// pairing codes are short so they can be typed, which the expiry and the
+// limit on failed attempts make up for
+const (
+	pairingCodeDigits = 6
+	pairingExpiry     = 5 * time.Minute
+	pairingMaxFailed  = 10
+)
+
+// Identity is who made a request.  A nil Identity means authentication is
+// turned off and everything is allowed.
+type Identity struct {
+	Name  string `json:"name"`
+	Role  Role   `json:"role"`
+	rules []AccessRule
+}
+
+// Allowed reports whether the identity may use method on path
+func (id *Identity) Allowed(method string, path string) bool {
+	if id == nil {
+		return true
+	}
+
+	segments := splitPath(path)
+	for _, rule := range id.rules {
+		if !ruleHasMethod(rule, method) {
+			continue
+		}
+		for _, p := range rule.Paths {
+			if pattern := splitPath(p); len(pattern) <= len(segments) && matchSegments(pattern, segments) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func ruleHasMethod(rule AccessRule, method string) bool {
+	for _, m := range rule.Methods {
+		if m == "*" || strings.EqualFold(m, method) {
+			return true
+		}
+	}
+	return false
+}
+
+// IsAdmin reports whether the identity may manage the mirror
+func (id *Identity) IsAdmin() bool {
+	return id == nil || id.Role == RoleAdmin
+}
+
+func (id *Identity) name() string {
+	if id == nil {
+		return ""
+	}
+	return id.Name
+}
+
+func (id *Identity) role() Role {
+	if id == nil {
+		return ""
+	}
+	return id.Role
+}
+
+// accessError is the error for a request the identity isn't allowed to make:
+// unauthorized if no token was given, so a client knows to ask for one
+func (id *Identity) accessError() error {
+	if id != nil && id.Name == "" {
+		return state.UnauthorizedError("a token is required")
+	}
+	return state.ForbiddenError("not allowed")
+}
+
+type identityKey struct{}
+
+func withIdentity(ctx context.Context, id *Identity) context.Context {
+	return context.WithValue(ctx, identityKey{}, id)
+}
+
+// identityFrom returns the identity a request was authenticated as
+func identityFrom(ctx context.Context) *Identity {
+	id, _ := ctx.Value(identityKey{}).(*Identity)
+	return id
+}
+
+// tokenEntry is a token in the tokens file.  Tokens written by hand may be in
+// plain text; issued tokens are only stored as their sha256.
+type tokenEntry struct {
+	Name    string    `json:"name"`
+	Role    Role      `json:"role"`
+	Token   string    `json:"token,omitempty"`
+	Hash    string    `json:"hash,omitempty"`
+	Created time.Time `json:"created"`
+}
+
+func (e tokenEntry) hash() []byte {
+	if e.Token != "" {
+		sum := sha256.Sum256([]byte(e.Token))
+		return sum[:]
+	}
+	b, _ := hex.DecodeString(e.Hash)
+	return b
+}
+
+type tokensFile struct {
+	Tokens []tokenEntry          `json:"tokens"`
+	Roles  map[Role][]AccessRule `json:"roles,omitempty"`
+}
+
+type pairingCode struct {
+	name    string
+	role    Role
+	expires time.Time
+}
+
+// Auth checks bearer tokens against the tokens file and issues new ones
+// through pairing
+type Auth struct {
+	path      string
+	anonymous Role
+
+	locker  sync.Locker
+	file    tokensFile
+	pending map[string]pairingCode
+	failed  int
+}
+
+// LoadAuth reads the tokens at path.  Requests without a token get the
+// anonymous role.  If there is no admin token one is created, for pairing
+// devices, and written in plain text to the file, which only we may read.
+func LoadAuth(path string, anonymous Role) (*Auth, error) {
+	a := &Auth{
+		path:      path,
+		anonymous: anonymous,
+		locker:    &sync.Mutex{},
+		pending:   make(map[string]pairingCode),
+	}
+
+	if err := a.Reload(anonymous); err != nil {
+		return nil, err
+	}
+
+	for _, e := range a.file.Tokens {
+		if e.Role == RoleAdmin {
+			return a, nil
+		}
+	}
+
+	token, err := newToken()
+	if err != nil {
+		return nil, err
+	}
+
+	a.locker.Lock()
+	defer a.locker.Unlock()
+	a.file.Tokens = append(a.file.Tokens, tokenEntry{
+		Name:    "admin",
+		Role:    RoleAdmin,
+		Token:   token,
+		Created: time.Now(),
+	})
+	if err := a.save(); err != nil {
+		return nil, err
+	}
+	log.Printf("created an admin token in %s", path)
+	return a, nil
+}
+
+// newToken returns a random token
+func newToken() (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+// Reload rereads the tokens file, which may have been edited by hand, and
+// sets the role of requests without a token
+func (a *Auth) Reload(anonymous Role) error {
+	file := tokensFile{}
+
+	b, err := ioutil.ReadFile(a.path)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	} else if err == nil {
+		if err := json.Unmarshal(b, &file); err != nil {
+			return fmt.Errorf("%s: %v", a.path, err)
+		}
+	}
+
+	for i, e := range file.Tokens {
+		if _, err := ParseRole(string(e.Role)); err != nil {
+			return fmt.Errorf("%s: token %d: %v", a.path, i+1, err)
+		} else if e.Token == "" && len(e.hash()) != sha256.Size {
+			return fmt.Errorf("%s: token %d has no token or hash", a.path, i+1)
+		}
+	}
+
+	a.locker.Lock()
+	defer a.locker.Unlock()
+	a.file, a.anonymous = file, anonymous
+	return nil
+}
+
+func (a *Auth) rules(role Role) []AccessRule {
+	if rules, ok := a.file.Roles[role]; ok {
+		return rules
+	}
+	return defaultRoles[role]
+}
+
+// issue creates a token, saving its hash.  It must not be called with a locked.
+func (a *Auth) issue(name string, role Role) (string, error) {
+	token, err := newToken()
+	if err != nil {
+		return "", err
+	}
+	sum := sha256.Sum256([]byte(token))
+
+	a.locker.Lock()
+	defer a.locker.Unlock()
+
+	a.file.Tokens = append(a.file.Tokens, tokenEntry{
+		Name:    name,
+		Role:    role,
+		Hash:    hex.EncodeToString(sum[:]),
+		Created: time.Now(),
+	})
+	return token, a.save()
+}
+
+// save writes the tokens file, readable only by us.  It must be called with a
+// locked.
+func (a *Auth) save() error {
+	b, err := json.MarshalIndent(a.file, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmpPath := a.path + ".tmp"
+	if err := ioutil.WriteFile(tmpPath, b, 0600); err != nil {
+		return err
+	}
+	// WriteFile keeps the mode of a file left from before
+	if err := os.Chmod(tmpPath, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmpPath, a.path)
+}
+
+// bearerToken returns the token from the Authorization header, or from the
+// access_token query parameter when opening a websocket, which can't set
+// headers.  Other requests must use the header so tokens stay out of logs.
+func bearerToken(r *http.Request) string {
+	if h := r.Header.Get("Authorization"); strings.HasPrefix(h, "Bearer ") {
+		return strings.TrimSpace(h[len("Bearer "):])
+	}
+	if websocket.IsWebSocketUpgrade(r) {
+		return r.URL.Query().Get("access_token")
+	}
+	return ""
+}
+
+// Authenticate returns the identity of the token on r, or the anonymous
+// identity if there isn't one
+func (a *Auth) Authenticate(r *http.Request) (*Identity, error) {
+	a.locker.Lock()
+	defer a.locker.Unlock()
+
+	token := bearerToken(r)
+	if token == "" {
+		return &Identity{Role: a.anonymous, rules: a.rules(a.anonymous)}, nil
+	}
+
+	sum := sha256.Sum256([]byte(token))
+	for _, e := range a.file.Tokens {
+		if subtle.ConstantTimeCompare(sum[:], e.hash()) == 1 {
+			return &Identity{Name: e.Name, Role: e.Role, rules: a.rules(e.Role)}, nil
+		}
+	}
+	return nil, state.UnauthorizedError("invalid token")
+}
+
+// Handler authenticates every request to next.  A nil Auth allows everything.
+func (a *Auth) Handler(next http.Handler) http.Handler {
+	if a == nil {
+		return next
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id, err := a.Authenticate(r)
+		if err != nil {
+			w.Header().Set("WWW-Authenticate", "Bearer")
+			writeError(w, err)
+			return
+		}
+		next.ServeHTTP(w, r.WithContext(withIdentity(r.Context(), id)))
+	})
+}
+
+// Require only lets requests through to next if their identity may use
+// method on path
+func Require(method string, path string, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if id := identityFrom(r.Context()); !id.Allowed(method, path) {
+			writeError(w, id.accessError())
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// RequireAdmin only lets admins through to next
+func RequireAdmin(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if id := identityFrom(r.Context()); !id.IsAdmin() {
+			writeError(w, id.accessError())
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// PairingCode creates a code an admin gives to a new device, which it
+// exchanges for a token with Pair.  The body names the role and the device.
+func (a *Auth) PairingCode(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not supported", http.StatusMethodNotAllowed)
+		return
+	}
+
+	req := struct {
+		Name string `json:"name"`
+		Role Role   `json:"role"`
+	}{}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeError(w, state.BadRequestError(err.Error()))
+		return
+	} else if _, err := ParseRole(string(req.Role)); err != nil || req.Role == RoleNone {
+		writeError(w, state.BadRequestError(fmt.Sprintf("invalid role '%s'", req.Role)))
+		return
+	}
+
+	n, err := rand.Int(rand.Reader, big.NewInt(1000000))
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	code := fmt.Sprintf("%0*d", pairingCodeDigits, n)
+
+	a.locker.Lock()
+	a.pending[code] = pairingCode{name: req.Name, role: req.Role, expires: time.Now().Add(pairingExpiry)}
+	a.locker.Unlock()
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"code":    code,
+		"role":    req.Role,
+		"expires": time.Now().Add(pairingExpiry),
+	})
+}
+
+// Pair exchanges a pairing code for a token.  Too many wrong codes cancel
+// every pending one.
+func (a *Auth) Pair(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not supported", http.StatusMethodNotAllowed)
+		return
+	}
+
+	req := struct {
+		Code string `json:"code"`
+		Name string `json:"name"`
+	}{}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeError(w, state.BadRequestError(err.Error()))
+		return
+	}
+
+	a.locker.Lock()
+	p, ok := a.pending[req.Code]
+	if ok && time.Now().Before(p.expires) {
+		delete(a.pending, req.Code)
+	} else {
+		ok = false
+		if a.failed++; a.failed >= pairingMaxFailed {
+			log.Printf("too many failed pairing attempts, cancelling all pairing codes")
+			a.pending = make(map[string]pairingCode)
+			a.failed = 0
+		}
+	}
+	a.locker.Unlock()
+
+	if !ok {
+		writeError(w, state.ForbiddenError("invalid or expired pairing code"))
+		return
+	}
+
+	if req.Name != "" {
+		p.name = req.Name
+	}
+	token, err := a.issue(p.name, p.role)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	log.Printf("paired '%s' as %s", p.name, p.role)
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"name":  p.name,
+		"role":  p.role,
+		"token": token,
+	})
+}
+
+// Tokens lists the tokens by name and role, or with DELETE and a name query
+// parameter revokes them
+func (a *Auth) Tokens(w http.ResponseWriter, r *http.Request) {
+	a.locker.Lock()
+	defer a.locker.Unlock()
+
+	switch r.Method {
+	case http.MethodGet:
+		ret := make([]tokenEntry, 0, len(a.file.Tokens))
+		for _, e := range a.file.Tokens {
+			ret = append(ret, tokenEntry{Name: e.Name, Role: e.Role, Created: e.Created})
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(ret)
+	case http.MethodDelete:
+		name := r.URL.Query().Get("name")
+		kept := make([]tokenEntry, 0, len(a.file.Tokens))
+		for _, e := range a.file.Tokens {
+			if e.Name != name {
+				kept = append(kept, e)
+			}
+		}
+		if len(kept) == len(a.file.Tokens) {
+			writeError(w, state.NotFoundError(fmt.Sprintf("no token named '%s'", name)))
+			return
+		}
+		a.file.Tokens = kept
+		if err := a.save(); err != nil {
+			writeError(w, err)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		http.Error(w, "method not supported", http.StatusMethodNotAllowed)
+	}
+}
@@ -0,0 +1,200 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/donniet/mirror.4/state"
+	"github.com/gorilla/websocket"
+)
+
+func TestAuth(t *testing.T) {
+	dir, err := ioutil.TempDir("", "auth")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	tokensPath := filepath.Join(dir, "tokens.json")
+	auth, err := LoadAuth(tokensPath, RoleNone)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// an admin token is created in the file, which only we may read
+	file := tokensFile{}
+	if b, err := ioutil.ReadFile(tokensPath); err != nil {
+		t.Fatal(err)
+	} else if err := json.Unmarshal(b, &file); err != nil {
+		t.Fatal(err)
+	} else if len(file.Tokens) != 1 || file.Tokens[0].Role != RoleAdmin || file.Tokens[0].Token == "" {
+		t.Fatalf("expected an admin token, got %s", b)
+	}
+	if info, err := os.Stat(tokensPath); err != nil {
+		t.Fatal(err)
+	} else if info.Mode().Perm() != 0600 {
+		t.Errorf("expected the tokens file to be 0600, got %v", info.Mode().Perm())
+	}
+	admin := file.Tokens[0].Token
+
+	local := new(State)
+	messages := make(chan StateMessage, 10)
+	server := &StateServer{messages: messages, server: state.NewServer(local)}
+
+	mux := http.NewServeMux()
+	mux.Handle("/api/", http.StripPrefix("/api", server))
+	mux.HandleFunc("/api/_pair", auth.Pair)
+	mux.Handle("/api/_pair/code", RequireAdmin(http.HandlerFunc(auth.PairingCode)))
+	handler := auth.Handler(mux)
+
+	request := func(method, target, token, body string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(method, target, bytes.NewBufferString(body))
+		if token != "" {
+			r.Header.Set("Authorization", "Bearer "+token)
+		}
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, r)
+		return w
+	}
+	pair := func(role Role) string {
+		w := request(http.MethodPost, "/api/_pair/code", admin, `{"name":"device","role":"`+string(role)+`"}`)
+		if w.Code != http.StatusOK {
+			t.Fatalf("expected a pairing code, got %d %s", w.Code, w.Body.String())
+		}
+		code := struct{ Code string }{}
+		json.Unmarshal(w.Body.Bytes(), &code)
+
+		w = request(http.MethodPost, "/api/_pair", "", `{"code":"`+code.Code+`"}`)
+		if w.Code != http.StatusOK {
+			t.Fatalf("expected a token, got %d %s", w.Code, w.Body.String())
+		}
+		res := struct{ Token string }{}
+		json.Unmarshal(w.Body.Bytes(), &res)
+
+		// codes only work once
+		if w := request(http.MethodPost, "/api/_pair", "", `{"code":"`+code.Code+`"}`); w.Code != http.StatusForbidden {
+			t.Errorf("expected a used code to be refused, got %d", w.Code)
+		}
+		return res.Token
+	}
+
+	sensor, viewer := pair(RoleSensor), pair(RoleViewer)
+
+	tests := []struct {
+		method, path, token string
+		code                int
+	}{
+		{http.MethodGet, "/api/display", "", http.StatusUnauthorized},
+		{http.MethodGet, "/api/display", "not a token", http.StatusUnauthorized},
+		{http.MethodPost, "/api/_pair/code", viewer, http.StatusForbidden},
+		{http.MethodGet, "/api/display", viewer, http.StatusOK},
+		{http.MethodPost, "/api/display/powerStatus", viewer, http.StatusForbidden},
+		{http.MethodGet, "/api/display", sensor, http.StatusForbidden},
+		{http.MethodPost, "/api/streams", sensor, http.StatusForbidden},
+		{http.MethodPut, "/api/faces/detections", sensor, http.StatusOK},
+		{http.MethodPost, "/api/display/powerStatus", admin, http.StatusOK},
+	}
+	for _, test := range tests {
+		body := `{"confidence":0.9}`
+		if test.method == http.MethodPost {
+			body = `"standby"`
+		}
+		if w := request(test.method, test.path, test.token, body); w.Code != test.code {
+			t.Errorf("%s %s: expected %d, got %d %s", test.method, test.path, test.code, w.Code, w.Body.String())
+		}
+	}
+
+	// tokens in the URL are only taken when opening a websocket
+	for _, upgrade := range []bool{false, true} {
+		r := httptest.NewRequest(http.MethodGet, "/api/display?access_token="+viewer, nil)
+		if upgrade {
+			r.Header.Set("Connection", "Upgrade")
+			r.Header.Set("Upgrade", "websocket")
+		}
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, r)
+		if code := map[bool]int{false: http.StatusUnauthorized, true: http.StatusOK}[upgrade]; w.Code != code {
+			t.Errorf("upgrade %v: expected %d for a token in the URL, got %d", upgrade, code, w.Code)
+		}
+	}
+
+	// tokens survive a restart
+	if auth, err = LoadAuth(tokensPath, RoleNone); err != nil {
+		t.Fatal(err)
+	}
+	handler = auth.Handler(mux)
+	if w := request(http.MethodGet, "/api/display", viewer, ""); w.Code != http.StatusOK {
+		t.Errorf("expected a paired token to work after reloading, got %d", w.Code)
+	}
+}
+
+func TestSocketAuth(t *testing.T) {
+	local := new(State)
+	messages := make(chan StateMessage)
+	server := &StateServer{messages: messages, server: state.NewServer(local)}
+	socks := NewSockets(server, nil, SocketConfig{QueueSize: 10, Overflow: OverflowCoalesce, HistorySize: 10})
+	go func() {
+		for msg := range messages {
+			socks.Write(msg)
+		}
+	}()
+	defer close(messages)
+
+	sensor := &Identity{Name: "camera", Role: RoleSensor, rules: defaultRoles[RoleSensor]}
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		socks.ServeHTTP(w, r.WithContext(withIdentity(r.Context(), sensor)))
+	}))
+	defer ts.Close()
+	defer socks.Close()
+
+	conn, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(ts.URL, "http"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	send := func(id, method, path, body string) SocketReply {
+		raw := json.RawMessage(body)
+		if err := conn.WriteJSON(StateMessage{ID: id, Method: method, Path: path, Body: &raw}); err != nil {
+			t.Fatal(err)
+		}
+		reply := SocketReply{}
+		if err := conn.ReadJSON(&reply); err != nil {
+			t.Fatal(err)
+		}
+		return reply
+	}
+
+	if reply := send("1", http.MethodPost, "/display/powerStatus", `"standby"`); reply.Status != http.StatusForbidden {
+		t.Errorf("expected a sensor to be refused, got %d", reply.Status)
+	}
+	if reply := send("2", MethodResume, "", `{}`); reply.Status != http.StatusForbidden {
+		t.Errorf("expected a sensor to be refused the state, got %d", reply.Status)
+	}
+	if reply := send("3", http.MethodPut, "/faces/detections", `{"confidence":0.9}`); reply.Status != http.StatusOK {
+		t.Errorf("expected a sensor to add a detection, got %d", reply.Status)
+	}
+
+	// changes only go to connections allowed to read them
+	viewer := testConn(socks)
+	viewer.info.identity = &Identity{Name: "hall", Role: RoleViewer, rules: defaultRoles[RoleViewer]}
+	camera := testConn(socks)
+	camera.info.identity = sensor
+	socks.locker.Lock()
+	socks.connections[viewer.info] = viewer
+	socks.connections[camera.info] = camera
+	socks.locker.Unlock()
+
+	body := json.RawMessage(`"on"`)
+	socks.Write(StateMessage{Method: http.MethodPost, Path: "/display/powerStatus", Body: &body})
+	if viewer.queue.Len() != 1 || camera.queue.Len() != 0 {
+		t.Errorf("expected only the viewer to get the change, got %d and %d", viewer.queue.Len(), camera.queue.Len())
+	}
+}
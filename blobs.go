@@ -0,0 +1,447 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"time"
+
+	"github.com/donniet/mirror.4/state"
+)
+
+const blobPrefix = "blobs/"
+
+// blobStore receives the contents of data-uris in state being migrated
+var blobStore *BlobStore
+
+// BlobStore keeps content on disk named by the hex sha256 of its bytes, with
+// the content type alongside in a .type file
+type BlobStore struct {
+	dir string
+}
+
+// NewBlobStore creates a blob store in dir
+func NewBlobStore(dir string) (*BlobStore, error) {
+	if err := os.MkdirAll(dir, 0770); err != nil {
+		return nil, err
+	}
+	return &BlobStore{dir: dir}, nil
+}
+
+func validHash(hash string) bool {
+	if len(hash) != sha256.Size*2 {
+		return false
+	}
+	_, err := hex.DecodeString(hash)
+	return err == nil
+}
+
+// Put stores data and returns its hash.  The hash is always of the plaintext,
+// so references don't change when blobs are encrypted.
+func (b *BlobStore) Put(contentType string, data []byte) (string, error) {
+	hash := blobHash(data)
+	path := filepath.Join(b.dir, hash)
+
+	if _, err := os.Stat(path); err == nil {
+		// touch it so a collection running now leaves it alone
+		now := time.Now()
+		return hash, os.Chtimes(path, now, now)
+	}
+
+	sealed, err := encryption.SealBlob(data)
+	if err != nil {
+		return "", err
+	}
+	if err := writeFileAtomic(path+".type", []byte(contentType)); err != nil {
+		return "", err
+	}
+	if err := writeFileAtomic(path, sealed); err != nil {
+		return "", err
+	}
+	return hash, nil
+}
+
+// Has reports whether the blob named hash is stored
+func (b *BlobStore) Has(hash string) bool {
+	_, err := os.Stat(filepath.Join(b.dir, hash))
+	return err == nil
+}
+
+// blobHash returns the name data is stored under
+func blobHash(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+// Read returns the content type and decrypted contents of a blob
+func (b *BlobStore) Read(hash string) (string, []byte, error) {
+	path := filepath.Join(b.dir, hash)
+
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return "", nil, err
+	}
+	if data, err = encryption.OpenBlob(data); err != nil {
+		return "", nil, err
+	}
+	contentType, _ := ioutil.ReadFile(path + ".type")
+	return string(contentType), data, nil
+}
+
+// Reseal rewrites blobs that are in plaintext or sealed with an old key so
+// that they are sealed with the current one
+func (b *BlobStore) Reseal() (int, error) {
+	if encryption == nil || encryption.mode == EncryptNone {
+		return 0, nil
+	}
+
+	infos, err := ioutil.ReadDir(b.dir)
+	if err != nil {
+		return 0, err
+	}
+
+	resealed := 0
+	for _, fi := range infos {
+		hash := fi.Name()
+		if !validHash(hash) {
+			continue
+		}
+
+		path := filepath.Join(b.dir, hash)
+		data, err := ioutil.ReadFile(path)
+		if err != nil {
+			return resealed, err
+		}
+		if _, current := encryption.Sealed(data); current {
+			continue
+		}
+		if data, err = encryption.Open(data); err != nil {
+			return resealed, fmt.Errorf("blob %s: %v", hash, err)
+		}
+		if data, err = encryption.Seal(data); err != nil {
+			return resealed, err
+		}
+		if err := writeFileAtomic(path, data); err != nil {
+			return resealed, err
+		}
+		resealed++
+	}
+	return resealed, nil
+}
+
+// ServeHTTP serves the blob named by the request path.  Blobs never change,
+// so browsers may cache them forever, but they are faces so shared caches may
+// not, and nothing may keep them if they are encrypted at rest.
+func (b *BlobStore) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	hash := strings.Trim(r.URL.Path, "/")
+	if !validHash(hash) {
+		http.NotFound(w, r)
+		return
+	}
+
+	contentType, data, err := b.Read(hash)
+	if os.IsNotExist(err) {
+		http.NotFound(w, r)
+		return
+	} else if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	if contentType != "" {
+		w.Header().Set("Content-Type", contentType)
+	}
+	w.Header().Set("ETag", `"`+hash+`"`)
+	if encryption == nil || encryption.mode == EncryptNone {
+		w.Header().Set("Cache-Control", "private, max-age=31536000, immutable")
+	} else {
+		w.Header().Set("Cache-Control", "private, no-store")
+	}
+
+	http.ServeContent(w, r, "", time.Time{}, bytes.NewReader(data))
+}
+
+// GC removes blobs not in refs that are older than grace, which protects blobs
+// stored by requests that have not yet been applied to the state
+func (b *BlobStore) GC(refs map[string]bool, grace time.Duration) (int, error) {
+	infos, err := ioutil.ReadDir(b.dir)
+	if err != nil {
+		return 0, err
+	}
+
+	removed := 0
+	for _, fi := range infos {
+		hash := fi.Name()
+		if !validHash(hash) || refs[hash] || time.Since(fi.ModTime()) < grace {
+			continue
+		}
+
+		if err := os.Remove(filepath.Join(b.dir, hash)); err != nil {
+			return removed, err
+		}
+		os.Remove(filepath.Join(b.dir, hash+".type"))
+		removed++
+	}
+	return removed, nil
+}
+
+// blobCollector periodically removes blobs no longer referenced by the state
+func blobCollector(blobs *BlobStore, apiServer *state.Server, local *State, stopper <-chan struct{}) {
+	ticker := time.NewTicker(time.Hour)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			refs := make(map[string]bool)
+			apiServer.DoLocked(func() error {
+				collectBlobRefs(reflect.ValueOf(local), refs)
+				return nil
+			})
+
+			if n, err := blobs.GC(refs, 10*time.Minute); err != nil {
+				log.Printf("error collecting blobs: %v", err)
+			} else if n > 0 {
+				log.Printf("removed %d unreferenced blobs", n)
+			}
+		case <-stopper:
+			return
+		}
+	}
+}
+
+// collectBlobRefs adds the hash of every BlobRef reachable from v to refs
+func collectBlobRefs(v reflect.Value, refs map[string]bool) {
+	switch v.Kind() {
+	case reflect.Ptr, reflect.Interface:
+		if !v.IsNil() {
+			collectBlobRefs(v.Elem(), refs)
+		}
+	case reflect.Struct:
+		if ref, ok := v.Interface().(BlobRef); ok {
+			if ref.Hash != "" {
+				refs[ref.Hash] = true
+			}
+			return
+		}
+		for i := 0; i < v.NumField(); i++ {
+			if f := v.Field(i); f.CanInterface() {
+				collectBlobRefs(f, refs)
+			}
+		}
+	case reflect.Slice, reflect.Array:
+		for i := 0; i < v.Len(); i++ {
+			collectBlobRefs(v.Index(i), refs)
+		}
+	case reflect.Map:
+		for _, k := range v.MapKeys() {
+			collectBlobRefs(v.MapIndex(k), refs)
+		}
+	}
+}
+
+// BlobRef refers to content in the blob store.  It marshals and unmarshals as
+// the relative URL the content is served from.  Clients may send a data-uri
+// instead, which storeBody puts in the blob store before the change is made.
+type BlobRef struct {
+	Hash string
+}
+
+var blobRefType = reflect.TypeOf(BlobRef{})
+
+func (r *BlobRef) UnmarshalJSON(b []byte) error {
+	str := ""
+	if err := json.Unmarshal(b, &str); err != nil {
+		return err
+	}
+
+	if str == "" {
+		r.Hash = ""
+		return nil
+	}
+
+	hash := strings.TrimPrefix(str, blobPrefix)
+	if hash == str || !validHash(hash) {
+		return fmt.Errorf("invalid blob reference '%.80s'", str)
+	}
+	r.Hash = hash
+	return nil
+}
+
+func (r BlobRef) MarshalJSON() ([]byte, error) {
+	if r.Hash == "" {
+		return json.Marshal("")
+	}
+	return json.Marshal(blobPrefix + r.Hash)
+}
+
+// parseDataURI decodes the data-uri in s
+func parseDataURI(s string) (DataURI, error) {
+	b, _ := json.Marshal(s)
+	d := DataURI{}
+	err := d.UnmarshalJSON(b)
+	return d, err
+}
+
+// storeBody puts the data-uris in body, the body of a change made with method
+// at path, in the blob store and replaces them with references, as
+// storeDataURIs does.  Bodies that can't hold a BlobRef, or aren't JSON, are
+// left for the state server to deal with, as they are by a nil store.
+func (b *BlobStore) storeBody(method string, path string, body []byte) ([]byte, error) {
+	if b == nil || (method != http.MethodPost && method != http.MethodPut) {
+		return body, nil
+	}
+	t := changeType(method, path)
+	if t == nil || !holdsBlobRefs(t, map[reflect.Type]bool{}) {
+		return body, nil
+	}
+
+	doc, err := decodeDocument(body)
+	if err != nil {
+		return body, nil
+	}
+	if doc, err = b.storeDataURIs(doc, t); err != nil {
+		return nil, err
+	}
+	return json.Marshal(doc)
+}
+
+// storeDataURIs puts the data-uris where doc, a decoded value of type t, has
+// a BlobRef in the blob store and replaces them with references to it,
+// changing doc in place.  References already in doc must be to blobs that
+// are stored.
+func (b *BlobStore) storeDataURIs(doc interface{}, t reflect.Type) (interface{}, error) {
+	return mapBlobRefs(doc, t, func(str string) (string, error) {
+		if hash := strings.TrimPrefix(str, blobPrefix); hash != str {
+			if !validHash(hash) || !b.Has(hash) {
+				return "", state.BadRequestError(fmt.Sprintf("no blob '%s'", str))
+			}
+			return str, nil
+		}
+
+		d, err := parseDataURI(str)
+		if err != nil {
+			return "", state.BadRequestError(err.Error())
+		}
+		hash, err := b.Put(strings.TrimPrefix(d.contentType, "data:"), d.data)
+		if err != nil {
+			return "", err
+		}
+		return blobPrefix + hash, nil
+	})
+}
+
+// dataURIRef returns the reference a data-uri would be stored under, after
+// checking it can be decoded, or str if it is already a reference
+func dataURIRef(str string) (string, error) {
+	if strings.HasPrefix(str, blobPrefix) {
+		return str, nil
+	}
+	d, err := parseDataURI(str)
+	if err != nil {
+		return "", err
+	}
+	return blobPrefix + blobHash(d.data), nil
+}
+
+// mapBlobRefs replaces each string where doc, a decoded value of type t, has
+// a BlobRef with what f returns for it, changing doc in place
+func mapBlobRefs(doc interface{}, t reflect.Type, f func(string) (string, error)) (interface{}, error) {
+	for t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	if t == blobRefType {
+		if str, ok := doc.(string); ok && str != "" {
+			return f(str)
+		}
+		return doc, nil
+	}
+
+	var err error
+	switch t.Kind() {
+	case reflect.Struct:
+		if m, ok := doc.(map[string]interface{}); ok {
+			for k, v := range m {
+				if field, ok := jsonField(t, k); ok {
+					if m[k], err = mapBlobRefs(v, field.Type, f); err != nil {
+						return nil, err
+					}
+				}
+			}
+		}
+	case reflect.Slice, reflect.Array:
+		if a, ok := doc.([]interface{}); ok {
+			for i := range a {
+				if a[i], err = mapBlobRefs(a[i], t.Elem(), f); err != nil {
+					return nil, err
+				}
+			}
+		}
+	case reflect.Map:
+		if m, ok := doc.(map[string]interface{}); ok {
+			for k := range m {
+				if m[k], err = mapBlobRefs(m[k], t.Elem(), f); err != nil {
+					return nil, err
+				}
+			}
+		}
+	}
+	return doc, nil
+}
+
+// holdsBlobRefs reports whether a value of type t can contain a BlobRef.  seen
+// holds the types already being looked at, for recursive types.
+func holdsBlobRefs(t reflect.Type, seen map[reflect.Type]bool) bool {
+	for t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	if t == blobRefType {
+		return true
+	} else if seen[t] {
+		return false
+	}
+	seen[t] = true
+
+	switch t.Kind() {
+	case reflect.Struct:
+		for i := 0; i < t.NumField(); i++ {
+			if f := t.Field(i); f.PkgPath == "" && holdsBlobRefs(f.Type, seen) {
+				return true
+			}
+		}
+	case reflect.Slice, reflect.Array, reflect.Map:
+		return holdsBlobRefs(t.Elem(), seen)
+	}
+	return false
+}
+
+// changeType returns the type of the body of a change made to the State with
+// method at path, or nil if there is nothing there.  A PUT adds an element to
+// the slice or map at path, or sets the key at the end of path in a map.
+func changeType(method string, path string) reflect.Type {
+	root := reflect.TypeOf(State{})
+	t := typeAtPath(root, path)
+	if t == nil || method != http.MethodPut {
+		return t
+	}
+
+	path = strings.Trim(path, "/")
+	if slash := strings.LastIndex(path, "/"); slash >= 0 {
+		if parent := typeAtPath(root, path[:slash]); parent != nil && parent.Kind() == reflect.Map {
+			return t
+		}
+	}
+	if t.Kind() == reflect.Slice || t.Kind() == reflect.Map {
+		return t.Elem()
+	}
+	return t
+}
@@ -0,0 +1,117 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestBlobStore(t *testing.T) {
+	dir, err := ioutil.TempDir("", "blobs")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	if blobStore, err = NewBlobStore(dir); err != nil {
+		t.Fatal(err)
+	}
+	defer func() { blobStore = nil }()
+
+	// decoding doesn't store data-uris, storing the body of a change does
+	body := []byte(`{"name":"sam","image":"data:image/png;base64,AAEC"}`)
+	d := FaceDetection{}
+	if err := json.Unmarshal(body, &d); err == nil {
+		t.Errorf("expected a data-uri not to decode as a blob reference")
+	}
+	if infos, _ := ioutil.ReadDir(dir); len(infos) != 0 {
+		t.Errorf("expected decoding to store nothing, found %d files", len(infos))
+	}
+	if body, err = blobStore.storeBody(http.MethodPut, "faces/detections", body); err != nil {
+		t.Fatal(err)
+	} else if err := json.Unmarshal(body, &d); err != nil {
+		t.Fatal(err)
+	} else if d.Image.Hash == "" || !blobStore.Has(d.Image.Hash) {
+		t.Fatalf("expected the data-uri to be stored, got %s", body)
+	}
+
+	// references must be to stored blobs
+	missing := []byte(`{"image":"blobs/` + strings.Repeat("0", 64) + `"}`)
+	if _, err := blobStore.storeBody(http.MethodPut, "faces/detections", missing); err == nil {
+		t.Errorf("expected a reference to a missing blob to be refused")
+	}
+	if _, err := blobStore.storeBody(http.MethodPost, "faces/detections/0/image", []byte(`"blobs/`+d.Image.Hash+`"`)); err != nil {
+		t.Errorf("expected a reference to a stored blob to be accepted: %v", err)
+	}
+	if b, err := blobStore.storeBody(http.MethodPost, "display/powerStatus", []byte(`"data:image/png;base64,AAEC"`)); err != nil || string(b) != `"data:image/png;base64,AAEC"` {
+		t.Errorf("expected bodies without images left alone, got %s %v", b, err)
+	}
+
+	b, _ := json.Marshal(d.Image)
+	if string(b) != `"blobs/`+d.Image.Hash+`"` {
+		t.Errorf("unexpected blob reference %s", b)
+	}
+	ref := BlobRef{}
+	if err := json.Unmarshal(b, &ref); err != nil || ref != d.Image {
+		t.Errorf("blob reference did not round trip: %v %v", ref, err)
+	}
+
+	w := httptest.NewRecorder()
+	blobStore.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/"+d.Image.Hash, nil))
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected 200 got %d", w.Code)
+	} else if ct := w.Header().Get("Content-Type"); ct != "image/png" {
+		t.Errorf("expected Content-Type image/png got %s", ct)
+	} else if w.Body.String() != "\x00\x01\x02" {
+		t.Errorf("unexpected blob contents %q", w.Body.String())
+	} else if cc := w.Header().Get("Cache-Control"); !strings.HasPrefix(cc, "private,") {
+		t.Errorf("expected only browsers to cache blobs, got %s", cc)
+	}
+
+	// nothing may keep them when they are encrypted at rest
+	if encryption, err = LoadEncryption(EncryptFields, "", testKey1); err != nil {
+		t.Fatal(err)
+	}
+	w = httptest.NewRecorder()
+	blobStore.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/"+d.Image.Hash, nil))
+	encryption = nil
+	if cc := w.Header().Get("Cache-Control"); cc != "private, no-store" {
+		t.Errorf("expected encrypted blobs not to be stored, got %s", cc)
+	}
+
+	r := httptest.NewRequest(http.MethodGet, "/"+d.Image.Hash, nil)
+	r.Header.Set("If-None-Match", w.Header().Get("ETag"))
+	w = httptest.NewRecorder()
+	blobStore.ServeHTTP(w, r)
+	if w.Code != http.StatusNotModified {
+		t.Errorf("expected 304 got %d", w.Code)
+	}
+
+	refs := make(map[string]bool)
+	collectBlobRefs(reflect.ValueOf(&State{Faces: faces{Detections: []FaceDetection{d}}}), refs)
+	if !refs[d.Image.Hash] {
+		t.Errorf("reference not collected")
+	}
+
+	if n, err := blobStore.GC(refs, 0); err != nil || n != 0 {
+		t.Errorf("referenced blob collected: %d %v", n, err)
+	}
+	if n, err := blobStore.GC(nil, time.Hour); err != nil || n != 0 {
+		t.Errorf("new blob collected: %d %v", n, err)
+	}
+	if n, err := blobStore.GC(nil, 0); err != nil || n != 1 {
+		t.Errorf("expected 1 blob collected: %d %v", n, err)
+	}
+
+	w = httptest.NewRecorder()
+	blobStore.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/"+d.Image.Hash, nil))
+	if w.Code != http.StatusNotFound {
+		t.Errorf("expected 404 got %d", w.Code)
+	}
+}
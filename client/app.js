@@ -31,6 +31,15 @@ function App(websocketUrl, el) {
     this.el = el;
     this.app = null;
     this.checkStreams = new Object();
+    this.nextId = 1;
+    this.pending = new Object();
+    // where to resume the broadcasts from after reconnecting
+    this.epoch = null;
+    this.seq = 0;
+    // whether every broadcast since the last resume has arrived, which can
+    // only be told without subscriptions filtering them
+    this.synced = false;
+    this.subscriptions = new Set();
     this.open();
 }
 App.prototype.setResponse = function(response) {
@@ -80,21 +89,15 @@ App.prototype.setResponse = function(response) {
     });
 };
 App.prototype.markStreamLoaded = function(index) {
-    this.sendMessage({
-        'method': 'POST',
-        'path': `streams/${index}/errorTime`,
-        'body': "0001-01-01T00:00:00Z"
-    });
+    this.sendRequest('POST', `streams/${index}/errorTime`, "0001-01-01T00:00:00Z")
+        .catch((reply) => console.log('could not mark stream loaded', index, reply));
     if(this.checkStreams[index]) {
         delete this.checkStreams[index];
     }
 };
 App.prototype.markStreamError = function(index) {
-    this.sendMessage({
-        'method': 'POST',
-        'path': `streams/${index}/errorTime`,
-        'body': new Date(),
-    });
+    this.sendRequest('POST', `streams/${index}/errorTime`, new Date())
+        .catch((reply) => console.log('could not mark stream error', index, reply));
     
     if(!this.checkStreams[index]) {
         this.checkStreams[index] = this.app.response.streams[index];
@@ -103,6 +106,16 @@ App.prototype.markStreamError = function(index) {
 App.prototype.sendMessage = function(msg) {
     this.ws.send(JSON.stringify(msg));
 }
+// limit broadcasts to changes under path ('*' matches any one segment);
+// without any subscriptions every change is received
+App.prototype.subscribe = function(path) {
+    this.subscriptions.add(path);
+    return this.sendRequest('subscribe', path);
+}
+App.prototype.unsubscribe = function(path) {
+    this.subscriptions.delete(path);
+    return this.sendRequest('unsubscribe', path);
+}
 App.prototype.open = function() {
     this.ws = new WebSocket(this.websocketUrl);
     this.ws.onopen = App.prototype.onopen.bind(this);
@@ -113,7 +126,31 @@ App.prototype.onopen = function(e) {
     this.ws.onerror = App.prototype.onerror.bind(this);
     this.ws.onclose = App.prototype.onclose.bind(this);
 
-    this.sendRequest('GET', '/');
+    this.synced = false;
+    this.resume();
+};
+// reconnect drops a connection that missed broadcasts, so resuming replays
+// them from the last one applied
+App.prototype.reconnect = function() {
+    console.log('missed changes after', this.seq, 'reconnecting');
+    this.synced = false;
+    this.ws.onmessage = null;
+    this.ws.close();
+};
+// resume asks for the broadcasts missed while disconnected, which arrive ahead
+// of the reply, or the whole state if they are no longer available
+App.prototype.resume = function() {
+    this.sendRequest('resume', '', {epoch: this.epoch, seq: this.seq}).then((reply) => {
+        let res = reply.body;
+        if (!res.resumed) {
+            this.setResponse(res.state);
+        } else {
+            console.log('resumed after', res.replayed, 'missed changes');
+        }
+        this.epoch = res.epoch;
+        this.seq = res.seq;
+        this.synced = true;
+    });
 };
 function postHelper(data, path, body) {
     let slash = -1;
@@ -137,38 +174,33 @@ function postHelper(data, path, body) {
 }
 App.prototype.handlePost = function(path, body) {
     console.log('post', path, body);
+    if (path.replace(/\//g, '') == '') {
+        // the whole state was replaced, e.g. by an import
+        this.setResponse(body);
+        return;
+    }
     postHelper(this.app.response, path, body);
 };
 function putHelper(data, path, body) {
-    while(path != "") {
-        let slash = path.indexOf('/');
-        if (slash >= 0) {
-            first = path.substring(0, slash);
-            path = path.substring(slash + 1);
-        } else if (typeof data == 'object' && typeof data[first] == 'object' && data[first].length != 'number') {
-            console.log('overwriting', first, data, body);
-            data[first] = body;
-            return;
-        } else {
-            first = path;
-            path = "";
-        }
-        // ignore double slashes
-        if (first == "") continue;
+    let parts = path.split('/').filter(p => p != "");
+    let last = parts.pop();
 
-        if (!data[first]) {
-            console.log('could not find path', first, data);
+    for (var i = 0; i < parts.length; i++) {
+        if (!data[parts[i]]) {
+            console.log('could not find path', parts[i], data);
             return;
         }
-
-        data = data[first];
+        data = data[parts[i]];
     }
 
-    if (typeof data == 'object' && typeof data.length == 'number') {
-        data.push(body);
+    if (data[last] && typeof data[last] == 'object' && typeof data[last].length == 'number') {
+        // append to an array
+        data[last].push(body);
+    } else if (typeof data == 'object' && last !== undefined) {
+        // add a key to a map
+        Vue.set(data, last, body);
     } else {
         console.log("don't know how to put", data, body);
-        return;
     }
 }
 App.prototype.handlePut = function(path, body) {
@@ -221,15 +253,30 @@ App.prototype.onmessage = function(e) {
 
     console.log('message', dat, dat.method);
 
-    if (dat.error) {
-        console.log('error received: ', dat.error)
+    if (dat.type == 'reply') {
+        this.handleReply(dat);
         return;
     }
-
-    if (!dat.method) {
-        this.setResponse(dat);
+    if (dat.type == 'resync') {
+        // the server dropped broadcasts this client was too slow for
+        this.reconnect();
         return;
     }
+    if (!this.app) {
+        // the state this change applies to hasn't arrived yet
+        return;
+    }
+    if (dat.seq) {
+        if (dat.seq <= this.seq) {
+            // already applied
+            return;
+        }
+        if (this.synced && this.subscriptions.size == 0 && dat.seq !== this.seq + 1) {
+            this.reconnect();
+            return;
+        }
+        this.seq = dat.seq;
+    }
 
     switch (dat.method) {
     case "POST":
@@ -248,15 +295,44 @@ App.prototype.onmessage = function(e) {
 App.prototype.onerror = function(e) {
     console.log('error', e);
 };
+App.prototype.handleReply = function(reply) {
+    let request = this.pending[reply.id];
+    if (!request) {
+        console.log('reply to unknown request', reply);
+        return;
+    }
+    delete this.pending[reply.id];
+
+    if (reply.status >= 400) {
+        console.log('error received: ', reply.status, reply.body);
+        request.reject(reply);
+    } else {
+        request.resolve(reply);
+    }
+};
 App.prototype.onclose = function(e) {
+    // requests in flight will never be answered
+    for (let id in this.pending) {
+        this.pending[id].reject({id: id, status: 0});
+    }
+    this.pending = new Object();
+
     setTimeout(function() { this.open(); }.bind(this), 1000);
 };
+// sendRequest resolves with the reply {status, headers, body} or rejects with
+// it if the request failed
 App.prototype.sendRequest = function(method, path, body) {
-    this.ws.send(JSON.stringify({
-        method: method,
-        path: path,
-        body: body
-    }));
+    let id = String(this.nextId++);
+
+    return new Promise((resolve, reject) => {
+        this.pending[id] = {resolve: resolve, reject: reject};
+        this.sendMessage({
+            id: id,
+            method: method,
+            path: path,
+            body: body
+        });
+    });
 };
 
 Vue.component('svg-image', {
@@ -359,6 +435,27 @@ Vue.component('clock', {
     }
 });
 
-function load(websocketUrl) {
+// load starts the app with what the server put in the page: where to connect,
+// the CSRF token, and the state to show until the websocket catches up
+function load(server) {
+    var websocketUrl = server.websocketUrl;
+    console.log('mirror', server.version);
+
+    // a token in the page address is remembered, so it only has to be given once
+    var token = new URLSearchParams(window.location.search).get('token');
+    if (token) {
+        localStorage.setItem('mirrorToken', token);
+    } else {
+        token = localStorage.getItem('mirrorToken');
+    }
+    // the CSRF token shows the server this page is ours, so it may make changes
+    websocketUrl += '?csrf=' + encodeURIComponent(server.csrfToken);
+    if (token) {
+        websocketUrl += '&access_token=' + encodeURIComponent(token);
+    }
+
     var app = new App(websocketUrl, '#template');
+    if (server.state) {
+        app.setResponse(server.state);
+    }
 }
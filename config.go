@@ -0,0 +1,292 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"unicode"
+)
+
+// configEnv names the config file if -config isn't given
+const configEnv = "MIRROR_CONFIG"
+
+// configSections groups the settings in the config file.  Settings are named
+// as their flags, and can also be set in the environment as MIRROR_ and the
+// name in upper snake case, like MIRROR_WEATHER_KEY.  Flags win over the
+// environment, which wins over the file.
+var configSections = map[string][]string{
+	"server": {
+		"addr", "basePath", "behindProxy", "tls", "tlsCert", "tlsKey", "tlsDir", "tlsHosts",
+		"socketQueue", "socketOverflow", "socketHistory", "socketPing", "socketIdle", "socketWriteTimeout", "maxConnections",
+	},
+	"weather": {
+		"weatherKey", "lat", "long",
+	},
+	"persistence": {
+		"statePath", "storage", "blobPath", "watchState", "conflicts", "journalSync", "compactEvery", "saveDelay", "saveMaxDelay",
+	},
+	"display": {
+		"clientDir", "dev",
+	},
+	"security": {
+		"encrypt", "keyFile", "tokens", "anonymousRole", "allowedOrigins",
+	},
+}
+
+// reloadable are the settings a SIGHUP applies without restarting
+var reloadable = map[string]bool{
+	"weatherKey":     true,
+	"lat":            true,
+	"long":           true,
+	"allowedOrigins": true,
+	"anonymousRole":  true,
+}
+
+// settingsLocker guards the settings that can change while running
+var settingsLocker sync.Locker = &sync.Mutex{}
+
+// envName is the environment variable for a setting
+func envName(setting string) string {
+	b := &strings.Builder{}
+	b.WriteString("MIRROR_")
+	for i, r := range setting {
+		if unicode.IsUpper(r) && i > 0 {
+			b.WriteRune('_')
+		}
+		b.WriteRune(unicode.ToUpper(r))
+	}
+	return b.String()
+}
+
+// Settings applies the config file and environment to the flags not given on
+// the command line
+type Settings struct {
+	path  string
+	flags *flag.FlagSet
+	// explicit are the flags given on the command line
+	explicit map[string]bool
+}
+
+// LoadSettings applies the config file at path, if any, and the environment
+// to the flags in fs that weren't parsed from the command line, then checks
+// the result
+func LoadSettings(fs *flag.FlagSet, path string) (*Settings, error) {
+	s := &Settings{path: path, flags: fs, explicit: make(map[string]bool)}
+	fs.Visit(func(f *flag.Flag) { s.explicit[f.Name] = true })
+
+	values, err := s.read()
+	if err != nil {
+		return nil, err
+	}
+	for _, name := range sortedKeys(values) {
+		if err := s.flags.Set(name, values[name]); err != nil {
+			return nil, fmt.Errorf("invalid %s '%s': %v", name, values[name], err)
+		}
+	}
+	return s, validateSettings()
+}
+
+// read returns the settings from the file and environment that the command
+// line doesn't override
+func (s *Settings) read() (map[string]string, error) {
+	values := make(map[string]string)
+
+	if s.path != "" {
+		b, err := ioutil.ReadFile(s.path)
+		if err != nil {
+			return nil, err
+		}
+
+		sections := make(map[string]map[string]json.RawMessage)
+		if err := json.Unmarshal(b, &sections); err != nil {
+			return nil, fmt.Errorf("%s: %v", s.path, err)
+		}
+		for section, settings := range sections {
+			allowed, ok := configSections[section]
+			if !ok {
+				return nil, fmt.Errorf("%s: unknown section '%s'", s.path, section)
+			}
+			for name, raw := range settings {
+				if !containsString(allowed, name) {
+					return nil, fmt.Errorf("%s: unknown setting '%s.%s'", s.path, section, name)
+				}
+				// strings are unquoted, and numbers and booleans taken as written
+				var str string
+				if err := json.Unmarshal(raw, &str); err == nil {
+					values[name] = str
+				} else {
+					values[name] = strings.TrimSpace(string(raw))
+				}
+			}
+		}
+	}
+
+	for _, settings := range configSections {
+		for _, name := range settings {
+			if v, ok := os.LookupEnv(envName(name)); ok {
+				values[name] = v
+			}
+		}
+	}
+
+	for name := range s.explicit {
+		delete(values, name)
+	}
+	return values, nil
+}
+
+// Changes rereads the file and environment and returns the settings that
+// differ from the running ones
+func (s *Settings) Changes() (map[string]string, error) {
+	values, err := s.read()
+	if err != nil {
+		return nil, err
+	}
+
+	settingsLocker.Lock()
+	defer settingsLocker.Unlock()
+
+	for name, v := range values {
+		if f := s.flags.Lookup(name); f != nil && sameSetting(f, v) {
+			delete(values, name)
+		}
+	}
+	return values, nil
+}
+
+// sameSetting reports whether v is the flag's value, allowing for it being
+// written differently, like 120s for 2m0s
+func sameSetting(f *flag.Flag, v string) bool {
+	getter, ok := f.Value.(flag.Getter)
+	if !ok {
+		return f.Value.String() == v
+	}
+
+	var err error
+	var parsed interface{}
+	switch getter.Get().(type) {
+	case bool:
+		parsed, err = strconv.ParseBool(v)
+	case int:
+		parsed, err = strconv.Atoi(v)
+	case float64:
+		parsed, err = strconv.ParseFloat(v, 64)
+	case time.Duration:
+		parsed, err = time.ParseDuration(v)
+	default:
+		parsed = v
+	}
+	return err == nil && parsed == getter.Get()
+}
+
+// Reload applies the reloadable settings that changed, returning their names.
+// Others are only logged, since they need a restart.  If the new settings are
+// invalid none are applied.
+func (s *Settings) Reload() ([]string, error) {
+	changes, err := s.Changes()
+	if err != nil {
+		return nil, err
+	}
+
+	settingsLocker.Lock()
+	defer settingsLocker.Unlock()
+
+	previous := make(map[string]string)
+	restore := func() {
+		for name, v := range previous {
+			s.flags.Set(name, v)
+		}
+	}
+
+	applied := []string{}
+	for _, name := range sortedKeys(changes) {
+		if !reloadable[name] {
+			log.Printf("%s changed, restart to apply it", name)
+			continue
+		}
+		previous[name] = s.flags.Lookup(name).Value.String()
+		if err := s.flags.Set(name, changes[name]); err != nil {
+			restore()
+			return nil, fmt.Errorf("invalid %s '%s': %v", name, changes[name], err)
+		}
+		applied = append(applied, name)
+	}
+	if err := validateSettings(); err != nil {
+		restore()
+		return nil, err
+	}
+	return applied, nil
+}
+
+// validateSettings checks the settings make sense together, reporting every
+// problem at once
+func validateSettings() error {
+	problems := []string{}
+	check := func(err error) {
+		if err != nil {
+			problems = append(problems, err.Error())
+		}
+	}
+	checkf := func(ok bool, format string, args ...interface{}) {
+		if !ok {
+			problems = append(problems, fmt.Sprintf(format, args...))
+		}
+	}
+
+	checkf(addr != "", "addr must be set")
+	checkf(lat >= -90 && lat <= 90, "lat %v must be between -90 and 90", lat)
+	checkf(long >= -180 && long <= 180, "long %v must be between -180 and 180", long)
+	checkf(storageKind == "json" || storageKind == "journal" || storageKind == "kv", "unknown storage '%s', expected json, journal or kv", storageKind)
+	checkf(compactEvery >= 1, "compactEvery must be at least 1")
+	checkf(saveDelay <= saveMaxDelay, "saveDelay must not be longer than saveMaxDelay")
+	checkf(queueSize >= 1, "socketQueue must be at least 1")
+	checkf(historySize >= 0, "socketHistory must not be negative")
+	checkf(idleTimeout <= 0 || (pingInterval > 0 && pingInterval < idleTimeout), "socketPing must be set and shorter than socketIdle")
+	checkf((tlsCert == "") == (tlsKey == ""), "tlsCert and tlsKey must be given together")
+
+	_, err := ParseConflictPolicy(conflicts)
+	check(err)
+	_, err = ParseSyncPolicy(journalSync)
+	check(err)
+	_, err = ParseEncryptMode(encryptMode)
+	check(err)
+	_, err = ParseOverflowPolicy(overflow)
+	check(err)
+	_, err = ParseOriginPolicy(origins)
+	check(err)
+	_, err = ParseRole(anonRole)
+	check(err)
+	_, err = ParseBasePath(basePath)
+	check(err)
+
+	if len(problems) > 0 {
+		return fmt.Errorf("invalid settings:\n  %s", strings.Join(problems, "\n  "))
+	}
+	return nil
+}
+
+func containsString(list []string, s string) bool {
+	for _, l := range list {
+		if l == s {
+			return true
+		}
+	}
+	return false
+}
+
+func sortedKeys(m map[string]string) []string {
+	ret := make([]string, 0, len(m))
+	for k := range m {
+		ret = append(ret, k)
+	}
+	sort.Strings(ret)
+	return ret
+}
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"flag"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestSettings(t *testing.T) {
+	dir, err := ioutil.TempDir("", "config")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// a flag set of our own, so the command line's is left alone, with the
+	// variables put back for other tests
+	flags := flag.NewFlagSet("test", flag.ContinueOnError)
+	registerFlags(flags)
+	defaults := map[string]string{}
+	flags.VisitAll(func(f *flag.Flag) { defaults[f.Name] = f.Value.String() })
+	defer func() {
+		restore := flag.NewFlagSet("restore", flag.ContinueOnError)
+		registerFlags(restore)
+		for name, v := range defaults {
+			restore.Set(name, v)
+		}
+	}()
+
+	path := filepath.Join(dir, "config.json")
+	write := func(content string) {
+		if err := ioutil.WriteFile(path, []byte(content), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if envName("socketWriteTimeout") != "MIRROR_SOCKET_WRITE_TIMEOUT" {
+		t.Errorf("unexpected environment variable %s", envName("socketWriteTimeout"))
+	}
+
+	write(`{"server": {"address": ":80"}}`)
+	if _, err := LoadSettings(flags, path); err == nil || !strings.Contains(err.Error(), "server.address") {
+		t.Errorf("expected an unknown setting to be reported, got %v", err)
+	}
+
+	write(`{"weather": {"lat": 91, "long": "west"}}`)
+	if _, err := LoadSettings(flags, path); err == nil || !strings.Contains(err.Error(), "long") {
+		t.Errorf("expected an invalid value to be reported, got %v", err)
+	}
+
+	write(`{
+		"weather": {"weatherKey": "from file", "lat": 45.5, "long": -93},
+		"persistence": {"saveDelay": "1s"},
+		"security": {"anonymousRole": "none"}
+	}`)
+	os.Setenv("MIRROR_WEATHER_KEY", "from env")
+	defer os.Unsetenv("MIRROR_WEATHER_KEY")
+
+	settings := &Settings{path: path, flags: flags, explicit: map[string]bool{"anonymousRole": true}}
+	values, err := settings.read()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if values["weatherKey"] != "from env" || values["lat"] != "45.5" || values["saveDelay"] != "1s" {
+		t.Errorf("expected the environment to win over the file, got %v", values)
+	}
+	if _, ok := values["anonymousRole"]; ok {
+		t.Errorf("expected the command line to win over the file")
+	}
+
+	// only the reloadable settings change without a restart, and only if
+	// they're valid
+	if applied, err := settings.Reload(); err != nil {
+		t.Fatal(err)
+	} else if strings.Join(applied, ",") != "lat,long,weatherKey" {
+		t.Errorf("expected the weather settings to be reloaded, got %v", applied)
+	}
+	if saveDelay.String() != defaults["saveDelay"] {
+		t.Errorf("expected saveDelay to wait for a restart, got %v", saveDelay)
+	}
+	if lat != 45.5 || weatherKey != "from env" {
+		t.Errorf("expected the new weather settings, got %v %s", lat, weatherKey)
+	}
+
+	write(`{"weather": {"lat": 100}}`)
+	if _, err := settings.Reload(); err == nil || !strings.Contains(err.Error(), "between -90 and 90") {
+		t.Errorf("expected an invalid latitude to be refused, got %v", err)
+	} else if lat != 45.5 {
+		t.Errorf("expected the latitude to be left alone, got %v", lat)
+	}
+
+	// the same value written differently isn't a change
+	write(`{"weather": {"lat": 45.50, "weatherKey": "from env"}, "persistence": {"saveMaxDelay": "10000ms"}}`)
+	if changes, err := settings.Changes(); err != nil {
+		t.Fatal(err)
+	} else if len(changes) != 0 {
+		t.Errorf("expected no changes, got %v", changes)
+	}
+
+	// flags parsed from the command line win over the file
+	if err := flags.Parse([]string{"-anonymousRole", "viewer"}); err != nil {
+		t.Fatal(err)
+	}
+	write(`{"security": {"anonymousRole": "none"}}`)
+	if _, err := LoadSettings(flags, path); err != nil {
+		t.Fatal(err)
+	} else if anonRole != "viewer" {
+		t.Errorf("expected the command line to win, got %s", anonRole)
+	}
+}
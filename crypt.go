@@ -0,0 +1,392 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"reflect"
+	"strings"
+)
+
+// EncryptMode selects what is encrypted when state is persisted
+type EncryptMode string
+
+const (
+	// EncryptNone writes plaintext, although encrypted data can still be read
+	EncryptNone EncryptMode = "none"
+	// EncryptFields encrypts the fields tagged `api:"sensitive"` and blobs
+	EncryptFields EncryptMode = "fields"
+	// EncryptFile encrypts whole documents, journal entries and blobs
+	EncryptFile EncryptMode = "file"
+)
+
+// envelopeKey marks an encrypted value in a JSON document: {"$encrypted": "..."}
+const envelopeKey = "$encrypted"
+
+// sealedMagic starts every sealed byte string, followed by the key id, the
+// nonce and the AES-GCM ciphertext
+var sealedMagic = []byte("MENC")
+
+const keyIDSize = 4
+
+// encryption is used to seal and open everything persisted; nil means no keys
+// were configured and everything is plaintext
+var encryption *Encryption
+
+type stateKey struct {
+	id   []byte
+	aead cipher.AEAD
+}
+
+// Encryption seals data with the first of its keys and opens data sealed with
+// any of them.  A key is rotated by adding a new one to the front of the list;
+// the old one can be removed once everything has been rewritten, which
+// happens at startup whenever encryption is enabled.
+type Encryption struct {
+	mode EncryptMode
+	keys []stateKey
+}
+
+// ParseEncryptMode validates an encryption mode name
+func ParseEncryptMode(s string) (EncryptMode, error) {
+	switch m := EncryptMode(s); m {
+	case EncryptNone, EncryptFields, EncryptFile:
+		return m, nil
+	}
+	return "", fmt.Errorf("unknown encryption mode '%s'", s)
+}
+
+// LoadEncryption reads 256 bit keys, hex or base64 encoded, one per line from
+// keyFile followed by any comma separated in env.  It returns nil if there are
+// no keys and the mode is EncryptNone.
+func LoadEncryption(mode EncryptMode, keyFile string, env string) (*Encryption, error) {
+	encoded := []string{}
+
+	if keyFile != "" {
+		f, err := os.Open(keyFile)
+		if err != nil {
+			return nil, err
+		}
+		defer f.Close()
+
+		scanner := bufio.NewScanner(f)
+		for scanner.Scan() {
+			if line := strings.TrimSpace(scanner.Text()); line != "" && !strings.HasPrefix(line, "#") {
+				encoded = append(encoded, line)
+			}
+		}
+		if err := scanner.Err(); err != nil {
+			return nil, err
+		}
+	}
+	for _, k := range strings.Split(env, ",") {
+		if k = strings.TrimSpace(k); k != "" {
+			encoded = append(encoded, k)
+		}
+	}
+
+	if len(encoded) == 0 {
+		if mode != EncryptNone {
+			return nil, fmt.Errorf("encryption mode '%s' needs a key file or environment variable", mode)
+		}
+		return nil, nil
+	}
+
+	e := &Encryption{mode: mode}
+	for i, k := range encoded {
+		key, err := decodeKey(k)
+		if err != nil {
+			return nil, fmt.Errorf("key %d: %v", i+1, err)
+		}
+		block, err := aes.NewCipher(key)
+		if err != nil {
+			return nil, err
+		}
+		aead, err := cipher.NewGCM(block)
+		if err != nil {
+			return nil, err
+		}
+		sum := sha256.Sum256(key)
+		e.keys = append(e.keys, stateKey{id: sum[:keyIDSize], aead: aead})
+	}
+	return e, nil
+}
+
+func decodeKey(s string) ([]byte, error) {
+	if b, err := hex.DecodeString(s); err == nil && len(b) == 32 {
+		return b, nil
+	}
+	if b, err := base64.StdEncoding.DecodeString(s); err == nil && len(b) == 32 {
+		return b, nil
+	}
+	return nil, fmt.Errorf("keys must be 32 bytes, hex or base64 encoded")
+}
+
+// Seal encrypts data with the current key
+func (e *Encryption) Seal(data []byte) ([]byte, error) {
+	key := e.keys[0]
+
+	nonce := make([]byte, key.aead.NonceSize())
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return nil, err
+	}
+
+	ret := make([]byte, 0, len(sealedMagic)+keyIDSize+len(nonce)+len(data)+key.aead.Overhead())
+	ret = append(ret, sealedMagic...)
+	ret = append(ret, key.id...)
+	ret = append(ret, nonce...)
+	return key.aead.Seal(ret, nonce, data, nil), nil
+}
+
+// Sealed reports whether data was sealed, and with the current key
+func (e *Encryption) Sealed(data []byte) (sealed bool, current bool) {
+	if !bytes.HasPrefix(data, sealedMagic) || len(data) < len(sealedMagic)+keyIDSize {
+		return false, false
+	}
+	id := data[len(sealedMagic) : len(sealedMagic)+keyIDSize]
+	return true, bytes.Equal(id, e.keys[0].id)
+}
+
+// Open decrypts sealed data with whichever key sealed it.  Data that was not
+// sealed is returned as is.
+func (e *Encryption) Open(data []byte) ([]byte, error) {
+	if sealed, _ := e.Sealed(data); !sealed {
+		return data, nil
+	}
+
+	id := data[len(sealedMagic) : len(sealedMagic)+keyIDSize]
+	for _, key := range e.keys {
+		if !bytes.Equal(id, key.id) {
+			continue
+		}
+
+		rest := data[len(sealedMagic)+keyIDSize:]
+		if len(rest) < key.aead.NonceSize() {
+			return nil, fmt.Errorf("sealed data is truncated")
+		}
+		return key.aead.Open(nil, rest[:key.aead.NonceSize()], rest[key.aead.NonceSize():], nil)
+	}
+	return nil, fmt.Errorf("no key with id %x", id)
+}
+
+// envelope seals an encoded JSON value into {"$encrypted": "..."}
+func (e *Encryption) envelope(b []byte) (map[string]interface{}, error) {
+	sealed, err := e.Seal(b)
+	if err != nil {
+		return nil, err
+	}
+	return map[string]interface{}{envelopeKey: base64.StdEncoding.EncodeToString(sealed)}, nil
+}
+
+// SealDocument encrypts the JSON document b, a value of type t, according to
+// the encryption mode: either as a whole or field by field
+func (e *Encryption) SealDocument(b []byte, t reflect.Type) ([]byte, error) {
+	if e == nil || e.mode == EncryptNone {
+		return b, nil
+	}
+
+	if e.mode == EncryptFile {
+		env, err := e.envelope(b)
+		if err != nil {
+			return nil, err
+		}
+		return json.Marshal(env)
+	}
+
+	doc, err := decodeDocument(b)
+	if err != nil {
+		return nil, err
+	}
+	if doc, err = e.sealFields(doc, t); err != nil {
+		return nil, err
+	}
+	return json.MarshalIndent(doc, "", "  ")
+}
+
+// sealFields replaces the values of sensitive fields found in doc with envelopes
+func (e *Encryption) sealFields(doc interface{}, t reflect.Type) (interface{}, error) {
+	for t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+
+	var err error
+	switch t.Kind() {
+	case reflect.Struct:
+		m, ok := doc.(map[string]interface{})
+		if !ok {
+			return doc, nil
+		}
+		for k, v := range m {
+			f, ok := jsonField(t, k)
+			if !ok || v == nil {
+				continue
+			}
+			if sensitiveField(f) {
+				b, err := json.Marshal(v)
+				if err != nil {
+					return nil, err
+				}
+				if m[k], err = e.envelope(b); err != nil {
+					return nil, err
+				}
+			} else if m[k], err = e.sealFields(v, f.Type); err != nil {
+				return nil, err
+			}
+		}
+	case reflect.Slice, reflect.Array:
+		if a, ok := doc.([]interface{}); ok {
+			for i := range a {
+				if a[i], err = e.sealFields(a[i], t.Elem()); err != nil {
+					return nil, err
+				}
+			}
+		}
+	case reflect.Map:
+		if m, ok := doc.(map[string]interface{}); ok {
+			for k := range m {
+				if m[k], err = e.sealFields(m[k], t.Elem()); err != nil {
+					return nil, err
+				}
+			}
+		}
+	}
+	return doc, nil
+}
+
+func sensitiveField(f reflect.StructField) bool {
+	for _, opt := range strings.Split(f.Tag.Get("api"), ",") {
+		if strings.TrimSpace(opt) == "sensitive" {
+			return true
+		}
+	}
+	return false
+}
+
+// OpenDocument decrypts every envelope in the JSON document b, whether it
+// wraps the whole document or a single field
+func (e *Encryption) OpenDocument(b []byte) ([]byte, error) {
+	// only documents mentioning the key can hold envelopes, so others are
+	// left alone without decoding them
+	if !bytes.Contains(b, []byte(`"`+envelopeKey+`"`)) {
+		return b, nil
+	}
+
+	doc, err := decodeDocument(b)
+	if err != nil {
+		return nil, err
+	}
+	if !hasEnvelope(doc) {
+		// the key was only in the data
+		return b, nil
+	} else if e == nil {
+		return nil, fmt.Errorf("state is encrypted but no key was given")
+	}
+
+	if doc, err = e.openValue(doc); err != nil {
+		return nil, err
+	}
+	return json.Marshal(doc)
+}
+
+// isEnvelope reports whether v is an encrypted value, an object with only the
+// envelope key and a string for it
+func isEnvelope(v map[string]interface{}) bool {
+	_, ok := v[envelopeKey].(string)
+	return ok && len(v) == 1
+}
+
+// hasEnvelope reports whether there is an encrypted value anywhere in doc
+func hasEnvelope(doc interface{}) bool {
+	switch v := doc.(type) {
+	case map[string]interface{}:
+		if isEnvelope(v) {
+			return true
+		}
+		for _, c := range v {
+			if hasEnvelope(c) {
+				return true
+			}
+		}
+	case []interface{}:
+		for _, c := range v {
+			if hasEnvelope(c) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func (e *Encryption) openValue(doc interface{}) (interface{}, error) {
+	var err error
+	switch v := doc.(type) {
+	case map[string]interface{}:
+		if isEnvelope(v) {
+			s := v[envelopeKey].(string)
+			sealed, err := base64.StdEncoding.DecodeString(s)
+			if err != nil {
+				return nil, err
+			}
+			b, err := e.Open(sealed)
+			if err != nil {
+				return nil, err
+			}
+			if doc, err = decodeDocument(b); err != nil {
+				return nil, err
+			}
+			return e.openValue(doc)
+		}
+		for k := range v {
+			if v[k], err = e.openValue(v[k]); err != nil {
+				return nil, err
+			}
+		}
+	case []interface{}:
+		for i := range v {
+			if v[i], err = e.openValue(v[i]); err != nil {
+				return nil, err
+			}
+		}
+	}
+	return doc, nil
+}
+
+// SealLine encrypts a whole journal entry unless the mode is EncryptNone
+func (e *Encryption) SealLine(b []byte) ([]byte, error) {
+	if e == nil || e.mode == EncryptNone {
+		return b, nil
+	}
+	env, err := e.envelope(b)
+	if err != nil {
+		return nil, err
+	}
+	return json.Marshal(env)
+}
+
+// SealBlob encrypts blob contents unless the mode is EncryptNone
+func (e *Encryption) SealBlob(data []byte) ([]byte, error) {
+	if e == nil || e.mode == EncryptNone {
+		return data, nil
+	}
+	return e.Seal(data)
+}
+
+// OpenBlob decrypts blob contents if they were sealed
+func (e *Encryption) OpenBlob(data []byte) ([]byte, error) {
+	if e == nil {
+		if bytes.HasPrefix(data, sealedMagic) {
+			return nil, fmt.Errorf("blob is encrypted but no key was given")
+		}
+		return data, nil
+	}
+	return e.Open(data)
+}
@@ -0,0 +1,127 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+const (
+	testKey1 = "000102030405060708090a0b0c0d0e0f101112131415161718191a1b1c1d1e1f"
+	testKey2 = "1f1e1d1c1b1a191817161514131211100f0e0d0c0b0a09080706050403020100"
+)
+
+func TestEncryptionRoundTrip(t *testing.T) {
+	defer func() { encryption = nil }()
+
+	for _, mode := range []EncryptMode{EncryptFields, EncryptFile} {
+		path, cleanup := copyFixture(t, "state-v0.json")
+
+		var err error
+		if encryption, err = LoadEncryption(mode, "", testKey1); err != nil {
+			t.Fatal(err)
+		}
+
+		local := new(State)
+		if err := local.Load(path); err != nil {
+			t.Fatal(err)
+		}
+		hash := local.Faces.Detections[0].Image.Hash
+		if err := local.Save(path); err != nil {
+			t.Fatal(err)
+		}
+
+		b, _ := ioutil.ReadFile(path)
+		if bytes.Contains(b, []byte(hash)) {
+			t.Errorf("%s: sensitive data written in plaintext", mode)
+		}
+		if mode == EncryptFields && !strings.Contains(string(b), `"powerStatus"`) {
+			t.Errorf("%s: expected other fields to stay readable", mode)
+		}
+
+		// a new key in front of the old one still reads what the old one wrote
+		if encryption, err = LoadEncryption(mode, "", testKey2+","+testKey1); err != nil {
+			t.Fatal(err)
+		}
+		reloaded := new(State)
+		if err := reloaded.Load(path); err != nil {
+			t.Fatal(err)
+		} else if reloaded.Faces.Detections[0].Image.Hash != hash {
+			t.Errorf("%s: expected %s after decrypting, got %#v", mode, hash, reloaded.Faces.Detections[0])
+		}
+
+		// without any key it can't be read
+		encryption = nil
+		if err := new(State).Load(path); err == nil {
+			t.Errorf("%s: expected an error loading without a key", mode)
+		}
+
+		cleanup()
+	}
+}
+
+func TestBlobReseal(t *testing.T) {
+	dir, err := ioutil.TempDir("", "blobs")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	defer func() { encryption = nil }()
+
+	blobs, _ := NewBlobStore(dir)
+	hash, err := blobs.Put("text/plain", []byte("hello"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if encryption, err = LoadEncryption(EncryptFields, "", testKey1); err != nil {
+		t.Fatal(err)
+	}
+	if n, err := blobs.Reseal(); err != nil || n != 1 {
+		t.Fatalf("expected 1 blob resealed, got %d %v", n, err)
+	}
+
+	data, _ := ioutil.ReadFile(filepath.Join(dir, hash))
+	if sealed, current := encryption.Sealed(data); !sealed || !current {
+		t.Errorf("blob not sealed with the current key")
+	}
+	if contentType, data, err := blobs.Read(hash); err != nil || contentType != "text/plain" || string(data) != "hello" {
+		t.Errorf("unexpected blob %s %q %v", contentType, data, err)
+	}
+}
+
+func TestOpenDocumentPlaintext(t *testing.T) {
+	defer func() { encryption = nil }()
+
+	// the envelope key in the data isn't an envelope
+	docs := []string{
+		`{"name":"$encrypted"}`,
+		`{"notes":{"$encrypted":"abc","other":1}}`,
+		`{"list":[{"$encrypted":3}]}`,
+	}
+	for _, doc := range docs {
+		encryption = nil
+		if b, err := encryption.OpenDocument([]byte(doc)); err != nil || string(b) != doc {
+			t.Errorf("expected %s left alone without a key, got %s %v", doc, b, err)
+		}
+
+		var err error
+		if encryption, err = LoadEncryption(EncryptFile, "", testKey1); err != nil {
+			t.Fatal(err)
+		}
+		if b, err := encryption.OpenDocument([]byte(doc)); err != nil || string(b) != doc {
+			t.Errorf("expected %s left alone, got %s %v", doc, b, err)
+		}
+	}
+
+	// a real envelope still needs the key
+	sealed, _ := encryption.SealDocument([]byte(`{"name":"mirror"}`), reflect.TypeOf(State{}))
+	encryption = nil
+	if _, err := encryption.OpenDocument(sealed); err == nil {
+		t.Errorf("expected an error opening an envelope without a key")
+	}
+}
@@ -0,0 +1,160 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/donniet/mirror.4/state"
+)
+
+const (
+	// csrfCookie holds the session's CSRF token, which our pages echo back
+	// from the template.  Other sites can send the cookie but can't read it.
+	csrfCookie = "mirror_csrf"
+	csrfHeader = "X-CSRF-Token"
+	csrfParam  = "csrf"
+)
+
+// OriginPolicy lists the origins, like "http://mirror.local:8081", whose pages
+// may open the websocket.  Empty allows only the origin the server was reached
+// at, and "*" allows any.
+type OriginPolicy []string
+
+// ParseOriginPolicy parses a comma separated list of origins
+func ParseOriginPolicy(s string) (OriginPolicy, error) {
+	ret := OriginPolicy{}
+	for _, o := range strings.Split(s, ",") {
+		if o = strings.TrimSpace(o); o == "" {
+			continue
+		} else if o == "*" {
+			ret = append(ret, o)
+			continue
+		}
+
+		u, err := url.Parse(o)
+		if err != nil || u.Scheme == "" || u.Host == "" || (u.Path != "" && u.Path != "/") {
+			return nil, fmt.Errorf("invalid origin '%s', expected scheme://host[:port]", o)
+		}
+		ret = append(ret, strings.ToLower(u.Scheme+"://"+u.Host))
+	}
+	return ret, nil
+}
+
+// Allowed reports whether the page that made r may use the websocket.
+// Requests without an Origin aren't from a browser and are allowed.
+func (p OriginPolicy) Allowed(r *http.Request) bool {
+	origin := r.Header.Get("Origin")
+	if origin == "" {
+		return true
+	}
+
+	u, err := url.Parse(origin)
+	if err != nil {
+		return false
+	}
+	if len(p) == 0 {
+		return strings.EqualFold(u.Host, r.Host)
+	}
+
+	origin = strings.ToLower(u.Scheme + "://" + u.Host)
+	for _, o := range p {
+		if o == "*" || o == origin {
+			return true
+		}
+	}
+	return false
+}
+
+// csrfToken returns the session's CSRF token for a page to embed, starting a
+// session if r doesn't have one
+func csrfToken(w http.ResponseWriter, r *http.Request) string {
+	if c, err := r.Cookie(csrfCookie); err == nil && c.Value != "" {
+		return c.Value
+	}
+
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		log.Printf("error creating CSRF token: %v", err)
+		return ""
+	}
+	token := base64.RawURLEncoding.EncodeToString(b)
+	http.SetCookie(w, &http.Cookie{
+		Name:     csrfCookie,
+		Value:    token,
+		Path:     "/",
+		HttpOnly: true,
+		Secure:   r.TLS != nil,
+		SameSite: http.SameSiteStrictMode,
+	})
+	return token
+}
+
+// crossSite reports whether a page on another site made r, going by the
+// Sec-Fetch-Site header browsers send, or else the Origin.  Requests with
+// neither, like those from the detector or curl, aren't made by a page.
+func crossSite(r *http.Request) bool {
+	switch r.Header.Get("Sec-Fetch-Site") {
+	case "same-origin", "none":
+		return false
+	case "":
+	default:
+		return true
+	}
+
+	origin := r.Header.Get("Origin")
+	if origin == "" {
+		return false
+	}
+	u, err := url.Parse(origin)
+	return err != nil || !strings.EqualFold(u.Host, r.Host)
+}
+
+// csrfVerified reports whether r came from one of our pages, by carrying the
+// session's CSRF token in the X-CSRF-Token header or csrf query parameter, or
+// doesn't need to because it wasn't made by a page on another site or was
+// authenticated with a token such a page can't have
+func csrfVerified(r *http.Request) bool {
+	if id := identityFrom(r.Context()); id != nil && id.Name != "" {
+		return true
+	} else if !crossSite(r) {
+		return true
+	}
+
+	c, err := r.Cookie(csrfCookie)
+	if err != nil || c.Value == "" {
+		return false
+	}
+	token := r.Header.Get(csrfHeader)
+	if token == "" {
+		token = r.URL.Query().Get(csrfParam)
+	}
+	return subtle.ConstantTimeCompare([]byte(token), []byte(c.Value)) == 1
+}
+
+// safeMethod reports whether method only reads, and so needs no CSRF token
+func safeMethod(method string) bool {
+	switch method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions,
+		MethodSubscribe, MethodUnsubscribe, MethodResume:
+		return true
+	}
+	return false
+}
+
+// RequireCSRF refuses requests to next that change something unless
+// csrfVerified
+func RequireCSRF(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !safeMethod(r.Method) && !csrfVerified(r) {
+			writeError(w, state.ForbiddenError("missing or invalid CSRF token"))
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,149 @@
+package main
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/donniet/mirror.4/state"
+	"github.com/gorilla/websocket"
+)
+
+func TestOriginPolicy(t *testing.T) {
+	if _, err := ParseOriginPolicy("mirror.local"); err == nil {
+		t.Errorf("expected an origin without a scheme to be refused")
+	}
+
+	same, _ := ParseOriginPolicy("")
+	listed, err := ParseOriginPolicy("http://Mirror.local:8081, https://phone.local")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		policy  OriginPolicy
+		origin  string
+		allowed bool
+	}{
+		{same, "", true},
+		{same, "http://localhost:8081", true},
+		{same, "http://evil.example", false},
+		{listed, "http://mirror.local:8081", true},
+		{listed, "https://phone.local", true},
+		{listed, "http://phone.local", false},
+		{listed, "http://localhost:8081", false},
+		{OriginPolicy{"*"}, "http://evil.example", true},
+	}
+	for _, test := range tests {
+		r := httptest.NewRequest(http.MethodGet, "http://localhost:8081/websocket", nil)
+		if test.origin != "" {
+			r.Header.Set("Origin", test.origin)
+		}
+		if allowed := test.policy.Allowed(r); allowed != test.allowed {
+			t.Errorf("%v allowing '%s': expected %v, got %v", test.policy, test.origin, test.allowed, allowed)
+		}
+	}
+}
+
+func TestCSRF(t *testing.T) {
+	local := new(State)
+	messages := make(chan StateMessage, 10)
+	server := &StateServer{messages: messages, server: state.NewServer(local)}
+	handler := RequireCSRF(server)
+
+	// a page gets a token, with a cookie to check it against
+	w := httptest.NewRecorder()
+	token := csrfToken(w, httptest.NewRequest(http.MethodGet, "/", nil))
+	cookies := w.Result().Cookies()
+	if token == "" || len(cookies) != 1 || cookies[0].Value != token {
+		t.Fatalf("expected a token and its cookie, got '%s' and %v", token, cookies)
+	}
+
+	// from a page on another site
+	request := func(method, token string) int {
+		r := httptest.NewRequest(method, "/display/powerStatus", bytes.NewBufferString(`"off"`))
+		r.Header.Set("Sec-Fetch-Site", "cross-site")
+		r.AddCookie(cookies[0])
+		if token != "" {
+			r.Header.Set(csrfHeader, token)
+		}
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, r)
+		return w.Code
+	}
+
+	if code := request(http.MethodGet, ""); code != http.StatusOK {
+		t.Errorf("expected reading without a token to be allowed, got %d", code)
+	}
+	if code := request(http.MethodPost, ""); code != http.StatusForbidden {
+		t.Errorf("expected a change without a token to be refused, got %d", code)
+	}
+	if code := request(http.MethodPost, "forged"); code != http.StatusForbidden {
+		t.Errorf("expected a change with the wrong token to be refused, got %d", code)
+	}
+	if code := request(http.MethodPost, token); code != http.StatusOK {
+		t.Errorf("expected a change with the token to be allowed, got %d", code)
+	}
+
+	// requests that no page made, like the detector's, and those from our own
+	// pages need no token
+	for _, test := range []struct {
+		header http.Header
+		status int
+	}{
+		{http.Header{}, http.StatusOK},
+		{http.Header{"Origin": {"http://example.com"}}, http.StatusOK},
+		{http.Header{"Sec-Fetch-Site": {"same-origin"}}, http.StatusOK},
+		{http.Header{"Origin": {"http://evil.example"}}, http.StatusForbidden},
+	} {
+		r := httptest.NewRequest(http.MethodPut, "/motion/detections", bytes.NewBufferString(`{"magnitude":1}`))
+		for k, v := range test.header {
+			r.Header[k] = v
+		}
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, r)
+		if w.Code != test.status {
+			t.Errorf("PUT with %v: expected %d, got %d", test.header, test.status, w.Code)
+		}
+	}
+
+	// the websocket takes the token when connecting
+	socks := NewSockets(server, nil, SocketConfig{QueueSize: 10, Overflow: OverflowCoalesce, HistorySize: 10})
+	ts := httptest.NewServer(socks)
+	defer ts.Close()
+	defer socks.Close()
+
+	url := "ws" + strings.TrimPrefix(ts.URL, "http")
+	header := http.Header{"Cookie": {cookies[0].String()}, "Sec-Fetch-Site": {"same-site"}}
+	for _, test := range []struct {
+		query  string
+		status int
+	}{
+		{"", http.StatusForbidden},
+		{"?" + csrfParam + "=" + token, http.StatusOK},
+	} {
+		conn, _, err := websocket.DefaultDialer.Dial(url+test.query, header)
+		if err != nil {
+			t.Fatal(err)
+		}
+		conn.WriteJSON(map[string]interface{}{"id": "1", "method": "POST", "path": "display/powerStatus", "body": "on"})
+		reply := SocketReply{}
+		if err := conn.ReadJSON(&reply); err != nil {
+			t.Fatal(err)
+		} else if reply.Status != test.status {
+			t.Errorf("connecting with '%s': expected %d, got %d", test.query, test.status, reply.Status)
+		}
+		conn.Close()
+	}
+
+	// and pages from other sites can't connect at all
+	header.Del("Sec-Fetch-Site")
+	header.Set("Origin", "http://evil.example")
+	if _, res, err := websocket.DefaultDialer.Dial(url, header); err == nil {
+		t.Errorf("expected a websocket from another origin to be refused")
+	} else if res != nil && res.StatusCode != http.StatusForbidden {
+		t.Errorf("expected 403 for another origin, got %d", res.StatusCode)
+	}
+}
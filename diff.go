@@ -0,0 +1,165 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"reflect"
+	"sort"
+	"strings"
+)
+
+// decodeDocument decodes b keeping numbers as json.Number so documents can be
+// compared and re-encoded without losing precision
+func decodeDocument(b []byte) (interface{}, error) {
+	var doc interface{}
+
+	dec := json.NewDecoder(bytes.NewReader(b))
+	dec.UseNumber()
+	if err := dec.Decode(&doc); err != nil {
+		return nil, err
+	}
+	return doc, nil
+}
+
+// mergeDocuments applies patch to doc as a JSON merge patch (RFC 7386):
+// objects are merged key by key, null removes a key and anything else
+// replaces the value in doc
+func mergeDocuments(doc, patch interface{}) interface{} {
+	p, ok := patch.(map[string]interface{})
+	if !ok {
+		return patch
+	}
+	d, ok := doc.(map[string]interface{})
+	if !ok {
+		d = make(map[string]interface{})
+	}
+
+	for k, v := range p {
+		if v == nil {
+			delete(d, k)
+		} else {
+			d[k] = mergeDocuments(d[k], v)
+		}
+	}
+	return d
+}
+
+// jsonField finds the struct field encoded under name
+func jsonField(t reflect.Type, name string) (reflect.StructField, bool) {
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		if f.PkgPath != "" {
+			continue
+		}
+
+		tag := f.Tag.Get("json")
+		if comma := strings.Index(tag, ","); comma >= 0 {
+			tag = tag[:comma]
+		}
+		if tag == "-" {
+			continue
+		}
+		if tag == name || (tag == "" && f.Name == name) {
+			return f, true
+		}
+	}
+	return reflect.StructField{}, false
+}
+
+// typeAtPath returns the type found by following a '/' separated path from t,
+// or nil if the path does not exist
+func typeAtPath(t reflect.Type, path string) reflect.Type {
+	for _, segment := range strings.Split(path, "/") {
+		for t.Kind() == reflect.Ptr {
+			t = t.Elem()
+		}
+		if segment == "" {
+			continue
+		}
+
+		switch t.Kind() {
+		case reflect.Struct:
+			f, ok := jsonField(t, segment)
+			if !ok {
+				return nil
+			}
+			t = f.Type
+		case reflect.Slice, reflect.Array, reflect.Map:
+			t = t.Elem()
+		default:
+			return nil
+		}
+	}
+	return t
+}
+
+// diffDocuments returns the messages that turn the decoded document from into
+// to, where both are values of type t found at path.  Changed values are
+// POSTed, new map keys are PUT and removed map keys are DELETEd, so the
+// messages can be applied by a state.Server as well as by clients.
+func diffDocuments(path string, t reflect.Type, from, to interface{}) []StateMessage {
+	for t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+
+	f, fok := from.(map[string]interface{})
+	o, ook := to.(map[string]interface{})
+
+	if !fok || !ook || (t.Kind() != reflect.Struct && t.Kind() != reflect.Map) {
+		if reflect.DeepEqual(from, to) {
+			return nil
+		}
+		return []StateMessage{documentMessage(http.MethodPost, path, to)}
+	}
+
+	keys := make([]string, 0, len(f)+len(o))
+	for k := range f {
+		keys = append(keys, k)
+	}
+	for k := range o {
+		if _, ok := f[k]; !ok {
+			keys = append(keys, k)
+		}
+	}
+	sort.Strings(keys)
+
+	ret := []StateMessage{}
+	for _, k := range keys {
+		child := path + "/" + k
+		if path == "" {
+			child = k
+		}
+
+		var elem reflect.Type
+		if t.Kind() == reflect.Map {
+			elem = t.Elem()
+		} else if field, ok := jsonField(t, k); ok {
+			elem = field.Type
+		} else {
+			continue
+		}
+
+		fv, inFrom := f[k]
+		ov, inTo := o[k]
+
+		switch {
+		case t.Kind() == reflect.Map && !inTo:
+			ret = append(ret, documentMessage(http.MethodDelete, child, nil))
+		case t.Kind() == reflect.Map && !inFrom:
+			ret = append(ret, documentMessage(http.MethodPut, child, ov))
+		default:
+			ret = append(ret, diffDocuments(child, elem, fv, ov)...)
+		}
+	}
+	return ret
+}
+
+func documentMessage(method string, path string, value interface{}) StateMessage {
+	msg := StateMessage{Method: method, Path: path}
+	if method != http.MethodDelete {
+		b, _ := json.Marshal(value)
+		msg.Body = (*json.RawMessage)(&b)
+	}
+	return msg
+}
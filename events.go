@@ -0,0 +1,175 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// eventID names a broadcast for Last-Event-ID: the hub's epoch and the seq
+func eventID(epoch string, seq uint64) string {
+	return fmt.Sprintf("%s-%d", epoch, seq)
+}
+
+func parseEventID(id string) (string, uint64, bool) {
+	i := strings.LastIndex(id, "-")
+	if i < 0 {
+		return "", 0, false
+	}
+	seq, err := strconv.ParseUint(id[i+1:], 10, 64)
+	if err != nil {
+		return "", 0, false
+	}
+	return id[:i], seq, true
+}
+
+// writeEvent writes a server-sent event, splitting data over as many data
+// lines as it has lines
+func writeEvent(w http.ResponseWriter, id string, event string, data []byte) error {
+	buf := &bytes.Buffer{}
+	if id != "" {
+		fmt.Fprintf(buf, "id: %s\n", id)
+	}
+	if event != "" {
+		fmt.Fprintf(buf, "event: %s\n", event)
+	}
+	for _, line := range bytes.Split(data, []byte("\n")) {
+		fmt.Fprintf(buf, "data: %s\n", line)
+	}
+	buf.WriteString("\n")
+
+	_, err := w.Write(buf.Bytes())
+	return err
+}
+
+// Events streams the same broadcasts as the websocket as server-sent events.
+// Each "path" query parameter subscribes to a path pattern as a websocket
+// subscribe does; without any every change is sent.  A client reconnecting
+// with Last-Event-ID (or the lastEventId query parameter) gets the changes it
+// missed, or a "state" event with the whole state if they are gone.
+func (socks *Sockets) Events(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not supported", http.StatusMethodNotAllowed)
+		return
+	}
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "streaming not supported", http.StatusInternalServerError)
+		return
+	}
+
+	c := SocketConn{
+		queue:    newSocketQueue(socks.config.QueueSize, socks.config.Overflow),
+		subs:     newSubscriptions(),
+		counters: socks.counters,
+		info:     newConnInfo(r, "events"),
+	}
+	for _, pattern := range r.URL.Query()["path"] {
+		c.subs.subscribe(pattern)
+	}
+
+	lastID := r.Header.Get("Last-Event-ID")
+	if lastID == "" {
+		lastID = r.URL.Query().Get("lastEventId")
+	}
+
+	socks.locker.Lock()
+	if max := socks.config.MaxConnections; max > 0 && len(socks.connections) >= max {
+		socks.locker.Unlock()
+
+		log.Printf("refusing event stream client %s, already at %d connections", c.info.remoteAddr, max)
+		c.counters.add(func(s *SocketStats) { s.Refused++ })
+		http.Error(w, "too many connections", http.StatusServiceUnavailable)
+		return
+	}
+	socks.connections[c.info] = c
+
+	// catch up while nothing can be broadcast, so nothing is missed or repeated
+	var full *socketResponse
+	res := ResumeReply{Epoch: socks.history.epoch, Seq: socks.history.seq, Resumed: true}
+	if lastID != "" {
+		epoch, seq, _ := parseEventID(lastID)
+		if res = socks.catchUp(c, epoch, seq); !res.Resumed {
+			full = socks.fullState()
+		}
+	}
+	socks.locker.Unlock()
+
+	defer func() {
+		c.queue.close()
+
+		socks.locker.Lock()
+		defer socks.locker.Unlock()
+		delete(socks.connections, c.info)
+	}()
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	// don't let a proxy hold the stream back
+	w.Header().Set("X-Accel-Buffering", "no")
+	w.WriteHeader(http.StatusOK)
+
+	if full != nil {
+		if full.status != http.StatusOK {
+			return
+		}
+		if err := writeEvent(w, eventID(res.Epoch, res.Seq), "state", bytes.TrimSpace(full.body.Bytes())); err != nil {
+			return
+		}
+	}
+	flusher.Flush()
+
+	var tick <-chan time.Time
+	if socks.config.PingInterval > 0 {
+		ticker := time.NewTicker(socks.config.PingInterval)
+		defer ticker.Stop()
+		tick = ticker.C
+	}
+
+	for {
+		select {
+		case <-c.queue.ready:
+		case <-tick:
+			// a comment keeps proxies from timing the stream out and finds dead
+			// peers
+			if _, err := w.Write([]byte(": ping\n\n")); err != nil {
+				return
+			}
+			flusher.Flush()
+			continue
+		case <-r.Context().Done():
+			return
+		case <-socks.stopper:
+			return
+		}
+
+		for {
+			m, ok := c.queue.take()
+			if !ok {
+				break
+			} else if m.resync {
+				// the client missed changes, so end the stream and let it
+				// reconnect from the last event it saw
+				return
+			} else if !m.broadcast {
+				continue
+			}
+
+			if err := writeEvent(w, eventID(socks.history.epoch, m.seq), "", *m.data); err != nil {
+				log.Printf("error writing event: %v", err)
+				return
+			}
+			c.counters.add(func(s *SocketStats) { s.Sent++ })
+		}
+		flusher.Flush()
+		c.info.touch()
+
+		if c.queue.done() {
+			return
+		}
+	}
+}
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/donniet/mirror.4/state"
+)
+
+// readEvent reads the next event from an event stream, skipping comments
+func readEvent(t *testing.T, r *bufio.Reader) (id string, event string, data string) {
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			t.Fatal(err)
+		}
+		line = strings.TrimSuffix(line, "\n")
+
+		switch {
+		case line == "" && data != "":
+			return
+		case strings.HasPrefix(line, "id: "):
+			id = line[len("id: "):]
+		case strings.HasPrefix(line, "event: "):
+			event = line[len("event: "):]
+		case strings.HasPrefix(line, "data: "):
+			data += line[len("data: "):]
+		}
+	}
+}
+
+func TestEvents(t *testing.T) {
+	stateServer := &StateServer{server: state.NewServer(new(State))}
+	socks := NewSockets(stateServer, nil, SocketConfig{QueueSize: 10, Overflow: OverflowCoalesce, HistorySize: 2})
+	stateServer.hub = socks
+	server := httptest.NewServer(http.HandlerFunc(socks.Events))
+	defer server.Close()
+
+	connect := func(query string, lastID string) (*http.Response, *bufio.Reader) {
+		req, _ := http.NewRequest(http.MethodGet, server.URL+query, nil)
+		if lastID != "" {
+			req.Header.Set("Last-Event-ID", lastID)
+		}
+		res, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return res, bufio.NewReader(res.Body)
+	}
+
+	res, r := connect("?path=display", "")
+	socks.Write(StateMessage{Method: http.MethodPost, Path: "forecast"})
+	socks.Write(StateMessage{Method: http.MethodPost, Path: "display/powerStatus"})
+
+	id, _, data := readEvent(t, r)
+	msg := StateMessage{}
+	if err := json.Unmarshal([]byte(data), &msg); err != nil || msg.Path != "display/powerStatus" {
+		t.Errorf("expected only the display change, got %s", data)
+	}
+	res.Body.Close()
+	for socks.Status().Connections > 0 {
+		time.Sleep(5 * time.Millisecond)
+	}
+
+	// resuming replays what was missed
+	socks.Write(StateMessage{Method: http.MethodPost, Path: "display/brightness"})
+	res, r = connect("?path=display", id)
+	if _, _, data := readEvent(t, r); !strings.Contains(data, "display/brightness") {
+		t.Errorf("expected the missed change, got %s", data)
+	}
+	res.Body.Close()
+	for socks.Status().Connections > 0 {
+		time.Sleep(5 * time.Millisecond)
+	}
+
+	// once the history has rolled over the whole state is sent instead
+	socks.Write(StateMessage{Method: http.MethodPost, Path: "display/brightness"})
+	socks.Write(StateMessage{Method: http.MethodPost, Path: "display/brightness"})
+	res, r = connect("", id)
+	defer res.Body.Close()
+	if _, event, data := readEvent(t, r); event != "state" || !strings.Contains(data, `"display"`) {
+		t.Errorf("expected the whole state, got %s %s", event, data)
+	}
+}
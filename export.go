@@ -0,0 +1,385 @@
+package main
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"reflect"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/donniet/mirror.4/state"
+)
+
+const maxImportSize = 64 << 20
+
+// exportManifest describes the contents of an export archive
+type exportManifest struct {
+	Version int       `json:"version"`
+	Path    string    `json:"path"`
+	Created time.Time `json:"created"`
+}
+
+// ImportResult reports the changes an import made, or would make on a dry run
+type ImportResult struct {
+	Mode         string         `json:"mode"`
+	DryRun       bool           `json:"dryRun"`
+	Changes      []StateMessage `json:"changes"`
+	Blobs        int            `json:"blobs"`
+	MissingBlobs []string       `json:"missingBlobs,omitempty"`
+}
+
+// Archiver exports the state and its blobs as a gzipped tar archive and
+// imports such archives back into the state
+type Archiver struct {
+	server   *state.Server
+	blobs    *BlobStore
+	messages chan<- StateMessage
+}
+
+// Export writes an archive of the state, or the part of it at the "path" query
+// parameter, along with every blob it references
+func (a *Archiver) Export(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not supported", http.StatusMethodNotAllowed)
+		return
+	}
+
+	path := strings.Trim(r.URL.Query().Get("path"), "/")
+
+	b, err := a.server.Get(path)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	doc, err := decodeDocument(b)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	manifest, _ := json.Marshal(exportManifest{
+		Version: stateVersion(),
+		Path:    path,
+		Created: time.Now(),
+	})
+
+	w.Header().Set("Content-Type", "application/gzip")
+	w.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="mirror-%s.tar.gz"`, time.Now().Format("20060102-150405")))
+
+	gz := gzip.NewWriter(w)
+	tw := tar.NewWriter(gz)
+
+	err = writeTarFile(tw, "manifest.json", manifest)
+	if err == nil {
+		err = writeTarFile(tw, "state.json", b)
+	}
+	for _, hash := range documentBlobRefs(doc) {
+		if err != nil {
+			break
+		}
+		err = a.exportBlob(tw, hash)
+	}
+	if err == nil {
+		err = tw.Close()
+	}
+	if err == nil {
+		err = gz.Close()
+	}
+	if err != nil {
+		// the headers are gone, so all we can do is cut the archive short
+		panic(http.ErrAbortHandler)
+	}
+}
+
+func (a *Archiver) exportBlob(tw *tar.Writer, hash string) error {
+	// archives hold plaintext so they can be imported with different keys
+	contentType, data, err := a.blobs.Read(hash)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	if err := writeTarFile(tw, "blobs/"+hash+".type", []byte(contentType)); err != nil {
+		return err
+	}
+	return writeTarFile(tw, "blobs/"+hash, data)
+}
+
+func writeTarFile(tw *tar.Writer, name string, data []byte) error {
+	err := tw.WriteHeader(&tar.Header{
+		Name:    name,
+		Mode:    0660,
+		Size:    int64(len(data)),
+		ModTime: time.Now(),
+	})
+	if err != nil {
+		return err
+	}
+	_, err = tw.Write(data)
+	return err
+}
+
+// Import reads an archive written by Export and replaces (mode=replace, the
+// default) or merges (mode=merge) it into the state.  Replacing resets fields
+// the archive leaves out to their zero values.  The document is applied as a
+// single change, so an import either happens entirely or not at all.  With
+// dryRun set the changes are reported but nothing is modified.
+func (a *Archiver) Import(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not supported", http.StatusMethodNotAllowed)
+		return
+	}
+
+	query := r.URL.Query()
+	result := ImportResult{
+		Mode:   query.Get("mode"),
+		DryRun: query.Get("dryRun") != "" && query.Get("dryRun") != "0" && query.Get("dryRun") != "false",
+	}
+	if result.Mode == "" {
+		result.Mode = "replace"
+	} else if result.Mode != "replace" && result.Mode != "merge" {
+		writeError(w, state.BadRequestError(fmt.Sprintf("unknown import mode '%s'", result.Mode)))
+		return
+	}
+
+	manifest, imported, blobs, err := readArchive(http.MaxBytesReader(w, r.Body, maxImportSize))
+	if err != nil {
+		writeError(w, state.BadRequestError(err.Error()))
+		return
+	}
+
+	t := typeAtPath(reflect.TypeOf(State{}), manifest.Path)
+	if t == nil {
+		writeError(w, state.NotFoundError(fmt.Sprintf("'%s' not found", manifest.Path)))
+		return
+	}
+
+	if manifest.Path == "" {
+		if imported, err = migrateDocument(imported, manifest.Version); err != nil {
+			writeError(w, state.BadRequestError(err.Error()))
+			return
+		}
+	} else if manifest.Version != stateVersion() {
+		writeError(w, state.BadRequestError(fmt.Sprintf("partial export has version %d but only version %d can be imported", manifest.Version, stateVersion())))
+		return
+	}
+
+	b, err := a.server.Get(manifest.Path)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	current, err := decodeDocument(b)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	next := imported
+	if result.Mode == "merge" {
+		// merge into a fresh copy so current is left to diff against
+		base, _ := decodeDocument(b)
+		next = mergeDocuments(base, imported)
+	}
+	if err := validateDocument(t, next); err != nil {
+		writeError(w, state.BadRequestError(err.Error()))
+		return
+	}
+
+	for _, hash := range documentBlobRefs(next) {
+		if _, ok := blobs[hash]; !ok && !a.blobs.Has(hash) {
+			result.MissingBlobs = append(result.MissingBlobs, hash)
+		}
+	}
+	result.Blobs = len(blobs)
+
+	if !result.DryRun {
+		if len(result.MissingBlobs) > 0 {
+			writeError(w, state.BadRequestError(fmt.Sprintf("%d blobs are neither in the archive nor stored", len(result.MissingBlobs))))
+			return
+		}
+		for _, blob := range blobs {
+			if _, err := a.blobs.Put(blob.contentType, blob.data); err != nil {
+				writeError(w, err)
+				return
+			}
+		}
+		if next, err = a.blobs.storeDataURIs(next, t); err != nil {
+			writeError(w, err)
+			return
+		}
+	}
+	result.Changes = diffDocuments(manifest.Path, t, current, next)
+
+	if !result.DryRun && len(result.Changes) > 0 {
+		msg := documentMessage(http.MethodPost, manifest.Path, next)
+		if err := applyMessage(a.server, &msg); err != nil {
+			writeError(w, err)
+			return
+		}
+		a.messages <- msg
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(result)
+}
+
+type archiveBlob struct {
+	contentType string
+	data        []byte
+}
+
+// readArchive reads the manifest, the state document and the blobs out of an
+// export archive, checking that each blob matches its hash
+func readArchive(r io.Reader) (*exportManifest, interface{}, map[string]*archiveBlob, error) {
+	gz, err := gzip.NewReader(r)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	defer gz.Close()
+
+	var manifest *exportManifest
+	var doc interface{}
+	blobs := make(map[string]*archiveBlob)
+
+	blob := func(hash string) *archiveBlob {
+		if blobs[hash] == nil {
+			blobs[hash] = &archiveBlob{}
+		}
+		return blobs[hash]
+	}
+
+	tr := tar.NewReader(gz)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return nil, nil, nil, err
+		}
+
+		data, err := ioutil.ReadAll(tr)
+		if err != nil {
+			return nil, nil, nil, err
+		}
+
+		switch name := hdr.Name; {
+		case name == "manifest.json":
+			manifest = &exportManifest{}
+			if err := json.Unmarshal(data, manifest); err != nil {
+				return nil, nil, nil, fmt.Errorf("invalid manifest: %v", err)
+			}
+		case name == "state.json":
+			if doc, err = decodeDocument(data); err != nil {
+				return nil, nil, nil, fmt.Errorf("invalid state: %v", err)
+			}
+		case strings.HasPrefix(name, blobPrefix) && strings.HasSuffix(name, ".type"):
+			blob(strings.TrimSuffix(name[len(blobPrefix):], ".type")).contentType = string(data)
+		case strings.HasPrefix(name, blobPrefix):
+			hash := name[len(blobPrefix):]
+			if blobHash(data) != hash {
+				return nil, nil, nil, fmt.Errorf("blob '%s' does not match its hash", hash)
+			}
+			blob(hash).data = data
+		}
+	}
+
+	if manifest == nil || doc == nil {
+		return nil, nil, nil, fmt.Errorf("archive is missing manifest.json or state.json")
+	}
+	for hash, b := range blobs {
+		if b.data == nil {
+			delete(blobs, hash)
+		}
+	}
+	return manifest, doc, blobs, nil
+}
+
+// migrateDocument brings a full state document exported at version up to date
+func migrateDocument(doc interface{}, version int) (interface{}, error) {
+	m, ok := doc.(map[string]interface{})
+	if !ok {
+		return nil, fmt.Errorf("state must be an object")
+	}
+	m["version"] = version
+
+	b, err := json.Marshal(m)
+	if err != nil {
+		return nil, err
+	}
+	if b, _, err = migrateState(b); err != nil {
+		return nil, err
+	}
+	if doc, err = decodeDocument(b); err != nil {
+		return nil, err
+	}
+
+	delete(doc.(map[string]interface{}), "version")
+	return doc, nil
+}
+
+// validateDocument checks that doc decodes into a value of type t without any
+// unknown fields
+func validateDocument(t reflect.Type, doc interface{}) error {
+	b, err := json.Marshal(doc)
+	if err != nil {
+		return err
+	}
+
+	// only references decode, so check a copy with the data-uris replaced by
+	// references to where they would be stored
+	copied, err := decodeDocument(b)
+	if err != nil {
+		return err
+	}
+	if copied, err = mapBlobRefs(copied, t, dataURIRef); err != nil {
+		return err
+	}
+	if b, err = json.Marshal(copied); err != nil {
+		return err
+	}
+
+	dec := json.NewDecoder(strings.NewReader(string(b)))
+	dec.DisallowUnknownFields()
+	return dec.Decode(reflect.New(t).Interface())
+}
+
+// documentBlobRefs returns the hashes of every blob reference in a decoded
+// document
+func documentBlobRefs(doc interface{}) []string {
+	refs := make(map[string]bool)
+
+	var walk func(v interface{})
+	walk = func(v interface{}) {
+		switch v := v.(type) {
+		case map[string]interface{}:
+			for _, c := range v {
+				walk(c)
+			}
+		case []interface{}:
+			for _, c := range v {
+				walk(c)
+			}
+		case string:
+			if strings.HasPrefix(v, blobPrefix) && validHash(v[len(blobPrefix):]) {
+				refs[v[len(blobPrefix):]] = true
+			}
+		}
+	}
+	walk(doc)
+
+	ret := make([]string, 0, len(refs))
+	for hash := range refs {
+		ret = append(ret, hash)
+	}
+	sort.Strings(ret)
+	return ret
+}
@@ -0,0 +1,115 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/donniet/mirror.4/state"
+)
+
+func TestExportImport(t *testing.T) {
+	path, cleanup := copyFixture(t, "state-v0.json")
+	defer cleanup()
+
+	source := new(State)
+	if err := source.Load(path); err != nil {
+		t.Fatal(err)
+	}
+	hash := source.Faces.Detections[0].Image.Hash
+
+	exporter := &Archiver{server: state.NewServer(source), blobs: blobStore}
+	w := httptest.NewRecorder()
+	exporter.Export(w, httptest.NewRequest(http.MethodGet, "/api/_export", nil))
+	if w.Code != http.StatusOK {
+		t.Fatalf("export failed with %d: %s", w.Code, w.Body.String())
+	}
+	archive := w.Body.Bytes()
+
+	// import into an empty mirror with a blob store of its own
+	dir := blobStore.dir
+	os.RemoveAll(dir)
+	if _, err := NewBlobStore(dir); err != nil {
+		t.Fatal(err)
+	}
+
+	target := &State{Faces: faces{People: People{"sam": Person{Distance: 1}}}}
+	messages := make(chan StateMessage, 100)
+	importer := &Archiver{server: state.NewServer(target), blobs: blobStore, messages: messages}
+
+	w = httptest.NewRecorder()
+	importer.Import(w, httptest.NewRequest(http.MethodPost, "/api/_import?mode=merge&dryRun=1", bytes.NewReader(archive)))
+	if w.Code != http.StatusOK {
+		t.Fatalf("dry run failed with %d: %s", w.Code, w.Body.String())
+	}
+	result := ImportResult{}
+	json.Unmarshal(w.Body.Bytes(), &result)
+	if len(result.Changes) == 0 || result.Blobs != 1 || len(messages) != 0 || len(target.Streams) != 0 {
+		t.Errorf("unexpected dry run result %#v", result)
+	}
+
+	w = httptest.NewRecorder()
+	importer.Import(w, httptest.NewRequest(http.MethodPost, "/api/_import?mode=merge", bytes.NewReader(archive)))
+	if w.Code != http.StatusOK {
+		t.Fatalf("import failed with %d: %s", w.Code, w.Body.String())
+	}
+
+	if len(target.Streams) != 1 || target.Display.PowerStatus != "on" {
+		t.Errorf("state not imported: %#v", target)
+	}
+	if _, ok := target.Faces.People["sam"]; !ok || len(target.Faces.People) != 2 {
+		t.Errorf("merge should keep existing people: %#v", target.Faces.People)
+	}
+	if len(messages) != 1 {
+		t.Errorf("expected the import to be broadcast as a single change, got %d", len(messages))
+	} else if m := <-messages; m.Method != http.MethodPost || m.Path != "" {
+		t.Errorf("unexpected import change %s '%s'", m.Method, m.Path)
+	}
+	if _, err := os.Stat(filepath.Join(blobStore.dir, hash)); err != nil {
+		t.Errorf("blob not imported: %v", err)
+	}
+
+	// replacing removes the person that was not exported
+	w = httptest.NewRecorder()
+	importer.Import(w, httptest.NewRequest(http.MethodPost, "/api/_import", bytes.NewReader(archive)))
+	if w.Code != http.StatusOK {
+		t.Fatalf("import failed with %d: %s", w.Code, w.Body.String())
+	} else if _, ok := target.Faces.People["sam"]; ok {
+		t.Errorf("replace should remove people missing from the export")
+	}
+}
+
+func TestValidateDocumentStoresNothing(t *testing.T) {
+	dir, err := ioutil.TempDir("", "blobs")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	if blobStore, err = NewBlobStore(dir); err != nil {
+		t.Fatal(err)
+	}
+	defer func() { blobStore = nil }()
+
+	doc, _ := decodeDocument([]byte(`{"faces":{"detections":[{"name":"sam","image":"data:image/png;base64,AAEC"}]}}`))
+	if err := validateDocument(reflect.TypeOf(State{}), doc); err != nil {
+		t.Fatal(err)
+	}
+	if infos, _ := ioutil.ReadDir(dir); len(infos) != 0 {
+		t.Errorf("expected validating to store nothing, found %d files", len(infos))
+	}
+	if b, _ := json.Marshal(doc); !bytes.Contains(b, []byte("data:image/png;base64,AAEC")) {
+		t.Errorf("expected the document left alone, got %s", b)
+	}
+
+	// broken data-uris are still caught
+	doc, _ = decodeDocument([]byte(`{"faces":{"detections":[{"image":"data:image/png;base64,!!"}]}}`))
+	if err := validateDocument(reflect.TypeOf(State{}), doc); err == nil {
+		t.Errorf("expected an error for a broken data-uri")
+	}
+}
@@ -3,4 +3,5 @@ module github.com/donniet/mirror.4
 require (
 	github.com/donniet/darksky v0.0.0-20190315154157-60c19135863f
 	github.com/gorilla/websocket v1.4.0
+	go.etcd.io/bbolt v1.3.5
 )
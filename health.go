@@ -0,0 +1,202 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+)
+
+const (
+	// weatherStaleAfter is three missed forecast updates
+	weatherStaleAfter = 6 * time.Hour
+	// startupGrace is how long after starting a missing forecast or save
+	// isn't a problem yet
+	startupGrace = 5 * time.Minute
+	// aliveTimeout is how long the message loop has to answer a check
+	aliveTimeout = 5 * time.Second
+)
+
+// WeatherStatus reports the outcome of the most recent forecast fetches
+type WeatherStatus struct {
+	LastUpdate    time.Time `json:"lastUpdate"`
+	LastError     string    `json:"lastError,omitempty"`
+	LastErrorTime time.Time `json:"lastErrorTime,omitempty"`
+	Stale         bool      `json:"stale"`
+}
+
+type weatherTracker struct {
+	locker sync.Locker
+	status WeatherStatus
+}
+
+// weatherHealth tracks the forecast fetches
+var weatherHealth = &weatherTracker{locker: &sync.Mutex{}}
+
+func (t *weatherTracker) succeeded() {
+	t.locker.Lock()
+	defer t.locker.Unlock()
+	t.status.LastUpdate = time.Now()
+	t.status.LastError = ""
+}
+
+func (t *weatherTracker) failed(err error) {
+	t.locker.Lock()
+	defer t.locker.Unlock()
+	t.status.LastError = err.Error()
+	t.status.LastErrorTime = time.Now()
+}
+
+// Status returns the last fetch times and error
+func (t *weatherTracker) Status() WeatherStatus {
+	t.locker.Lock()
+	defer t.locker.Unlock()
+
+	ret := t.status
+	ret.Stale = ret.LastUpdate.IsZero() || time.Since(ret.LastUpdate) > weatherStaleAfter
+	return ret
+}
+
+// Status is the answer to /api/_status: what is running and what's wrong
+type Status struct {
+	Version     string         `json:"version"`
+	Started     time.Time      `json:"started"`
+	Uptime      string         `json:"uptime"`
+	Ready       bool           `json:"ready"`
+	Healthy     bool           `json:"healthy"`
+	Errors      []string       `json:"errors"`
+	Persistence PersistStatus  `json:"persistence"`
+	Weather     WeatherStatus  `json:"weather"`
+	Sockets     SocketStats    `json:"sockets"`
+	Watcher     *WatcherStatus `json:"watcher,omitempty"`
+}
+
+// Health answers liveness, readiness and status checks for monitors
+type Health struct {
+	locker  sync.Locker
+	started time.Time
+	ready   bool
+	alive   func(timeout time.Duration) bool
+
+	persister *Persister
+	sockets   *Sockets
+	watcher   *StateWatcher
+}
+
+// NewHealth reports on the persister, sockets and watcher, which may be nil
+func NewHealth(persister *Persister, sockets *Sockets, watcher *StateWatcher) *Health {
+	return &Health{
+		locker:    &sync.Mutex{},
+		started:   time.Now(),
+		persister: persister,
+		sockets:   sockets,
+		watcher:   watcher,
+	}
+}
+
+// SetReady says whether the state is loaded and the server is listening
+func (h *Health) SetReady(ready bool) {
+	h.locker.Lock()
+	defer h.locker.Unlock()
+	h.ready = ready
+}
+
+func (h *Health) isReady() bool {
+	h.locker.Lock()
+	defer h.locker.Unlock()
+	return h.ready
+}
+
+// SetAlive gives the check that the message loop is still answering, the same
+// one the systemd watchdog uses
+func (h *Health) SetAlive(alive func(timeout time.Duration) bool) {
+	h.locker.Lock()
+	defer h.locker.Unlock()
+	h.alive = alive
+}
+
+func (h *Health) isAlive() bool {
+	h.locker.Lock()
+	alive := h.alive
+	h.locker.Unlock()
+	return alive == nil || alive(aliveTimeout)
+}
+
+// Status collects the status of every part of the mirror
+func (h *Health) Status() Status {
+	ret := Status{
+		Version:     version,
+		Started:     h.started,
+		Uptime:      time.Since(h.started).Round(time.Second).String(),
+		Ready:       h.isReady(),
+		Errors:      []string{},
+		Persistence: h.persister.Status(),
+		Weather:     weatherHealth.Status(),
+		Sockets:     h.sockets.Status(),
+	}
+	settled := time.Since(h.started) > startupGrace
+
+	if p := ret.Persistence; p.LastError != "" {
+		ret.Errors = append(ret.Errors, fmt.Sprintf("saving state: %s", p.LastError))
+	}
+	if w := ret.Weather; w.Stale && settled {
+		if w.LastUpdate.IsZero() {
+			ret.Errors = append(ret.Errors, "weather: never updated")
+		} else {
+			ret.Errors = append(ret.Errors, fmt.Sprintf("weather: last updated %v ago", time.Since(w.LastUpdate).Round(time.Minute)))
+		}
+		if w.LastError != "" {
+			ret.Errors = append(ret.Errors, fmt.Sprintf("weather: %s", w.LastError))
+		}
+	}
+	if h.watcher != nil {
+		w := h.watcher.Status()
+		ret.Watcher = &w
+		if w.LastError != "" {
+			ret.Errors = append(ret.Errors, fmt.Sprintf("watching state file: %s", w.LastError))
+		}
+	}
+	if !ret.Ready {
+		ret.Errors = append(ret.Errors, "not ready")
+	}
+	if !h.isAlive() {
+		ret.Errors = append(ret.Errors, "message loop not answering")
+	}
+
+	ret.Healthy = len(ret.Errors) == 0
+	return ret
+}
+
+// Healthz answers 200 as long as the message loop is answering, and 503 if it
+// is stuck, for restarting the server
+func (h *Health) Healthz(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	if !h.isAlive() {
+		http.Error(w, "message loop not answering", http.StatusServiceUnavailable)
+		return
+	}
+	w.Write([]byte("ok\n"))
+}
+
+// Readyz answers 200 once the state is loaded and the server is listening,
+// and 503 before then or while shutting down
+func (h *Health) Readyz(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	if !h.isReady() {
+		http.Error(w, "not ready", http.StatusServiceUnavailable)
+		return
+	}
+	w.Write([]byte("ready\n"))
+}
+
+// ServeHTTP answers with the Status.  It is always 200 if the server can
+// answer; monitors should check healthy and errors.
+func (h *Health) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not supported", http.StatusMethodNotAllowed)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(h.Status())
+}
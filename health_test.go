@@ -0,0 +1,82 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/donniet/mirror.4/state"
+)
+
+func TestHealth(t *testing.T) {
+	local := new(State)
+	p := NewPersister(&testStorage{}, state.NewServer(local), local, 3, time.Millisecond, 10*time.Millisecond)
+	defer p.Close()
+	socks := NewSockets(http.NotFoundHandler(), nil, SocketConfig{QueueSize: 10, Overflow: OverflowCoalesce})
+	health := NewHealth(p, socks, nil)
+
+	get := func(handler http.HandlerFunc) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		handler(w, httptest.NewRequest(http.MethodGet, "/", nil))
+		return w
+	}
+	status := func() Status {
+		ret := Status{}
+		if err := json.Unmarshal(get(health.ServeHTTP).Body.Bytes(), &ret); err != nil {
+			t.Fatal(err)
+		}
+		return ret
+	}
+
+	if w := get(health.Healthz); w.Code != http.StatusOK {
+		t.Errorf("expected to be alive, got %d", w.Code)
+	}
+	if w := get(health.Readyz); w.Code != http.StatusServiceUnavailable {
+		t.Errorf("expected not to be ready before listening, got %d", w.Code)
+	}
+
+	health.SetReady(true)
+	if w := get(health.Readyz); w.Code != http.StatusOK {
+		t.Errorf("expected to be ready, got %d", w.Code)
+	}
+
+	// a missing forecast isn't a problem right after starting
+	if s := status(); !s.Healthy || s.Version != version || !s.Weather.Stale {
+		t.Errorf("expected a healthy status with a stale forecast, got %#v", s)
+	}
+
+	health.started = time.Now().Add(-time.Hour)
+	weatherHealth.failed(errors.New("no network"))
+	p.setError(errors.New("disk full"))
+	defer func() { weatherHealth.status = WeatherStatus{} }()
+
+	s := status()
+	errs := strings.Join(s.Errors, "\n")
+	if s.Healthy || !strings.Contains(errs, "disk full") || !strings.Contains(errs, "weather: never updated") || !strings.Contains(errs, "no network") {
+		t.Errorf("expected the save and weather problems, got %v", s.Errors)
+	}
+
+	weatherHealth.succeeded()
+	p.setSaved()
+	if s := status(); !s.Healthy || s.Weather.Stale {
+		t.Errorf("expected to be healthy again, got %v", s.Errors)
+	}
+
+	// a stuck message loop fails the liveness check
+	answering := true
+	health.SetAlive(func(time.Duration) bool { return answering })
+	if w := get(health.Healthz); w.Code != http.StatusOK {
+		t.Errorf("expected to be alive while the loop answers, got %d", w.Code)
+	}
+	answering = false
+	if w := get(health.Healthz); w.Code != http.StatusServiceUnavailable {
+		t.Errorf("expected a stuck loop to be reported, got %d", w.Code)
+	}
+	if s := status(); s.Healthy || !strings.Contains(strings.Join(s.Errors, "\n"), "message loop") {
+		t.Errorf("expected the stuck loop in the status, got %v", s.Errors)
+	}
+}
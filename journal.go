@@ -0,0 +1,277 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"sort"
+	"time"
+
+	"github.com/donniet/mirror.4/state"
+)
+
+// SyncPolicy controls when the journal is flushed to stable storage
+type SyncPolicy string
+
+const (
+	// SyncAlways fsyncs after every appended message
+	SyncAlways SyncPolicy = "always"
+	// SyncInterval fsyncs at most once per journal sync interval
+	SyncInterval SyncPolicy = "interval"
+	// SyncNever leaves flushing to the operating system
+	SyncNever SyncPolicy = "never"
+)
+
+const journalSyncInterval = 5 * time.Second
+
+// ParseSyncPolicy validates a sync policy name
+func ParseSyncPolicy(s string) (SyncPolicy, error) {
+	switch p := SyncPolicy(s); p {
+	case SyncAlways, SyncInterval, SyncNever:
+		return p, nil
+	}
+	return "", fmt.Errorf("unknown journal sync policy '%s'", s)
+}
+
+// Journal is an append-only log of StateMessages, one JSON document per line,
+// recording every change made since the last snapshot of the state.  The first
+// line is a journalHeader numbering the journal, so a snapshot can say which
+// journals it already includes.
+type Journal struct {
+	path       string
+	policy     SyncPolicy
+	file       *os.File
+	size       int64
+	entries    int
+	generation uint64
+	lastSync   time.Time
+}
+
+// journalHeader starts each journal after the first
+type journalHeader struct {
+	Generation uint64 `json:"generation"`
+}
+
+// journalMark is kept in a snapshot to say which journals it includes: every
+// one before its generation, and the entries in its own up to the revision the
+// state server was at when it was taken.  Changes are numbered from the
+// start of each run, which always begins a new generation.
+type journalMark struct {
+	Generation uint64 `json:"generation"`
+	Revision   uint64 `json:"revision"`
+}
+
+// OpenJournal opens or creates the journal at path for appending
+func OpenJournal(path string, policy SyncPolicy) (*Journal, error) {
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_RDWR|os.O_APPEND, 0660)
+	if err != nil {
+		return nil, err
+	}
+	fi, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	return &Journal{
+		path:     path,
+		policy:   policy,
+		file:     f,
+		size:     fi.Size(),
+		lastSync: time.Now(),
+	}, nil
+}
+
+// Len returns the number of messages in the journal
+func (j *Journal) Len() int {
+	return j.entries
+}
+
+// Append writes msg to the end of the journal, syncing according to the policy
+func (j *Journal) Append(msg StateMessage) error {
+	b, err := json.Marshal(msg)
+	if err != nil {
+		return err
+	}
+	if b, err = encryption.SealLine(b); err != nil {
+		return err
+	}
+	b = append(b, '\n')
+
+	if _, err := j.file.Write(b); err != nil {
+		// don't leave a torn entry for later appends to follow
+		j.file.Truncate(j.size)
+		return err
+	}
+	j.size += int64(len(b))
+	j.entries++
+
+	switch j.policy {
+	case SyncAlways:
+		return j.Sync()
+	case SyncInterval:
+		if time.Since(j.lastSync) >= journalSyncInterval {
+			return j.Sync()
+		}
+	}
+	return nil
+}
+
+// Sync flushes the journal to stable storage
+func (j *Journal) Sync() error {
+	j.lastSync = time.Now()
+	return j.file.Sync()
+}
+
+// Replay applies every message in the journal to server in the order they were
+// first applied, unless the snapshot marked by mark already includes it.
+// Messages can be appended out of that order, since they are sent on once the
+// state server is unlocked, so numbered ones are sorted by their change.  A
+// partially written message at the end of the file, as left by a crash
+// mid-append, is discarded.  One that can't be read anywhere else is an error,
+// since skipping it could apply the ones after it to the wrong items.
+func (j *Journal) Replay(server *state.Server, mark journalMark) error {
+	if _, err := j.file.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+
+	r := bufio.NewReader(j.file)
+	lines := [][]byte{}
+	for {
+		line, err := r.ReadBytes('\n')
+		if err == io.EOF {
+			if len(bytes.TrimSpace(line)) > 0 {
+				log.Printf("discarding incomplete journal entry at offset %d", journalOffset(lines))
+			}
+			break
+		} else if err != nil {
+			return err
+		}
+		lines = append(lines, line)
+	}
+
+	j.entries = 0
+	j.generation = 0
+	if len(lines) > 0 {
+		header := journalHeader{}
+		if err := json.Unmarshal(lines[0], &header); err == nil && header.Generation > 0 {
+			j.generation = header.Generation
+		}
+	}
+	if j.generation < mark.Generation {
+		// the snapshot was written but the journal wasn't truncated
+		log.Printf("journal %d is already in snapshot %d, discarding it", j.generation, mark.Generation)
+		return j.start(mark.Generation)
+	}
+
+	good := 0
+	if j.generation > 0 {
+		good = 1
+	}
+	msgs := []StateMessage{}
+	numbered := true
+	for ; good < len(lines); good++ {
+		line := lines[good]
+
+		// a wrong or missing key is not corruption, so stop before truncating
+		opened, err := encryption.OpenDocument(line)
+		if err != nil {
+			return fmt.Errorf("journal entry at offset %d: %v", journalOffset(lines[:good]), err)
+		}
+
+		msg := StateMessage{}
+		if err := json.Unmarshal(opened, &msg); err != nil && good == len(lines)-1 {
+			log.Printf("discarding incomplete journal entry at offset %d: %v", journalOffset(lines[:good]), err)
+			break
+		} else if err != nil {
+			return fmt.Errorf("corrupt entry at offset %d of %s, followed by %d more: %v", journalOffset(lines[:good]), j.path, len(lines)-good-1, err)
+		}
+		if j.generation == mark.Generation && msg.Change != 0 && msg.Change <= mark.Revision {
+			// applied before the snapshot but saved after it
+			continue
+		}
+		msgs = append(msgs, msg)
+		numbered = numbered && msg.Change != 0
+	}
+
+	// journals from before changes were numbered are in the only order known
+	if numbered {
+		sort.SliceStable(msgs, func(a, b int) bool { return msgs[a].Change < msgs[b].Change })
+	}
+	for _, msg := range msgs {
+		if err := applyMessage(server, &msg); err != nil {
+			log.Printf("error replaying %s %s: %v", msg.Method, msg.Path, err)
+		}
+		j.entries++
+	}
+
+	j.size = journalOffset(lines[:good])
+	return j.file.Truncate(j.size)
+}
+
+// journalOffset returns where the line after lines starts
+func journalOffset(lines [][]byte) int64 {
+	n := int64(0)
+	for _, l := range lines {
+		n += int64(len(l))
+	}
+	return n
+}
+
+// Truncate empties the journal and starts the next generation, after a
+// snapshot marked with it has been written
+func (j *Journal) Truncate() error {
+	return j.start(j.generation + 1)
+}
+
+// start empties the journal and writes the header for generation
+func (j *Journal) start(generation uint64) error {
+	if err := j.file.Truncate(0); err != nil {
+		return err
+	}
+	j.size = 0
+	j.entries = 0
+
+	b, err := json.Marshal(journalHeader{Generation: generation})
+	if err != nil {
+		return err
+	}
+	b = append(b, '\n')
+	if _, err := j.file.Write(b); err != nil {
+		return err
+	}
+	j.size = int64(len(b))
+	j.generation = generation
+	return j.Sync()
+}
+
+// Close syncs and closes the journal file
+func (j *Journal) Close() error {
+	if err := j.file.Sync(); err != nil {
+		j.file.Close()
+		return err
+	}
+	return j.file.Close()
+}
+
+// applyMessage replays a StateMessage against the state server, numbering it
+// with the revision it made and replacing its body with what was stored
+func applyMessage(server *state.Server, msg *StateMessage) error {
+	var body []byte
+	if msg.Body != nil {
+		body = *msg.Body
+	}
+
+	_, stored, change, err := server.Apply(msg.Method, msg.Path, body)
+	if err != nil {
+		return err
+	}
+	msg.Change = change
+	if stored != nil {
+		msg.Body = (*json.RawMessage)(&stored)
+	}
+	return nil
+}
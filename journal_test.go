@@ -0,0 +1,193 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/donniet/mirror.4/state"
+)
+
+type journalTestStruct struct {
+	Name  string         `json:"name"`
+	Slice []int          `json:"slice"`
+	Map   map[string]int `json:"map"`
+}
+
+func rawMessage(s string) *json.RawMessage {
+	b := json.RawMessage(s)
+	return &b
+}
+
+func TestJournalReplay(t *testing.T) {
+	dir, err := ioutil.TempDir("", "journal")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "state.journal")
+
+	j, err := OpenJournal(path, SyncAlways)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	msgs := []StateMessage{
+		{Method: http.MethodPost, Path: "name", Body: rawMessage(`"mirror"`)},
+		{Method: http.MethodPut, Path: "slice", Body: rawMessage(`4`)},
+		{Method: http.MethodPut, Path: "map/two", Body: rawMessage(`2`)},
+		{Method: http.MethodDelete, Path: "map/one"},
+	}
+	for _, m := range msgs {
+		if err := j.Append(m); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if j.Len() != len(msgs) {
+		t.Errorf("expected %d entries got %d", len(msgs), j.Len())
+	}
+	j.Close()
+
+	// simulate a crash part way through writing an entry
+	f, err := os.OpenFile(path, os.O_APPEND|os.O_WRONLY, 0660)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.Write([]byte(`{"method":"POST","path":"na`))
+	f.Close()
+
+	tester := &journalTestStruct{
+		Slice: []int{1, 2, 3},
+		Map:   map[string]int{"one": 1},
+	}
+
+	j, err = OpenJournal(path, SyncAlways)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer j.Close()
+
+	if err := j.Replay(state.NewServer(tester), journalMark{}); err != nil {
+		t.Fatal(err)
+	}
+
+	if j.Len() != len(msgs) {
+		t.Errorf("expected %d replayed entries got %d", len(msgs), j.Len())
+	}
+	if tester.Name != "mirror" {
+		t.Errorf("expected name 'mirror' got '%s'", tester.Name)
+	}
+	if len(tester.Slice) != 4 || tester.Slice[3] != 4 {
+		t.Errorf("unexpected slice %v", tester.Slice)
+	}
+	if _, ok := tester.Map["one"]; ok || tester.Map["two"] != 2 {
+		t.Errorf("unexpected map %v", tester.Map)
+	}
+
+	// the torn entry should have been cut off
+	if err := j.Append(msgs[0]); err != nil {
+		t.Fatal(err)
+	}
+	b, _ := ioutil.ReadFile(path)
+	if n := bytes.Count(b, []byte("\n")); n != len(msgs)+1 {
+		t.Errorf("expected %d lines after append got %d", len(msgs)+1, n)
+	}
+
+	// truncating starts the next generation
+	if err := j.Truncate(); err != nil {
+		t.Fatal(err)
+	} else if b, _ := ioutil.ReadFile(path); string(b) != "{\"generation\":1}\n" || j.Len() != 0 {
+		t.Errorf("expected an empty generation 1 journal, got %q", b)
+	}
+}
+
+func TestJournalReplayOrder(t *testing.T) {
+	dir, err := ioutil.TempDir("", "journal")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	j, err := OpenJournal(filepath.Join(dir, "state.journal"), SyncAlways)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer j.Close()
+
+	// changes made in one order by the state server but appended in another
+	applied := &journalTestStruct{}
+	server := state.NewServer(applied)
+	msgs := []StateMessage{
+		{Method: http.MethodPut, Path: "slice", Body: rawMessage(`1`)},
+		{Method: http.MethodPut, Path: "slice", Body: rawMessage(`2`)},
+		{Method: http.MethodPost, Path: "name", Body: rawMessage(`"first"`)},
+		{Method: http.MethodPost, Path: "name", Body: rawMessage(`"second"`)},
+	}
+	for i := range msgs {
+		if err := applyMessage(server, &msgs[i]); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, i := range []int{1, 3, 0, 2} {
+		if err := j.Append(msgs[i]); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	replayed := &journalTestStruct{}
+	if err := j.Replay(state.NewServer(replayed), journalMark{}); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(replayed, applied) {
+		t.Errorf("expected the state as it was applied, %#v, got %#v", applied, replayed)
+	}
+}
+
+func TestJournalCorruption(t *testing.T) {
+	dir, err := ioutil.TempDir("", "journal")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "state.journal")
+	entry := `{"method":"PUT","path":"slice","body":4}` + "\n"
+	corrupt := `{"method":"PUT","pa` + "\x00\x00\n"
+
+	// a torn last entry is dropped, even if it ends in a newline
+	ioutil.WriteFile(path, []byte(entry+corrupt), 0660)
+	j, err := OpenJournal(path, SyncAlways)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tester := &journalTestStruct{}
+	if err := j.Replay(state.NewServer(tester), journalMark{}); err != nil {
+		t.Fatal(err)
+	} else if len(tester.Slice) != 1 {
+		t.Errorf("expected the good entry replayed, got %v", tester.Slice)
+	}
+	j.Close()
+	if b, _ := ioutil.ReadFile(path); string(b) != entry {
+		t.Errorf("expected the torn entry cut off, got %q", b)
+	}
+
+	// one followed by good entries is an error, and nothing is cut off
+	ioutil.WriteFile(path, []byte(entry+corrupt+entry), 0660)
+	j, err = OpenJournal(path, SyncAlways)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer j.Close()
+	if err := j.Replay(state.NewServer(&journalTestStruct{}), journalMark{}); err == nil {
+		t.Errorf("expected an error replaying a corrupt entry")
+	}
+	if b, _ := ioutil.ReadFile(path); string(b) != entry+corrupt+entry {
+		t.Errorf("expected the journal left alone, got %q", b)
+	}
+}
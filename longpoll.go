@@ -0,0 +1,146 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/donniet/mirror.4/state"
+)
+
+// revisionHeader carries the revision of the state a GET was answered from:
+// the sequence number of the last change broadcast
+const revisionHeader = "X-Revision"
+
+const (
+	watchDefaultTimeout = 30 * time.Second
+	watchMaxTimeout     = 5 * time.Minute
+)
+
+// Revision returns the sequence number of the last broadcast
+func (socks *Sockets) Revision() uint64 {
+	socks.locker.Lock()
+	defer socks.locker.Unlock()
+	return socks.history.seq
+}
+
+type revisionKey struct{}
+
+// withRevision carries the revision into a request made with the hub locked,
+// which the state server can't lock again to read it
+func withRevision(ctx context.Context, rev uint64) context.Context {
+	return context.WithValue(ctx, revisionKey{}, rev)
+}
+
+// revision returns the revision a GET is answered at
+func (s *StateServer) revision(r *http.Request) uint64 {
+	if rev, ok := r.Context().Value(revisionKey{}).(uint64); ok {
+		return rev
+	}
+	return s.hub.Revision()
+}
+
+// changedSince reports whether anything at, above or below path was broadcast
+// after rev.  If it can't tell, because rev is from before the history or
+// from a previous run, it says it did.  It must be called with the hub locked.
+func (socks *Sockets) changedSince(path []string, rev uint64) bool {
+	if rev == socks.history.seq {
+		return false
+	}
+
+	missed, ok := socks.history.since(socks.history.epoch, rev)
+	if !ok {
+		return true
+	}
+	for _, m := range missed {
+		if hasPathPrefix(m.path, path) || hasPathPrefix(path, m.path) {
+			return true
+		}
+	}
+	return false
+}
+
+// WaitChange waits until something at, above or below path changes after rev,
+// returning the revision it changed at, or false if timeout passed, ctx was
+// cancelled or the server began shutting down first
+func (socks *Sockets) WaitChange(ctx context.Context, path string, rev uint64, timeout time.Duration) (uint64, bool) {
+	segments := splitPath(path)
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+
+	for {
+		socks.locker.Lock()
+		current, changed, wake := socks.history.seq, socks.changedSince(segments, rev), socks.changed
+		socks.locker.Unlock()
+
+		if changed {
+			return current, true
+		}
+
+		select {
+		case <-wake:
+		case <-timer.C:
+			return current, false
+		case <-ctx.Done():
+			return current, false
+		case <-socks.stopper:
+			return current, false
+		}
+	}
+}
+
+// watch answers GET ?watch=1&rev=N once the value at the path has changed
+// after revision N, or the current revision if rev isn't given.  The reply is
+// the new value with its revision, or 304 Not Modified if nothing changed
+// before the timeout query parameter (default 30s).
+func (s *StateServer) watch(w http.ResponseWriter, r *http.Request) {
+	if s.hub == nil {
+		writeError(w, state.BadRequestError("watching is not available"))
+		return
+	}
+
+	query := r.URL.Query()
+
+	rev := s.hub.Revision()
+	if v := query.Get("rev"); v != "" {
+		var err error
+		if rev, err = strconv.ParseUint(v, 10, 64); err != nil {
+			writeError(w, state.BadRequestError(fmt.Sprintf("invalid rev '%s'", v)))
+			return
+		}
+	}
+
+	timeout := watchDefaultTimeout
+	if v := query.Get("timeout"); v != "" {
+		var err error
+		if timeout, err = time.ParseDuration(v); err != nil || timeout <= 0 {
+			writeError(w, state.BadRequestError(fmt.Sprintf("invalid timeout '%s'", v)))
+			return
+		} else if timeout > watchMaxTimeout {
+			timeout = watchMaxTimeout
+		}
+	}
+
+	// the path must exist to be watched
+	if _, err := s.server.Get(r.URL.Path); err != nil {
+		writeError(w, err)
+		return
+	}
+
+	current, changed := s.hub.WaitChange(r.Context(), r.URL.Path, rev, timeout)
+	w.Header().Set(revisionHeader, strconv.FormatUint(current, 10))
+	if !changed {
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+
+	res, err := s.server.Get(r.URL.Path)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(res)
+}
@@ -0,0 +1,60 @@
+package main
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+
+	"github.com/donniet/mirror.4/state"
+)
+
+func TestWatch(t *testing.T) {
+	local := new(State)
+	messages := make(chan StateMessage)
+	server := &StateServer{messages: messages, server: state.NewServer(local)}
+	server.hub = NewSockets(server, nil, SocketConfig{QueueSize: 10, Overflow: OverflowCoalesce, HistorySize: 10})
+	go func() {
+		for msg := range messages {
+			server.hub.Write(msg)
+		}
+	}()
+	defer close(messages)
+
+	request := func(method, target, body string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		server.ServeHTTP(w, httptest.NewRequest(method, target, bytes.NewBufferString(body)))
+		return w
+	}
+
+	w := request(http.MethodGet, "/display/powerStatus", "")
+	rev := w.Header().Get(revisionHeader)
+	if rev != "0" {
+		t.Fatalf("expected revision 0, got '%s'", rev)
+	}
+
+	if w := request(http.MethodGet, "/display/powerStatus?watch=1&timeout=10ms&rev="+rev, ""); w.Code != http.StatusNotModified {
+		t.Errorf("expected no change before the timeout, got %d", w.Code)
+	}
+
+	done := make(chan *httptest.ResponseRecorder)
+	go func() { done <- request(http.MethodGet, "/display/powerStatus?watch=1&rev="+rev, "") }()
+
+	// a change elsewhere doesn't wake the watch
+	request(http.MethodPost, "/forecast/summary", `"sunny"`)
+	request(http.MethodPost, "/display/powerStatus", `"standby"`)
+
+	w = <-done
+	if w.Code != http.StatusOK || w.Body.String() != `"standby"` {
+		t.Errorf("expected the new value, got %d %s", w.Code, w.Body.String())
+	}
+	if n, _ := strconv.Atoi(w.Header().Get(revisionHeader)); n != 2 {
+		t.Errorf("expected revision 2, got '%s'", w.Header().Get(revisionHeader))
+	}
+
+	// a revision already behind returns at once
+	if w := request(http.MethodGet, "/display?watch=1&timeout=1m&rev=1", ""); w.Code != http.StatusOK {
+		t.Errorf("expected a change since revision 1, got %d", w.Code)
+	}
+}
@@ -1,16 +1,21 @@
 package main
 
 import (
-	"bytes"
+	"context"
+	"crypto/tls"
 	"encoding/json"
 	"flag"
-	"fmt"
-	"html/template"
 	"io/ioutil"
 	"log"
+	"net"
 	"net/http"
 	"os"
 	"os/signal"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
 	"time"
 
 	"github.com/donniet/darksky"
@@ -24,95 +29,179 @@ const (
 )
 
 var (
-	addr       = "localhost:8081"
-	weatherKey = ""
-	lat        = defaultLat
-	long       = defaultLong
-	statePath  = "state.json"
+	configPath   = ""
+	addr         = "localhost:8081"
+	weatherKey   = ""
+	lat          = defaultLat
+	long         = defaultLong
+	statePath    = "state.json"
+	storageKind  = "journal"
+	blobPath     = "blobs"
+	watchState   = 2 * time.Second
+	conflicts    = string(ConflictDisk)
+	journalSync  = string(SyncInterval)
+	compactEvery = 500
+	saveDelay    = 2 * time.Second
+	saveMaxDelay = 10 * time.Second
+	encryptMode  = string(EncryptNone)
+	keyFile      = ""
+	queueSize    = 256
+	overflow     = string(OverflowCoalesce)
+	historySize  = 1024
+	pingInterval = 30 * time.Second
+	idleTimeout  = 75 * time.Second
+	writeTimeout = 10 * time.Second
+	maxConns     = 64
+	tokensPath   = ""
+	anonRole     = string(RoleViewer)
+	origins      = ""
+	useTLS       = false
+	tlsCert      = ""
+	tlsKey       = ""
+	tlsDir       = "tls"
+	tlsHosts     = "mirror.local,localhost,127.0.0.1"
+	basePath     = ""
+	devMode      = false
+	clientDir    = ""
+	behindProxy  = false
 )
 
+// stateKeyEnv holds comma separated state encryption keys, after any in keyFile
+const stateKeyEnv = "MIRROR_STATE_KEY"
+
 func init() {
-	flag.StringVar(&addr, "addr", addr, "address to run webserver")
-	flag.StringVar(&weatherKey, "weatherKey", weatherKey, "darksky api key")
-	flag.Float64Var(&lat, "lat", lat, "lattitude")
-	flag.Float64Var(&long, "long", long, "longitude")
-	flag.StringVar(&statePath, "statePath", statePath, "path to save state")
+	registerFlags(flag.CommandLine)
 }
 
-func mustExecuteTemplate(fileName string, templateName string, dat interface{}) []byte {
-	buf := &bytes.Buffer{}
-
-	if tmpl, err := template.New("index.html").Delims("[[", "]]").ParseFiles(fileName); err != nil {
-		log.Fatalf("could not parse template: %v", err)
-	} else if err := tmpl.ExecuteTemplate(buf, templateName, dat); err != nil {
-		log.Fatalf("error executing template: %v", err)
-	}
-
-	return buf.Bytes()
+// registerFlags defines the settings on fs, each starting from its variable's
+// current value
+func registerFlags(fs *flag.FlagSet) {
+	fs.StringVar(&configPath, "config", configPath, "JSON config file with server, weather, persistence, display and security sections; defaults to "+configEnv)
+	fs.StringVar(&addr, "addr", addr, "address to run webserver")
+	fs.StringVar(&weatherKey, "weatherKey", weatherKey, "darksky api key")
+	fs.Float64Var(&lat, "lat", lat, "lattitude")
+	fs.Float64Var(&long, "long", long, "longitude")
+	fs.StringVar(&statePath, "statePath", statePath, "path to save state")
+	fs.StringVar(&storageKind, "storage", storageKind, "state storage backend: json, journal or kv (stored in statePath with a .db extension)")
+	fs.StringVar(&blobPath, "blobPath", blobPath, "directory to store images and other blobs")
+	fs.DurationVar(&watchState, "watchState", watchState, "how often to check the state file for outside edits, 0 to disable")
+	fs.StringVar(&conflicts, "conflicts", conflicts, "which change wins when the state file and memory both changed: disk or memory")
+	fs.StringVar(&journalSync, "journalSync", journalSync, "when to fsync saved state: always, interval or never")
+	fs.IntVar(&compactEvery, "compactEvery", compactEvery, "number of saved changes before writing a full snapshot")
+	fs.DurationVar(&saveDelay, "saveDelay", saveDelay, "quiet period to wait for before saving a burst of changes")
+	fs.DurationVar(&saveMaxDelay, "saveMaxDelay", saveMaxDelay, "longest time a change may go unsaved")
+	fs.StringVar(&encryptMode, "encrypt", encryptMode, "what to encrypt at rest: none, fields (those tagged sensitive, and blobs) or file")
+	fs.StringVar(&keyFile, "keyFile", keyFile, "file of state encryption keys, one per line with the current key first; more may be given in "+stateKeyEnv)
+	fs.IntVar(&queueSize, "socketQueue", queueSize, "messages queued for each websocket client before the overflow policy applies")
+	fs.StringVar(&overflow, "socketOverflow", overflow, "what to do when a websocket client falls behind: drop-oldest, coalesce or disconnect")
+	fs.IntVar(&historySize, "socketHistory", historySize, "recent broadcasts kept for websocket clients resuming after a reconnect")
+	fs.DurationVar(&pingInterval, "socketPing", pingInterval, "how often to ping websocket clients, 0 to disable")
+	fs.DurationVar(&idleTimeout, "socketIdle", idleTimeout, "disconnect websocket clients not heard from, or answering pings, for this long, 0 to disable")
+	fs.DurationVar(&writeTimeout, "socketWriteTimeout", writeTimeout, "disconnect websocket clients taking longer than this to accept a message")
+	fs.IntVar(&maxConns, "maxConnections", maxConns, "most websocket clients at once, 0 for no limit")
+	fs.StringVar(&tokensPath, "tokens", tokensPath, "file of access tokens and their roles, which turns on authentication; an admin token is written to it if it has none")
+	fs.StringVar(&anonRole, "anonymousRole", anonRole, "role of requests without a token: none, viewer, remote, sensor or admin")
+	fs.BoolVar(&useTLS, "tls", useTLS, "serve HTTPS and secure websockets, with tlsCert and tlsKey or a certificate generated in tlsDir")
+	fs.StringVar(&tlsCert, "tlsCert", tlsCert, "TLS certificate file, implies -tls")
+	fs.StringVar(&tlsKey, "tlsKey", tlsKey, "TLS private key file")
+	fs.StringVar(&tlsDir, "tlsDir", tlsDir, "directory for the generated TLS certificate authority and certificate")
+	fs.StringVar(&tlsHosts, "tlsHosts", tlsHosts, "comma separated host names and addresses the generated certificate is for, and its CA may only sign for")
+	fs.BoolVar(&devMode, "dev", devMode, "reload templates when they change and show template errors in the page")
+	fs.StringVar(&clientDir, "clientDir", clientDir, "serve the page and its scripts from this directory instead of the ones built in, for development")
+	fs.StringVar(&basePath, "basePath", basePath, "path prefix to serve everything under, like /mirror")
+	fs.BoolVar(&behindProxy, "behindProxy", behindProxy, "trust X-Forwarded-Host, X-Forwarded-Proto and X-Forwarded-For from a reverse proxy")
+	fs.StringVar(&origins, "allowedOrigins", origins, "comma separated origins whose pages may open the websocket, like http://mirror.local:8081; empty for only the mirror's own, * for any")
 }
 
-func updateWeather(state *State) *StateMessage {
+func updateWeather(apiServer *state.Server, local *State) *StateMessage {
 	log.Printf("starting weather updator")
 
-	service := darksky.NewService(weatherKey)
-	res, err := service.Get(float32(lat), float32(long))
+	settingsLocker.Lock()
+	key, latitude, longitude := weatherKey, lat, long
+	settingsLocker.Unlock()
+
+	start := time.Now()
+	service := darksky.NewService(key)
+	res, err := service.Get(float32(latitude), float32(longitude))
+	weatherDuration.Since(start)
 	if err != nil {
 		log.Printf("error getting weather %v", err)
+		weatherFetches.Inc("error")
+		weatherHealth.failed(err)
 		return nil
 	}
+	weatherFetches.Inc("success")
+	weatherHealth.succeeded()
 
 	// log.Printf("updating weather: %v", res)
 
-	// should do locked...
-	state.Forecast.Updated = time.Now()
-	state.Forecast.DateTime = time.Time(res.Currently.Time)
+	// the forecast is changed through the state server so the change is
+	// numbered like any other
+	var f forecast
+	apiServer.DoLocked(func() error {
+		f = local.Forecast
+		return nil
+	})
+
+	f.Updated = time.Now()
+	f.DateTime = time.Time(res.Currently.Time)
 	if res.Currently.TemperatureHigh != nil {
-		state.Forecast.High = *res.Currently.TemperatureHigh
+		f.High = *res.Currently.TemperatureHigh
 	}
 	if res.Currently.TemperatureLow != nil {
-		state.Forecast.Low = *res.Currently.TemperatureLow
+		f.Low = *res.Currently.TemperatureLow
 	}
-	state.Forecast.Icon = res.Currently.Icon
-	state.Forecast.Summary = res.Currently.Summary
-	state.Forecast.Darksky = &res
+	f.Icon = res.Currently.Icon
+	f.Summary = res.Currently.Summary
+	f.Darksky = &res
 
 	if res.Daily != nil && len(res.Daily.Data) > 0 {
 		// log.Printf("hourly")
 		if res.Daily.Data[0].TemperatureHigh != nil {
-			state.Forecast.High = *res.Daily.Data[0].TemperatureHigh
+			f.High = *res.Daily.Data[0].TemperatureHigh
 		}
 		if res.Daily.Data[0].TemperatureLow != nil {
-			state.Forecast.Low = *res.Daily.Data[0].TemperatureLow
+			f.Low = *res.Daily.Data[0].TemperatureLow
 		}
-		state.Forecast.Icon = res.Daily.Data[0].Icon
+		f.Icon = res.Daily.Data[0].Icon
 	}
 
-	b, err := json.Marshal(state.Forecast)
+	b, err := json.Marshal(f)
 	if err != nil {
 		// why would this error?
 		panic(err)
 	}
 
-	return &StateMessage{
+	msg := &StateMessage{
 		Method: http.MethodPost,
 		Path:   "forecast",
 		Body:   (*json.RawMessage)(&b),
 	}
-
+	if err := applyMessage(apiServer, msg); err != nil {
+		log.Printf("error updating forecast: %v", err)
+		return nil
+	}
+	return msg
 }
 
-func weatherUpdator(apiServer *state.Server, state *State, stopper <-chan struct{}, messages chan<- StateMessage) {
+// weatherUpdator updates the forecast every two hours, or when refresh says
+// the weather settings changed
+func weatherUpdator(apiServer *state.Server, state *State, stopper <-chan struct{}, messages chan<- StateMessage, refresh <-chan struct{}) {
 	ticker := time.NewTicker(2 * time.Hour)
 	defer ticker.Stop()
 
-	if msg := updateWeather(state); msg != nil {
+	if msg := updateWeather(apiServer, state); msg != nil {
 		messages <- *msg
 	}
 
 	for {
 		select {
 		case <-ticker.C:
-			if msg := updateWeather(state); msg != nil {
+			if msg := updateWeather(apiServer, state); msg != nil {
+				messages <- *msg
+			}
+		case <-refresh:
+			if msg := updateWeather(apiServer, state); msg != nil {
 				messages <- *msg
 			}
 		case <-stopper:
@@ -124,6 +213,21 @@ func weatherUpdator(apiServer *state.Server, state *State, stopper <-chan struct
 type StateServer struct {
 	messages chan<- StateMessage
 	server   *state.Server
+	// blobs stores the data-uris in changes
+	blobs *BlobStore
+	// hub numbers the changes, for revisions and watching
+	hub *Sockets
+}
+
+// writeError writes err as a JSON error message with the status it carries
+func writeError(w http.ResponseWriter, err error) {
+	msg, _ := json.Marshal(MessageFromError(err))
+
+	if s, ok := err.(state.Statuser); ok {
+		http.Error(w, string(msg), s.Status())
+	} else {
+		http.Error(w, string(msg), http.StatusInternalServerError)
+	}
 }
 
 func (s *StateServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
@@ -131,6 +235,8 @@ func (s *StateServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	var err error
 	var res []byte
 	var path string
+	var stored []byte
+	var change uint64
 
 	if r.Body != nil {
 		body, err = ioutil.ReadAll(r.Body)
@@ -140,36 +246,48 @@ func (s *StateServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		}
 	}
 
+	if id := identityFrom(r.Context()); !id.Allowed(r.Method, r.URL.Path) {
+		writeError(w, id.accessError())
+		return
+	}
+
 	switch r.Method {
 	case http.MethodGet:
+		if r.URL.Query().Get("watch") != "" {
+			s.watch(w, r)
+			return
+		}
+		if s.hub != nil {
+			// the revision is taken first so it never claims a change the
+			// value doesn't have
+			w.Header().Set(revisionHeader, strconv.FormatUint(s.revision(r), 10))
+		}
 		res, err = s.server.Get(r.URL.Path)
-	case http.MethodPost:
-		path, err = s.server.Post(r.URL.Path, body)
-	case http.MethodPut:
-		path, err = s.server.Put(r.URL.Path, body)
-	case http.MethodDelete:
-		err = s.server.Delete(r.URL.Path)
+	case http.MethodPost, http.MethodPut, http.MethodDelete:
+		if body, err = s.blobs.storeBody(r.Method, r.URL.Path, body); err == nil {
+			path, stored, change, err = s.server.Apply(r.Method, r.URL.Path, body)
+		}
 	default:
 		http.Error(w, "method not supported", http.StatusMethodNotAllowed)
 		return
 	}
 
 	if err != nil {
-		msg, _ := json.Marshal(map[string]string{"error": err.Error()})
-
-		if s, ok := err.(state.Statuser); ok {
-			http.Error(w, string(msg), s.Status())
-		} else {
-			http.Error(w, string(msg), http.StatusInternalServerError)
-		}
+		writeError(w, err)
 		return
 	}
 
 	if r.Method != http.MethodGet {
+		// broadcast what was stored rather than what was sent, so data-uris
+		// go out as blob references
+		if stored != nil {
+			body = stored
+		}
 		s.messages <- StateMessage{
 			Body:   (*json.RawMessage)(&body),
 			Method: r.Method,
 			Path:   r.URL.Path,
+			Change: change,
 		}
 	}
 
@@ -186,10 +304,22 @@ func main() {
 	log.SetFlags(log.Lshortfile | log.LstdFlags)
 	flag.Parse()
 
+	if configPath == "" {
+		configPath = os.Getenv(configEnv)
+	}
+	settings, err := LoadSettings(flag.CommandLine, configPath)
+	if err != nil {
+		log.Fatal(err)
+	}
+
 	stopper := make(chan struct{})
 	messages := make(chan StateMessage)
-	interrupt := make(chan os.Signal)
+	// senders counts the background tasks sending on messages
+	senders := &sync.WaitGroup{}
+	interrupt := make(chan os.Signal, 1)
 	signal.Notify(interrupt, os.Interrupt)
+	hangup := make(chan os.Signal, 1)
+	signal.Notify(hangup, syscall.SIGHUP)
 
 	local := new(State)
 	apiServer := state.NewServer(local)
@@ -198,43 +328,271 @@ func main() {
 		server:   apiServer,
 	}
 
-	if err := local.Load(statePath); err != nil && !os.IsNotExist(err) {
+	mode, err := ParseEncryptMode(encryptMode)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if encryption, err = LoadEncryption(mode, keyFile, os.Getenv(stateKeyEnv)); err != nil {
 		log.Fatal(err)
 	}
 
-	go weatherUpdator(apiServer, local, stopper, messages)
+	blobs, err := NewBlobStore(blobPath)
+	if err != nil {
+		log.Fatal(err)
+	}
+	blobStore = blobs
+	stateServer.blobs = blobs
 
-	sockets := NewSockets(stateServer, stopper)
+	policy, err := ParseSyncPolicy(journalSync)
+	if err != nil {
+		log.Fatal(err)
+	}
+	storage, err := OpenStorage(storageKind, statePath, policy)
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer storage.Close()
+
+	sdStatus("loading state from %s", statePath)
+	if err := storage.Load(local); err != nil {
+		log.Fatal(err)
+	}
+
+	var watcher *StateWatcher
+	if watchState > 0 && storageKind != "kv" {
+		conflictPolicy, err := ParseConflictPolicy(conflicts)
+		if err != nil {
+			log.Fatal(err)
+		}
+		if watcher, err = NewStateWatcher(statePath, apiServer, local, messages, conflictPolicy); err != nil {
+			log.Fatal(err)
+		}
+		storage = watchedStorage{storage, watcher}
+		senders.Add(1)
+		go func() {
+			defer senders.Done()
+			watcher.Run(watchState, stopper)
+		}()
+	}
+
+	if mode != EncryptNone {
+		// rewrite everything with the current key, which also encrypts state
+		// written before encryption was turned on
+		if err := apiServer.DoLocked(func() error { return storage.Snapshot(local, apiServer.Revision()) }); err != nil {
+			log.Fatal(err)
+		}
+		go func() {
+			if n, err := blobs.Reseal(); err != nil {
+				log.Printf("error encrypting blobs: %v", err)
+			} else if n > 0 {
+				log.Printf("encrypted %d blobs with the current key", n)
+			}
+		}()
+	}
+
+	persister := NewPersister(storage, apiServer, local, compactEvery, saveDelay, saveMaxDelay)
+
+	weatherRefresh := make(chan struct{}, 1)
+	senders.Add(1)
+	go func() {
+		defer senders.Done()
+		weatherUpdator(apiServer, local, stopper, messages, weatherRefresh)
+	}()
+	go blobCollector(blobs, apiServer, local, stopper)
+
+	overflowPolicy, err := ParseOverflowPolicy(overflow)
+	if err != nil {
+		log.Fatal(err)
+	}
+	originPolicy, err := ParseOriginPolicy(origins)
+	if err != nil {
+		log.Fatal(err)
+	}
+	sockets := NewSockets(stateServer, stopper, SocketConfig{
+		QueueSize:      queueSize,
+		Overflow:       overflowPolicy,
+		HistorySize:    historySize,
+		PingInterval:   pingInterval,
+		IdleTimeout:    idleTimeout,
+		WriteTimeout:   writeTimeout,
+		MaxConnections: maxConns,
+		Origins:        originPolicy,
+	})
+	stateServer.hub = sockets
+
+	var auth *Auth
+	if tokensPath != "" {
+		role, err := ParseRole(anonRole)
+		if err != nil {
+			log.Fatal(err)
+		}
+		if auth, err = LoadAuth(tokensPath, role); err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	var tlsConfig *tls.Config
+	if useTLS || tlsCert != "" {
+		hosts := []string{}
+		for _, h := range strings.Split(tlsHosts, ",") {
+			if h = strings.TrimSpace(h); h != "" {
+				hosts = append(hosts, h)
+			}
+		}
+		if tlsConfig, err = LoadTLS(tlsCert, tlsKey, tlsDir, hosts); err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	prefix, err := ParseBasePath(basePath)
+	if err != nil {
+		log.Fatal(err)
+	}
+	proxy := Proxy{BasePath: prefix, Trusted: behindProxy}
+
+	client, err := ClientFS(clientDir)
+	if err != nil {
+		log.Fatal(err)
+	}
+	templates, err := NewTemplates(client, "index.html", devMode)
+	if err != nil {
+		log.Fatal(err)
+	}
 
 	mux := http.NewServeMux()
-	mux.Handle("/api/", http.StripPrefix("/api", stateServer))
+	mux.Handle("/api/", RequireCSRF(http.StripPrefix("/api", stateServer)))
+	archiver := &Archiver{
+		server:   apiServer,
+		blobs:    blobs,
+		messages: messages,
+	}
+	mux.Handle("/api/_export", RequireAdmin(http.HandlerFunc(archiver.Export)))
+	mux.Handle("/api/_import", RequireAdmin(RequireCSRF(http.HandlerFunc(archiver.Import))))
+	if auth != nil {
+		mux.HandleFunc("/api/_pair", auth.Pair)
+		mux.Handle("/api/_pair/code", RequireAdmin(http.HandlerFunc(auth.PairingCode)))
+		mux.Handle("/api/_tokens", RequireAdmin(http.HandlerFunc(auth.Tokens)))
+	}
+	health := NewHealth(persister, sockets, watcher)
+	mux.Handle("/api/_status", Require(http.MethodGet, "", health))
+	mux.HandleFunc("/healthz", health.Healthz)
+	mux.HandleFunc("/readyz", health.Readyz)
+	registerStatusMetrics(persister, sockets)
+	mux.Handle("/metrics", Require(http.MethodGet, "", metrics))
+	mux.Handle("/api/_connections", RequireAdmin(http.HandlerFunc(sockets.Connections)))
 	mux.Handle("/websocket", sockets)
-	mux.Handle("/client/", http.StripPrefix("/client/", http.FileServer(http.Dir("client"))))
-	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
-		indexBytes := mustExecuteTemplate("client/index.html", "index.html", map[string]interface{}{
-			"WebsocketURL": template.URL(fmt.Sprintf("ws://%s/websocket", addr)),
+	mux.Handle("/events", Require(http.MethodGet, "", http.HandlerFunc(sockets.Events)))
+	mux.Handle("/blobs/", Require(http.MethodGet, "", http.StripPrefix("/blobs/", blobs)))
+	if tlsConfig != nil && tlsCert == "" {
+		// for installing on the devices that use the mirror
+		mux.HandleFunc("/ca.pem", func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Content-Type", "application/x-pem-file")
+			http.ServeFile(w, r, filepath.Join(tlsDir, tlsCAFile))
 		})
+	}
+	mux.Handle("/client/", http.StripPrefix("/client/", NewStaticFiles(client, devMode || clientDir != "")))
+	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		// the state is in the page so it can be shown before the websocket
+		// connects
+		var snapshot interface{}
+		if identityFrom(r.Context()).Allowed(http.MethodGet, "") {
+			if b, err := apiServer.Get("/"); err == nil {
+				snapshot = json.RawMessage(b)
+			}
+		}
 
-		w.Write(indexBytes)
+		templates.Execute(w, "index.html", map[string]interface{}{
+			"WebsocketURL": proxy.WebsocketURL(r),
+			"CSRFToken":    csrfToken(w, r),
+			"Version":      version,
+			"State":        snapshot,
+			"Config": map[string]interface{}{
+				"basePath":     proxy.BasePath,
+				"auth":         auth != nil,
+				"stateVersion": stateVersion(),
+			},
+		})
 	})
 
 	s := http.Server{
-		Addr:    addr,
-		Handler: mux,
+		Addr:      addr,
+		Handler:   proxy.Handler(InstrumentHandler(auth.Handler(mux))),
+		TLSConfig: tlsConfig,
 	}
 
+	// the watchdog and health checks see the loop is still taking messages by
+	// asking it to close a channel
+	liveness := make(chan chan struct{})
+	loopDone := make(chan struct{})
 	go func() {
+		defer close(loopDone)
 		for {
 			select {
-			case msg := <-messages:
-				log.Printf("got message: %#v", msg)
-				if err := local.Save(statePath); err != nil {
-					log.Fatal(err)
+			case alive := <-liveness:
+				close(alive)
+			case msg, ok := <-messages:
+				if !ok {
+					return
 				}
+				log.Printf("got message: %#v", msg)
+				persister.Notify(msg)
 				sockets.Write(msg)
+				countDetection(msg)
+			}
+		}
+	}()
+	loopAlive := func(timeout time.Duration) bool {
+		alive := make(chan struct{})
+		timer := time.NewTimer(timeout)
+		defer timer.Stop()
+
+		select {
+		case liveness <- alive:
+		case <-timer.C:
+			return false
+		}
+		select {
+		case <-alive:
+			return true
+		case <-timer.C:
+			return false
+		}
+	}
+	health.SetAlive(loopAlive)
+
+	// reload what can be changed without a restart on SIGHUP
+	go func() {
+		for {
+			select {
+			case <-hangup:
 			case <-stopper:
 				return
 			}
+
+			applied, err := settings.Reload()
+			if err != nil {
+				log.Printf("not reloading settings: %v", err)
+				continue
+			}
+			for _, name := range applied {
+				log.Printf("reloaded %s", name)
+				switch name {
+				case "weatherKey", "lat", "long":
+					select {
+					case weatherRefresh <- struct{}{}:
+					default:
+					}
+				case "allowedOrigins":
+					policy, _ := ParseOriginPolicy(origins)
+					sockets.SetOrigins(policy)
+				}
+			}
+			if auth != nil {
+				role, _ := ParseRole(anonRole)
+				if err := auth.Reload(role); err != nil {
+					log.Printf("error reloading tokens: %v", err)
+				}
+			}
 		}
 	}()
 
@@ -243,12 +601,50 @@ func main() {
 		<-interrupt
 
 		log.Println("shutting down")
+		sdNotify("STOPPING=1")
+		health.SetReady(false)
+
+		// stop everything that sends changes before closing the channel
+		// they are sent on, while the loop keeps taking them
 		close(stopper)
+		if err := s.Shutdown(context.Background()); err != nil {
+			log.Printf("error shutting down: %v", err)
+		}
+		sockets.Close()
+		senders.Wait()
 		close(messages)
-		s.Close()
 	}()
 
-	if err := s.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+	// systemd may have opened the socket for us
+	listener, err := systemdListener()
+	if err != nil {
+		log.Fatal(err)
+	} else if listener == nil {
+		if listener, err = net.Listen("tcp", addr); err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	// the state was loaded before getting here
+	health.SetReady(true)
+	if err := sdNotify("READY=1\nSTATUS=serving on " + listener.Addr().String()); err != nil {
+		log.Printf("error notifying systemd: %v", err)
+	}
+	if interval := watchdogInterval(); interval > 0 {
+		go runWatchdog(interval, loopAlive, stopper)
+	}
+
+	if tlsConfig != nil {
+		err = s.ServeTLS(listener, "", "")
+	} else {
+		err = s.Serve(listener)
+	}
+	if err != nil && err != http.ErrServerClosed {
 		log.Fatal(err)
 	}
+
+	<-loopDone
+	if err := persister.Close(); err != nil {
+		log.Printf("error saving state on shutdown: %v", err)
+	}
 }
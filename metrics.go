@@ -0,0 +1,453 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"math"
+	"net"
+	"net/http"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Metrics collects counters, gauges and histograms and serves them in the
+// Prometheus text format, without needing the Prometheus client
+type Metrics struct {
+	locker     sync.Locker
+	collectors []collector
+}
+
+type collector interface {
+	write(buf *bytes.Buffer)
+}
+
+// NewMetrics creates an empty registry
+func NewMetrics() *Metrics {
+	return &Metrics{locker: &sync.Mutex{}}
+}
+
+func (m *Metrics) register(c collector) {
+	m.locker.Lock()
+	defer m.locker.Unlock()
+	m.collectors = append(m.collectors, c)
+}
+
+func (m *Metrics) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not supported", http.StatusMethodNotAllowed)
+		return
+	}
+
+	m.locker.Lock()
+	collectors := append([]collector{}, m.collectors...)
+	m.locker.Unlock()
+
+	buf := &bytes.Buffer{}
+	for _, c := range collectors {
+		c.write(buf)
+	}
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	w.Write(buf.Bytes())
+}
+
+func writeHeader(buf *bytes.Buffer, name, help, kind string) {
+	fmt.Fprintf(buf, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, kind)
+}
+
+// writeSample writes one value, with labels given as name and value pairs
+func writeSample(buf *bytes.Buffer, name string, labels []string, v float64) {
+	buf.WriteString(name)
+	if len(labels) > 0 {
+		buf.WriteByte('{')
+		for i := 0; i+1 < len(labels); i += 2 {
+			if i > 0 {
+				buf.WriteByte(',')
+			}
+			fmt.Fprintf(buf, "%s=%s", labels[i], strconv.Quote(labels[i+1]))
+		}
+		buf.WriteByte('}')
+	}
+	buf.WriteByte(' ')
+	buf.WriteString(formatValue(v))
+	buf.WriteByte('\n')
+}
+
+func formatValue(v float64) string {
+	switch {
+	case math.IsInf(v, 1):
+		return "+Inf"
+	case math.IsInf(v, -1):
+		return "-Inf"
+	}
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+// pairLabels zips label names with values for writeSample
+func pairLabels(names []string, values []string) []string {
+	ret := make([]string, 0, 2*len(names))
+	for i, n := range names {
+		ret = append(ret, n, values[i])
+	}
+	return ret
+}
+
+// CounterVec counts events, one count for each combination of labels
+type CounterVec struct {
+	name, help string
+	labels     []string
+
+	locker sync.Locker
+	values map[string]float64
+}
+
+// NewCounterVec registers a counter with the given label names
+func (m *Metrics) NewCounterVec(name, help string, labels ...string) *CounterVec {
+	c := &CounterVec{
+		name:   name,
+		help:   help,
+		labels: labels,
+		locker: &sync.Mutex{},
+		values: make(map[string]float64),
+	}
+	if len(labels) == 0 {
+		// report zero rather than nothing before the first event
+		c.values[""] = 0
+	}
+	m.register(c)
+	return c
+}
+
+// Add adds v to the count for the label values, in the order of the names
+func (c *CounterVec) Add(v float64, labels ...string) {
+	key := strings.Join(labels, "\x00")
+
+	c.locker.Lock()
+	defer c.locker.Unlock()
+	c.values[key] += v
+}
+
+// Inc adds one to the count for the label values
+func (c *CounterVec) Inc(labels ...string) {
+	c.Add(1, labels...)
+}
+
+func (c *CounterVec) write(buf *bytes.Buffer) {
+	c.locker.Lock()
+	defer c.locker.Unlock()
+
+	writeHeader(buf, c.name, c.help, "counter")
+	keys := make([]string, 0, len(c.values))
+	for k := range c.values {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		var values []string
+		if len(c.labels) > 0 {
+			values = strings.Split(k, "\x00")
+		}
+		writeSample(buf, c.name, pairLabels(c.labels, values), c.values[k])
+	}
+}
+
+// defaultBuckets are the histogram bounds, in seconds, for latencies
+var defaultBuckets = []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10}
+
+type histogramValue struct {
+	counts []uint64
+	sum    float64
+	count  uint64
+}
+
+// HistogramVec counts observations, like latencies, into buckets, one
+// histogram for each combination of labels
+type HistogramVec struct {
+	name, help string
+	labels     []string
+	buckets    []float64
+
+	locker sync.Locker
+	values map[string]*histogramValue
+}
+
+// NewHistogramVec registers a histogram with the given upper bounds and label
+// names
+func (m *Metrics) NewHistogramVec(name, help string, buckets []float64, labels ...string) *HistogramVec {
+	h := &HistogramVec{
+		name:    name,
+		help:    help,
+		labels:  labels,
+		buckets: buckets,
+		locker:  &sync.Mutex{},
+		values:  make(map[string]*histogramValue),
+	}
+	m.register(h)
+	return h
+}
+
+// Observe records v for the label values
+func (h *HistogramVec) Observe(v float64, labels ...string) {
+	key := strings.Join(labels, "\x00")
+
+	h.locker.Lock()
+	defer h.locker.Unlock()
+
+	hv, ok := h.values[key]
+	if !ok {
+		hv = &histogramValue{counts: make([]uint64, len(h.buckets))}
+		h.values[key] = hv
+	}
+	for i, b := range h.buckets {
+		if v <= b {
+			hv.counts[i]++
+		}
+	}
+	hv.sum += v
+	hv.count++
+}
+
+// Since records the time since start, in seconds
+func (h *HistogramVec) Since(start time.Time, labels ...string) {
+	h.Observe(time.Since(start).Seconds(), labels...)
+}
+
+func (h *HistogramVec) write(buf *bytes.Buffer) {
+	h.locker.Lock()
+	defer h.locker.Unlock()
+
+	writeHeader(buf, h.name, h.help, "histogram")
+	keys := make([]string, 0, len(h.values))
+	for k := range h.values {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		var values []string
+		if len(h.labels) > 0 {
+			values = strings.Split(k, "\x00")
+		}
+		labels := pairLabels(h.labels, values)
+		hv := h.values[k]
+		for i, b := range h.buckets {
+			writeSample(buf, h.name+"_bucket", append(labels, "le", formatValue(b)), float64(hv.counts[i]))
+		}
+		writeSample(buf, h.name+"_bucket", append(labels, "le", "+Inf"), float64(hv.count))
+		writeSample(buf, h.name+"_sum", labels, hv.sum)
+		writeSample(buf, h.name+"_count", labels, float64(hv.count))
+	}
+}
+
+// funcMetric reports a value computed when scraped, like a count kept
+// elsewhere
+type funcMetric struct {
+	name, help, kind string
+	fn               func() float64
+}
+
+// NewGaugeFunc registers a gauge read from fn
+func (m *Metrics) NewGaugeFunc(name, help string, fn func() float64) {
+	m.register(&funcMetric{name: name, help: help, kind: "gauge", fn: fn})
+}
+
+// NewCounterFunc registers a counter read from fn, which must never decrease
+func (m *Metrics) NewCounterFunc(name, help string, fn func() float64) {
+	m.register(&funcMetric{name: name, help: help, kind: "counter", fn: fn})
+}
+
+func (f *funcMetric) write(buf *bytes.Buffer) {
+	writeHeader(buf, f.name, f.help, f.kind)
+	writeSample(buf, f.name, nil, f.fn())
+}
+
+// metrics is every metric the mirror reports at /metrics
+var metrics = NewMetrics()
+
+var (
+	httpRequests = metrics.NewCounterVec("mirror_http_requests_total",
+		"HTTP requests by method, path and status.", "method", "path", "status")
+	httpDuration = metrics.NewHistogramVec("mirror_http_request_duration_seconds",
+		"Time to answer HTTP requests, by method and path.", defaultBuckets, "method", "path")
+	socketRequests = metrics.NewCounterVec("mirror_websocket_requests_total",
+		"Requests made over the websocket, by method and status.", "method", "status")
+	saveDuration = metrics.NewHistogramVec("mirror_state_save_duration_seconds",
+		"Time to save changes to the state.", defaultBuckets)
+	saveFailures = metrics.NewCounterVec("mirror_state_save_failures_total",
+		"Saves of the state that failed.")
+	weatherFetches = metrics.NewCounterVec("mirror_weather_fetches_total",
+		"Weather forecast fetches, by result.", "result")
+	weatherDuration = metrics.NewHistogramVec("mirror_weather_fetch_duration_seconds",
+		"Time to fetch the weather forecast.", defaultBuckets)
+	detections = metrics.NewCounterVec("mirror_detections_total",
+		"Detections received from sensors, by kind.", "kind")
+)
+
+func init() {
+	metrics.NewGaugeFunc("mirror_weather_age_seconds", "Time since the forecast was last fetched, -1 if it never has been.", func() float64 {
+		last := weatherHealth.Status().LastUpdate
+		if last.IsZero() {
+			return -1
+		}
+		return time.Since(last).Seconds()
+	})
+}
+
+// registerStatusMetrics reports the counts the persister and websocket hub
+// already keep for their status
+func registerStatusMetrics(persister *Persister, sockets *Sockets) {
+	metrics.NewGaugeFunc("mirror_state_pending_changes", "Changes to the state not saved yet.", func() float64 {
+		return float64(persister.Status().Pending)
+	})
+
+	socketStat := func(name, help string, kind string, f func(s SocketStats) float64) {
+		fn := func() float64 { return f(sockets.Status()) }
+		if kind == "gauge" {
+			metrics.NewGaugeFunc(name, help, fn)
+		} else {
+			metrics.NewCounterFunc(name, help, fn)
+		}
+	}
+	socketStat("mirror_websocket_connections", "Connected websocket and event stream clients.", "gauge",
+		func(s SocketStats) float64 { return float64(s.Connections) })
+	socketStat("mirror_websocket_queued_messages", "Messages waiting to be sent to clients.", "gauge",
+		func(s SocketStats) float64 { return float64(s.Queued) })
+	socketStat("mirror_websocket_messages_sent_total", "Messages sent to clients.", "counter",
+		func(s SocketStats) float64 { return float64(s.Sent) })
+	socketStat("mirror_websocket_messages_dropped_total", "Messages dropped because a client fell behind.", "counter",
+		func(s SocketStats) float64 { return float64(s.Dropped) })
+	socketStat("mirror_websocket_messages_coalesced_total", "Messages replaced by a newer change to the same path.", "counter",
+		func(s SocketStats) float64 { return float64(s.Coalesced) })
+	socketStat("mirror_websocket_disconnected_total", "Clients disconnected for falling behind.", "counter",
+		func(s SocketStats) float64 { return float64(s.Disconnected) })
+	socketStat("mirror_websocket_timed_out_total", "Clients disconnected for not answering pings.", "counter",
+		func(s SocketStats) float64 { return float64(s.TimedOut) })
+	socketStat("mirror_websocket_refused_total", "Clients refused for being over the connection limit.", "counter",
+		func(s SocketStats) float64 { return float64(s.Refused) })
+}
+
+// metricsPaths are the first segments of API paths given their own label, so
+// stray requests can't create unlimited series
+var metricsPaths = func() map[string]bool {
+	ret := map[string]bool{}
+	t := reflect.TypeOf(State{})
+	for i := 0; i < t.NumField(); i++ {
+		if name := strings.Split(t.Field(i).Tag.Get("json"), ",")[0]; name != "" {
+			ret[name] = true
+		}
+	}
+	return ret
+}()
+
+// metricsRoutes are the API routes outside the state with their own label
+var metricsRoutes = map[string]bool{
+	"_export":      true,
+	"_import":      true,
+	"_status":      true,
+	"_pair":        true,
+	"_tokens":      true,
+	"_connections": true,
+}
+
+// metricsPath reduces a request path to the route it was served by, like
+// /api/display or /blobs
+func metricsPath(p string) string {
+	segments := splitPath(p)
+	switch {
+	case len(segments) == 0:
+		return "/"
+	case segments[0] != "api":
+		switch segments[0] {
+		case "websocket", "events", "blobs", "client", "metrics", "ca.pem", "healthz", "readyz":
+			return "/" + segments[0]
+		}
+		return "other"
+	case len(segments) == 1:
+		return "/api"
+	case metricsPaths[segments[1]] || metricsRoutes[segments[1]]:
+		return "/api/" + segments[1]
+	}
+	return "/api/other"
+}
+
+// metricsMethod is the method label for a request, which is limited to the
+// methods that are served
+func metricsMethod(method string) string {
+	switch method {
+	case http.MethodGet, http.MethodHead, http.MethodPost, http.MethodPut, http.MethodDelete,
+		MethodSubscribe, MethodUnsubscribe, MethodResume:
+		return method
+	}
+	return "other"
+}
+
+// countDetection counts changes that add sensor detections
+func countDetection(msg StateMessage) {
+	if msg.Method != http.MethodPut && msg.Method != http.MethodPost {
+		return
+	}
+	segments := splitPath(msg.Path)
+	if len(segments) >= 2 && segments[1] == "detections" && (segments[0] == "faces" || segments[0] == "motion") {
+		detections.Inc(segments[0])
+	}
+}
+
+// statusRecorder remembers the status written, while still letting event
+// streams flush and websockets take over the connection
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+}
+
+func (r *statusRecorder) WriteHeader(status int) {
+	if r.status == 0 {
+		r.status = status
+	}
+	r.ResponseWriter.WriteHeader(status)
+}
+
+func (r *statusRecorder) Write(b []byte) (int, error) {
+	if r.status == 0 {
+		r.status = http.StatusOK
+	}
+	return r.ResponseWriter.Write(b)
+}
+
+func (r *statusRecorder) Flush() {
+	if f, ok := r.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+func (r *statusRecorder) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	h, ok := r.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, fmt.Errorf("connection can't be taken over")
+	}
+	r.status = http.StatusSwitchingProtocols
+	return h.Hijack()
+}
+
+// InstrumentHandler counts the requests to next and times them.  Websockets
+// and event streams are only counted, since they last as long as the client
+// stays.
+func InstrumentHandler(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		rec := &statusRecorder{ResponseWriter: w}
+		next.ServeHTTP(rec, r)
+
+		if rec.status == 0 {
+			rec.status = http.StatusOK
+		}
+		path := metricsPath(r.URL.Path)
+		method := metricsMethod(r.Method)
+		httpRequests.Inc(method, path, strconv.Itoa(rec.status))
+		if path != "/websocket" && path != "/events" {
+			httpDuration.Since(start, method, path)
+		}
+	})
+}
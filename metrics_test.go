@@ -0,0 +1,87 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestMetrics(t *testing.T) {
+	m := NewMetrics()
+	requests := m.NewCounterVec("test_requests_total", "Requests.", "method", "path")
+	m.NewCounterVec("test_failures_total", "Failures.")
+	latency := m.NewHistogramVec("test_latency_seconds", "Latency.", []float64{0.1, 1})
+	m.NewGaugeFunc("test_answer", "The answer.", func() float64 { return 42 })
+
+	requests.Inc("GET", "/api/display")
+	requests.Inc("GET", "/api/display")
+	requests.Add(3, "POST", `/quoted"path`)
+	latency.Observe(0.05)
+	latency.Observe(0.5)
+	latency.Observe(5)
+
+	w := httptest.NewRecorder()
+	m.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	body := w.Body.String()
+
+	for _, line := range []string{
+		"# TYPE test_requests_total counter",
+		`test_requests_total{method="GET",path="/api/display"} 2`,
+		`test_requests_total{method="POST",path="/quoted\"path"} 3`,
+		"test_failures_total 0",
+		`test_latency_seconds_bucket{le="0.1"} 1`,
+		`test_latency_seconds_bucket{le="1"} 2`,
+		`test_latency_seconds_bucket{le="+Inf"} 3`,
+		"test_latency_seconds_sum 5.55",
+		"test_latency_seconds_count 3",
+		"# TYPE test_answer gauge",
+		"test_answer 42",
+	} {
+		if !strings.Contains(body, line+"\n") {
+			t.Errorf("expected '%s' in:\n%s", line, body)
+		}
+	}
+}
+
+func TestMetricsPath(t *testing.T) {
+	tests := map[string]string{
+		"/":                     "/",
+		"/api/display/power":    "/api/display",
+		"/api/_status":          "/api/_status",
+		"/api/_pair/code":       "/api/_pair",
+		"/api/_anything":        "/api/other",
+		"/api/nothing/here":     "/api/other",
+		"/blobs/abc":            "/blobs",
+		"/client/icons/fog.svg": "/client",
+		"/wp-login.php":         "other",
+	}
+	for path, expected := range tests {
+		if got := metricsPath(path); got != expected {
+			t.Errorf("%s: expected %s, got %s", path, expected, got)
+		}
+	}
+}
+
+func TestInstrumentHandler(t *testing.T) {
+	handler := InstrumentHandler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "nope", http.StatusTeapot)
+	}))
+	// the registry is shared, so compare with the count before the request
+	count := func() float64 {
+		httpRequests.locker.Lock()
+		defer httpRequests.locker.Unlock()
+		return httpRequests.values[strings.Join([]string{"other", "/api/display", "418"}, "\x00")]
+	}
+	before := count()
+	handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("BREW", "/api/display", nil))
+	if after := count(); after != before+1 {
+		t.Errorf("expected the request counted once, went from %v to %v", before, after)
+	}
+
+	w := httptest.NewRecorder()
+	metrics.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	if line := `mirror_http_requests_total{method="other",path="/api/display",status="418"}`; !strings.Contains(w.Body.String(), line) {
+		t.Errorf("expected '%s' in:\n%s", line, w.Body.String())
+	}
+}
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+)
+
+// stateMigration upgrades a decoded state document by one schema version.
+// Numbers in the document are json.Number so they survive the round trip.
+type stateMigration struct {
+	description string
+	migrate     func(doc map[string]interface{}) error
+}
+
+// unversionedState is the version of documents without one, which were
+// written before versions were and have the same schema as version 1
+const unversionedState = 1
+
+// stateMigrations is the registry of schema changes, in order.  The migration
+// at index i upgrades a version i+1 document to version i+2, so the current
+// schema version is always len(stateMigrations)+1.  Append to the end; never
+// reorder or remove entries.
+var stateMigrations = []stateMigration{
+	{
+		description: "move face detection images to the blob store",
+		migrate:     moveImagesToBlobs,
+	},
+}
+
+// stateVersion returns the schema version written by State.Save
+func stateVersion() int {
+	return len(stateMigrations) + unversionedState
+}
+
+// moveImagesToBlobs stores the inline data-uri images of face detections in
+// the blob store and replaces them with references to it
+func moveImagesToBlobs(doc map[string]interface{}) error {
+	faces, _ := doc["faces"].(map[string]interface{})
+	detections, _ := faces["detections"].([]interface{})
+	for i, d := range detections {
+		detection, ok := d.(map[string]interface{})
+		if !ok {
+			continue
+		}
+		image, _ := detection["image"].(string)
+		if image == "" || strings.HasPrefix(image, blobPrefix) {
+			continue
+		}
+		if blobStore == nil {
+			return fmt.Errorf("no blob store for the image of detection %d", i)
+		}
+
+		uri, err := parseDataURI(image)
+		if err != nil {
+			return fmt.Errorf("image of detection %d: %v", i, err)
+		}
+		hash, err := blobStore.Put(strings.TrimPrefix(uri.contentType, "data:"), uri.data)
+		if err != nil {
+			return err
+		}
+		detection["image"] = blobPrefix + hash
+	}
+	return nil
+}
+
+// migrateState runs every migration needed to bring b up to the current
+// schema and returns the upgraded document along with its original version
+func migrateState(b []byte) ([]byte, int, error) {
+	doc := make(map[string]interface{})
+
+	dec := json.NewDecoder(bytes.NewReader(b))
+	dec.UseNumber()
+	if err := dec.Decode(&doc); err != nil {
+		return nil, 0, err
+	}
+
+	version := unversionedState
+	if v, ok := doc["version"]; ok {
+		n, ok := v.(json.Number)
+		if !ok {
+			return nil, 0, fmt.Errorf("state version must be a number, got %v", v)
+		}
+		i, err := strconv.Atoi(n.String())
+		if err != nil || i < unversionedState {
+			return nil, 0, fmt.Errorf("invalid state version '%s'", n)
+		}
+		version = i
+	}
+
+	if version > stateVersion() {
+		return nil, version, fmt.Errorf("state version %d is newer than supported version %d", version, stateVersion())
+	} else if version == stateVersion() {
+		return b, version, nil
+	}
+
+	for v := version; v < stateVersion(); v++ {
+		m := stateMigrations[v-unversionedState]
+		log.Printf("migrating state to version %d: %s", v+1, m.description)
+		if err := m.migrate(doc); err != nil {
+			return nil, version, fmt.Errorf("migrating state to version %d: %v", v+1, err)
+		}
+	}
+	doc["version"] = stateVersion()
+
+	ret, err := json.Marshal(doc)
+	return ret, version, err
+}
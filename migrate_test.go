@@ -0,0 +1,220 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// copyFixture copies a fixture into a temporary directory that also holds the
+// blob store, returning the new path and a function to remove it all
+func copyFixture(t *testing.T, fixture string) (string, func()) {
+	dir, err := ioutil.TempDir("", "migrate")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if blobStore, err = NewBlobStore(filepath.Join(dir, "blobs")); err != nil {
+		t.Fatal(err)
+	}
+
+	b, err := ioutil.ReadFile(filepath.Join("testdata", fixture))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	path := filepath.Join(dir, "state.json")
+	if err := ioutil.WriteFile(path, b, 0660); err != nil {
+		t.Fatal(err)
+	}
+
+	return path, func() {
+		blobStore = nil
+		os.RemoveAll(dir)
+	}
+}
+
+func TestLoadVersion0(t *testing.T) {
+	path, cleanup := copyFixture(t, "state-v0.json")
+	defer cleanup()
+
+	s := new(State)
+	if err := s.Load(path); err != nil {
+		t.Fatal(err)
+	}
+
+	if s.Display.PowerStatus != "on" {
+		t.Errorf("expected powerStatus 'on' got '%s'", s.Display.PowerStatus)
+	}
+	if s.Faces.MaxDetections != 50 || len(s.Faces.Detections) != 1 {
+		t.Errorf("faces not loaded: %#v", s.Faces)
+	} else if d := s.Faces.Detections[0]; d.Name != "donnie" || d.Image.Hash == "" {
+		t.Errorf("unexpected detection %#v", d)
+	} else if _, err := os.Stat(filepath.Join(filepath.Dir(path), "blobs", d.Image.Hash)); err != nil {
+		t.Errorf("expected the inline image to be moved to the blob store: %v", err)
+	}
+	if p, ok := s.Faces.People["donnie"]; !ok || len(p.Embedding) != 3 {
+		t.Errorf("people not loaded: %#v", s.Faces.People)
+	}
+	if len(s.Streams) != 1 || s.Streams[0].Name != "front door" {
+		t.Errorf("streams not loaded: %#v", s.Streams)
+	}
+
+	// files from before versioning are version 1
+	if _, err := os.Stat(path + ".v1"); err != nil {
+		t.Errorf("expected a backup of the unversioned file: %v", err)
+	}
+
+	// saving writes the current version, which loads without migrating
+	if err := s.Save(path); err != nil {
+		t.Fatal(err)
+	}
+	b, _ := ioutil.ReadFile(path)
+	if _, version, err := migrateState(b); err != nil {
+		t.Error(err)
+	} else if version != stateVersion() {
+		t.Errorf("expected saved version %d got %d", stateVersion(), version)
+	}
+}
+
+func TestLoadVersion1(t *testing.T) {
+	path, cleanup := copyFixture(t, "state-v1.json")
+	defer cleanup()
+
+	s := new(State)
+	if err := s.Load(path); err != nil {
+		t.Fatal(err)
+	}
+
+	if s.Display.PowerStatus != "off" {
+		t.Errorf("expected powerStatus 'off' got '%s'", s.Display.PowerStatus)
+	}
+	if len(s.Faces.Detections) != 1 {
+		t.Errorf("faces not loaded: %#v", s.Faces)
+	} else if d := s.Faces.Detections[0]; d.Image.Hash == "" {
+		t.Errorf("expected the image moved to the blob store, got %#v", d)
+	} else if _, err := os.Stat(filepath.Join(filepath.Dir(path), "blobs", d.Image.Hash)); err != nil {
+		t.Errorf("expected the inline image to be moved to the blob store: %v", err)
+	}
+	if len(s.Motion.Detections) != 1 || len(s.Faces.People) != 1 || len(s.Streams) != 1 {
+		t.Errorf("state not loaded: %#v", s)
+	}
+
+	if _, err := os.Stat(path + ".v1"); err != nil {
+		t.Errorf("expected a backup of the version 1 file: %v", err)
+	}
+}
+
+func TestMoveImagesToBlobs(t *testing.T) {
+	path, cleanup := copyFixture(t, "state-v1.json")
+	defer cleanup()
+
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	migrated, version, err := migrateState(b)
+	if err != nil {
+		t.Fatal(err)
+	} else if version != 1 {
+		t.Errorf("expected version 1, got %d", version)
+	}
+
+	// the document itself refers to the stored image
+	doc, err := decodeDocument(migrated)
+	if err != nil {
+		t.Fatal(err)
+	}
+	refs := documentBlobRefs(doc)
+	if len(refs) != 1 || bytes.Contains(migrated, []byte("base64,")) {
+		t.Fatalf("expected the image replaced with a blob reference, got:\n%s", migrated)
+	}
+	if contentType, data, err := blobStore.Read(refs[0]); err != nil {
+		t.Fatal(err)
+	} else if contentType != "image/png" || !bytes.HasPrefix(data, []byte("\x89PNG")) {
+		t.Errorf("expected the png in the blob store, got %s %q", contentType, data)
+	}
+
+	// without a blob store there is nowhere to move it
+	blobStore = nil
+	if _, _, err := migrateState(b); err == nil {
+		t.Errorf("expected an error migrating images without a blob store")
+	}
+}
+
+func TestMigrateCurrentVersion(t *testing.T) {
+	path, cleanup := copyFixture(t, "state-v1.json")
+	defer cleanup()
+
+	s := new(State)
+	if err := s.Load(path); err != nil {
+		t.Fatal(err)
+	} else if err := s.Save(path); err != nil {
+		t.Fatal(err)
+	}
+	saved, _ := ioutil.ReadFile(path)
+
+	// a current document is returned as it is
+	if migrated, version, err := migrateState(saved); err != nil {
+		t.Fatal(err)
+	} else if version != stateVersion() || !bytes.Equal(migrated, saved) {
+		t.Errorf("expected version %d unchanged, got version %d:\n%s", stateVersion(), version, migrated)
+	}
+
+	// and loading and saving it again changes nothing, nor backs it up
+	os.Remove(path + ".v1")
+	reloaded := new(State)
+	if err := reloaded.Load(path); err != nil {
+		t.Fatal(err)
+	} else if err := reloaded.Save(path); err != nil {
+		t.Fatal(err)
+	}
+	if b, _ := ioutil.ReadFile(path); !bytes.Equal(b, saved) {
+		t.Errorf("expected the same document after reloading, got:\n%s", b)
+	}
+	if matches, _ := filepath.Glob(path + ".v*"); len(matches) != 0 {
+		t.Errorf("expected no backups of a current document, got %v", matches)
+	}
+}
+
+func TestMigrationsRunInOrder(t *testing.T) {
+	saved := stateMigrations
+	defer func() { stateMigrations = saved }()
+
+	stateMigrations = append(stateMigrations[:len(saved):len(saved)],
+		stateMigration{
+			description: "rename display.powerStatus to display.power",
+			migrate: func(doc map[string]interface{}) error {
+				display := doc["display"].(map[string]interface{})
+				display["power"] = display["powerStatus"]
+				delete(display, "powerStatus")
+				return nil
+			},
+		},
+		stateMigration{
+			description: "rename display.power back",
+			migrate: func(doc map[string]interface{}) error {
+				display := doc["display"].(map[string]interface{})
+				display["powerStatus"] = display["power"]
+				delete(display, "power")
+				return nil
+			},
+		},
+	)
+
+	path, cleanup := copyFixture(t, "state-v0.json")
+	defer cleanup()
+
+	s := new(State)
+	if err := s.Load(path); err != nil {
+		t.Fatal(err)
+	} else if s.Display.PowerStatus != "on" {
+		t.Errorf("migrations did not run in order, powerStatus is '%s'", s.Display.PowerStatus)
+	}
+
+	if _, _, err := migrateState([]byte(`{"version": 5}`)); err == nil {
+		t.Errorf("expected an error loading a newer version")
+	}
+}
@@ -0,0 +1,203 @@
+package main
+
+import (
+	"log"
+	"sync"
+	"time"
+
+	"github.com/donniet/mirror.4/state"
+)
+
+// PersistStatus reports the outcome of the most recent saves
+type PersistStatus struct {
+	LastSaved     time.Time `json:"lastSaved"`
+	LastError     string    `json:"lastError,omitempty"`
+	LastErrorTime time.Time `json:"lastErrorTime,omitempty"`
+	Pending       int       `json:"pending"`
+}
+
+// Persister coalesces bursts of state changes and writes them to storage off
+// the broadcast path.  Changes are flushed once no new message has arrived for
+// delay, but never later than maxDelay after the first unsaved change.
+type Persister struct {
+	storage      Storage
+	server       *state.Server
+	local        *State
+	compactEvery int
+	delay        time.Duration
+	maxDelay     time.Duration
+	appended     int
+
+	changes chan StateMessage
+	done    chan struct{}
+	locker  sync.Locker
+	status  PersistStatus
+}
+
+// NewPersister starts a persister saving local to storage, taking a snapshot
+// after every compactEvery changes.  server guards access to local.
+func NewPersister(storage Storage, server *state.Server, local *State, compactEvery int, delay, maxDelay time.Duration) *Persister {
+	p := &Persister{
+		storage:      storage,
+		server:       server,
+		local:        local,
+		compactEvery: compactEvery,
+		delay:        delay,
+		maxDelay:     maxDelay,
+		changes:      make(chan StateMessage, 64),
+		done:         make(chan struct{}),
+		locker:       &sync.Mutex{},
+	}
+	go p.run()
+	return p
+}
+
+// Notify queues a message that has already been applied to the state
+func (p *Persister) Notify(msg StateMessage) {
+	p.changes <- msg
+}
+
+// Status returns the last save time and error
+func (p *Persister) Status() PersistStatus {
+	p.locker.Lock()
+	defer p.locker.Unlock()
+
+	return p.status
+}
+
+// Close flushes any pending changes, takes a snapshot and stops the persister
+func (p *Persister) Close() error {
+	close(p.changes)
+	<-p.done
+
+	if err := p.compact(); err != nil {
+		p.setError(err)
+		return err
+	}
+	p.setSaved()
+	return nil
+}
+
+func (p *Persister) run() {
+	defer close(p.done)
+
+	var pending []StateMessage
+	var first time.Time
+
+	timer := time.NewTimer(p.delay)
+	timer.Stop()
+
+	for {
+		select {
+		case msg, ok := <-p.changes:
+			if !ok {
+				timer.Stop()
+				p.flush(pending)
+				return
+			}
+			if len(pending) == 0 {
+				first = time.Now()
+			}
+			pending = append(pending, msg)
+			p.setPending(len(pending))
+
+			wait := p.delay
+			if deadline := time.Until(first.Add(p.maxDelay)); deadline < wait {
+				wait = deadline
+			}
+			resetTimer(timer, wait)
+		case <-timer.C:
+			var err error
+			if pending, err = p.flush(pending); err != nil {
+				// retry the failed save after the usual delay
+				first = time.Now()
+				timer.Reset(p.delay)
+			}
+		}
+	}
+}
+
+// flush writes pending to storage and returns whatever could not be saved
+func (p *Persister) flush(pending []StateMessage) ([]StateMessage, error) {
+	start := time.Now()
+	defer saveDuration.Since(start)
+
+	var err error
+	for len(pending) > 0 {
+		if err = p.storage.Append(pending[0]); err != nil {
+			break
+		}
+		pending = pending[1:]
+		p.appended++
+	}
+
+	if err == nil && p.appended < p.compactEvery {
+		err = p.server.DoLocked(func() error { return p.storage.Save(p.local, p.server.Revision()) })
+	}
+
+	if err != nil || p.appended >= p.compactEvery {
+		// the snapshot already contains every applied change, so it
+		// supersedes whatever did not make it into storage
+		if err != nil {
+			log.Printf("error saving changes, taking a snapshot instead: %v", err)
+		}
+		if err = p.compact(); err == nil {
+			pending = nil
+		}
+	}
+
+	if err != nil {
+		log.Printf("error saving state: %v", err)
+		saveFailures.Inc()
+		p.setError(err)
+	} else {
+		p.setSaved()
+	}
+	p.setPending(len(pending))
+	return pending, err
+}
+
+func (p *Persister) compact() error {
+	err := p.server.DoLocked(func() error {
+		return p.storage.Snapshot(p.local, p.server.Revision())
+	})
+	if err != nil {
+		return err
+	}
+	p.appended = 0
+	return nil
+}
+
+func (p *Persister) setSaved() {
+	p.locker.Lock()
+	defer p.locker.Unlock()
+
+	p.status.LastSaved = time.Now()
+	p.status.LastError = ""
+}
+
+func (p *Persister) setError(err error) {
+	p.locker.Lock()
+	defer p.locker.Unlock()
+
+	p.status.LastError = err.Error()
+	p.status.LastErrorTime = time.Now()
+}
+
+func (p *Persister) setPending(n int) {
+	p.locker.Lock()
+	defer p.locker.Unlock()
+
+	p.status.Pending = n
+}
+
+// resetTimer safely resets a timer that may have already fired
+func resetTimer(t *time.Timer, d time.Duration) {
+	if !t.Stop() {
+		select {
+		case <-t.C:
+		default:
+		}
+	}
+	t.Reset(d)
+}
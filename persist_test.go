@@ -0,0 +1,97 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/donniet/mirror.4/state"
+)
+
+// testStorage counts calls and fails snapshots while failing is set
+type testStorage struct {
+	locker    sync.Mutex
+	appended  int
+	saves     int
+	snapshots int
+	failing   bool
+}
+
+func (t *testStorage) Load(s *State) error { return nil }
+func (t *testStorage) Close() error        { return nil }
+
+func (t *testStorage) Append(msg StateMessage) error {
+	t.locker.Lock()
+	defer t.locker.Unlock()
+	t.appended++
+	return nil
+}
+
+func (t *testStorage) Save(s *State, revision uint64) error {
+	t.locker.Lock()
+	defer t.locker.Unlock()
+	t.saves++
+	return nil
+}
+
+func (t *testStorage) Snapshot(s *State, revision uint64) error {
+	t.locker.Lock()
+	defer t.locker.Unlock()
+	if t.failing {
+		return errors.New("disk full")
+	}
+	t.snapshots++
+	return nil
+}
+
+func (t *testStorage) counts() (int, int, int) {
+	t.locker.Lock()
+	defer t.locker.Unlock()
+	return t.appended, t.saves, t.snapshots
+}
+
+func TestPersisterCoalesces(t *testing.T) {
+	storage := &testStorage{failing: true}
+	local := new(State)
+
+	p := NewPersister(storage, state.NewServer(local), local, 3, 20*time.Millisecond, 200*time.Millisecond)
+
+	msg := StateMessage{Method: http.MethodPost, Path: "display/powerStatus", Body: rawMessage(`"on"`)}
+	p.Notify(msg)
+	p.Notify(msg)
+
+	time.Sleep(100 * time.Millisecond)
+
+	if s := p.Status(); s.LastSaved.IsZero() || s.Pending != 0 {
+		t.Errorf("expected a completed save, got %#v", s)
+	} else if appended, saves, _ := storage.counts(); appended != 2 || saves != 1 {
+		t.Errorf("expected 2 appends in 1 save, got %d in %d", appended, saves)
+	}
+
+	// reaching compactEvery takes a snapshot, which fails and is retried
+	p.Notify(msg)
+	time.Sleep(100 * time.Millisecond)
+
+	if s := p.Status(); s.LastError == "" {
+		t.Errorf("expected failed snapshot to be reported")
+	}
+
+	storage.locker.Lock()
+	storage.failing = false
+	storage.locker.Unlock()
+	time.Sleep(100 * time.Millisecond)
+
+	if s := p.Status(); s.LastError != "" {
+		t.Errorf("expected retried snapshot to succeed, got %s", s.LastError)
+	} else if _, _, snapshots := storage.counts(); snapshots != 1 {
+		t.Errorf("expected 1 snapshot got %d", snapshots)
+	}
+
+	if err := p.Close(); err != nil {
+		t.Error(err)
+	} else if _, _, snapshots := storage.counts(); snapshots != 2 {
+		t.Errorf("expected a snapshot on close")
+	}
+}
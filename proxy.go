@@ -0,0 +1,92 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+)
+
+// Proxy describes how the mirror is reached: under BasePath, and if Trusted,
+// through a reverse proxy whose X-Forwarded-Host, X-Forwarded-Proto and
+// X-Forwarded-For headers say what the client actually asked for
+type Proxy struct {
+	BasePath string
+	Trusted  bool
+}
+
+// ParseBasePath cleans up a path prefix to mount the mirror under, like
+// "/mirror".  The root is "".
+func ParseBasePath(s string) (string, error) {
+	s = strings.Trim(s, "/")
+	if s == "" {
+		return "", nil
+	}
+	for _, segment := range strings.Split(s, "/") {
+		if segment == "" || segment == "." || segment == ".." {
+			return "", fmt.Errorf("invalid base path '/%s'", s)
+		}
+	}
+	return "/" + s, nil
+}
+
+// lastForwarded returns the entry the nearest proxy added to a forwarding
+// header, since earlier ones come from whoever sent the request
+func lastForwarded(r *http.Request, header string) string {
+	values := r.Header.Values(header)
+	if len(values) == 0 {
+		return ""
+	}
+	entries := strings.Split(values[len(values)-1], ",")
+	return strings.TrimSpace(entries[len(entries)-1])
+}
+
+// Handler serves next under BasePath.  Requests from a trusted proxy are
+// rewritten to the host, scheme and client address forwarded, so origin
+// checks, logs and links see what the client did.
+func (p Proxy) Handler(next http.Handler) http.Handler {
+	handler := next
+	if p.BasePath != "" {
+		mux := http.NewServeMux()
+		mux.Handle(p.BasePath+"/", http.StripPrefix(p.BasePath, next))
+		mux.Handle(p.BasePath, http.RedirectHandler(p.BasePath+"/", http.StatusMovedPermanently))
+		handler = mux
+	}
+	if !p.Trusted {
+		return handler
+	}
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		r = r.Clone(r.Context())
+		if host := lastForwarded(r, "X-Forwarded-Host"); host != "" {
+			r.Host = host
+		}
+		if proto := strings.ToLower(lastForwarded(r, "X-Forwarded-Proto")); proto == "http" || proto == "https" {
+			r.URL.Scheme = proto
+		}
+		if ip := net.ParseIP(lastForwarded(r, "X-Forwarded-For")); ip != nil {
+			r.RemoteAddr = net.JoinHostPort(ip.String(), "0")
+		}
+		handler.ServeHTTP(w, r)
+	})
+}
+
+// requestScheme is the scheme the client used: the one a trusted proxy
+// forwarded, or whether the connection is TLS
+func requestScheme(r *http.Request) string {
+	if r.URL.Scheme != "" {
+		return r.URL.Scheme
+	} else if r.TLS != nil {
+		return "https"
+	}
+	return "http"
+}
+
+// WebsocketURL is the address of the websocket for the page r asked for
+func (p Proxy) WebsocketURL(r *http.Request) string {
+	scheme := "ws"
+	if requestScheme(r) == "https" {
+		scheme = "wss"
+	}
+	return fmt.Sprintf("%s://%s%s/websocket", scheme, r.Host, p.BasePath)
+}
@@ -0,0 +1,63 @@
+package main
+
+import (
+	"crypto/tls"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestProxy(t *testing.T) {
+	if _, err := ParseBasePath("/mirror/../admin"); err == nil {
+		t.Errorf("expected a base path with .. to be refused")
+	}
+	if p, _ := ParseBasePath("mirror/"); p != "/mirror" {
+		t.Errorf("expected /mirror, got '%s'", p)
+	}
+
+	tests := []struct {
+		proxy   Proxy
+		target  string
+		headers map[string]string
+		tls     bool
+		url     string
+		remote  string
+	}{
+		{Proxy{}, "http://0.0.0.0:8081/", nil, false, "ws://0.0.0.0:8081/websocket", "192.0.2.1:1234"},
+		{Proxy{}, "https://mirror.local/", nil, true, "wss://mirror.local/websocket", "192.0.2.1:1234"},
+		// forwarding headers are only believed from a trusted proxy
+		{Proxy{BasePath: "/mirror"}, "http://127.0.0.1:8081/mirror/",
+			map[string]string{"X-Forwarded-Host": "home.example", "X-Forwarded-Proto": "https"}, false,
+			"ws://127.0.0.1:8081/mirror/websocket", "192.0.2.1:1234"},
+		{Proxy{BasePath: "/mirror", Trusted: true}, "http://127.0.0.1:8081/mirror/",
+			map[string]string{"X-Forwarded-Host": "home.example", "X-Forwarded-Proto": "https", "X-Forwarded-For": "203.0.113.9, 10.0.0.5"}, false,
+			"wss://home.example/mirror/websocket", "10.0.0.5:0"},
+	}
+	for _, test := range tests {
+		var url, remote, path string
+		handler := test.proxy.Handler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			url, remote, path = test.proxy.WebsocketURL(r), r.RemoteAddr, r.URL.Path
+		}))
+
+		r := httptest.NewRequest(http.MethodGet, test.target, nil)
+		r.RemoteAddr = "192.0.2.1:1234"
+		if test.tls {
+			r.TLS = &tls.ConnectionState{}
+		}
+		for k, v := range test.headers {
+			r.Header.Set(k, v)
+		}
+		handler.ServeHTTP(httptest.NewRecorder(), r)
+
+		if url != test.url || remote != test.remote || path != "/" {
+			t.Errorf("%s: expected %s from %s for /, got %s from %s for %s", test.target, test.url, test.remote, url, remote, path)
+		}
+	}
+
+	// the base path without its slash redirects to the page
+	w := httptest.NewRecorder()
+	Proxy{BasePath: "/mirror"}.Handler(http.NotFoundHandler()).ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/mirror", nil))
+	if w.Code != http.StatusMovedPermanently || w.Header().Get("Location") != "/mirror/" {
+		t.Errorf("expected a redirect to /mirror/, got %d %s", w.Code, w.Header().Get("Location"))
+	}
+}
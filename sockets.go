@@ -5,48 +5,283 @@ import (
 	"encoding/json"
 	"io"
 	"log"
+	"net"
 	"net/http"
+	"strconv"
+	"strings"
 	"sync"
+	"time"
 
+	"github.com/donniet/mirror.4/state"
 	"github.com/gorilla/websocket"
 )
 
 type StateMessage struct {
+	Type   string           `json:"type,omitempty"`
+	ID     string           `json:"id,omitempty"`
+	Seq    uint64           `json:"seq,omitempty"`
 	Method string           `json:"method"`
 	Path   string           `json:"path"`
 	Body   *json.RawMessage `json:"body"`
+	// Change is the state server's revision after the change, so a snapshot
+	// can tell whether it includes it
+	Change uint64 `json:"change,omitempty"`
 }
 
+// types of the messages written to a websocket
+const (
+	// MessageBroadcast is a change to the state, whoever made it
+	MessageBroadcast = "broadcast"
+	// MessageReply answers the request with the same id
+	MessageReply = "reply"
+)
+
+// SocketReply is the response to a request made over a websocket
+type SocketReply struct {
+	Type    string           `json:"type"`
+	ID      string           `json:"id,omitempty"`
+	Status  int              `json:"status"`
+	Headers http.Header      `json:"headers,omitempty"`
+	Body    *json.RawMessage `json:"body,omitempty"`
+}
+
+// socketResponse collects what a handler writes so it can be sent as a reply
+type socketResponse struct {
+	header http.Header
+	status int
+	body   bytes.Buffer
+}
+
+func newSocketResponse() *socketResponse {
+	return &socketResponse{header: make(http.Header)}
+}
+
+func (w *socketResponse) Header() http.Header {
+	return w.header
+}
+func (w *socketResponse) WriteHeader(statusCode int) {
+	if w.status == 0 {
+		w.status = statusCode
+	}
+}
+func (w *socketResponse) Write(b []byte) (int, error) {
+	w.WriteHeader(http.StatusOK)
+	return w.body.Write(b)
+}
+
+// reply builds the reply to the request id, quoting a body that isn't JSON
+func (w *socketResponse) reply(id string) SocketReply {
+	ret := SocketReply{
+		Type:    MessageReply,
+		ID:      id,
+		Status:  w.status,
+		Headers: w.header,
+	}
+	if ret.Status == 0 {
+		ret.Status = http.StatusOK
+	}
+
+	if b := bytes.TrimSpace(w.body.Bytes()); len(b) == 0 {
+		// no body
+	} else if json.Valid(b) {
+		ret.Body = (*json.RawMessage)(&b)
+	} else {
+		quoted, _ := json.Marshal(string(b))
+		ret.Body = (*json.RawMessage)(&quoted)
+	}
+	return ret
+}
+
+// methods a websocket client sends to choose which broadcasts it receives
+const (
+	MethodSubscribe   = "subscribe"
+	MethodUnsubscribe = "unsubscribe"
+)
+
 type SocketConn struct {
 	conn     *websocket.Conn
-	messages chan *json.RawMessage
+	queue    *socketQueue
+	subs     *subscriptions
+	counters *socketCounters
+	info     *connInfo
+}
+
+// subscriptions holds the path patterns a connection wants broadcasts for.
+// Until the first subscribe it receives everything.
+type subscriptions struct {
+	locker   sync.Locker
+	patterns map[string][]string
+}
+
+func newSubscriptions() *subscriptions {
+	return &subscriptions{locker: &sync.Mutex{}}
+}
+
+// splitPath returns the segments of a '/' separated path, ignoring empty ones
+func splitPath(path string) []string {
+	ret := []string{}
+	for _, s := range strings.Split(path, "/") {
+		if s != "" {
+			ret = append(ret, s)
+		}
+	}
+	return ret
+}
+
+func (s *subscriptions) subscribe(pattern string) {
+	s.locker.Lock()
+	defer s.locker.Unlock()
+
+	if s.patterns == nil {
+		s.patterns = make(map[string][]string)
+	}
+	segments := splitPath(pattern)
+	s.patterns[strings.Join(segments, "/")] = segments
 }
 
-func (w SocketConn) Header() http.Header {
-	return http.Header(make(map[string][]string))
+func (s *subscriptions) unsubscribe(pattern string) {
+	s.locker.Lock()
+	defer s.locker.Unlock()
+
+	if s.patterns == nil {
+		// stop receiving everything, keeping nothing but what is subscribed later
+		s.patterns = make(map[string][]string)
+	}
+	delete(s.patterns, strings.Join(splitPath(pattern), "/"))
 }
-func (w SocketConn) WriteHeader(statusCode int) {}
-func (w SocketConn) Write(b []byte) (int, error) {
-	w.messages <- (*json.RawMessage)(&b)
-	return len(b), nil
+
+// matches reports whether a change at path is of interest: it is at or below a
+// subscribed pattern, or above one so that it replaces what was subscribed to.
+// A "*" segment in a pattern matches any one segment.
+func (s *subscriptions) matches(path string) bool {
+	s.locker.Lock()
+	defer s.locker.Unlock()
+
+	if s.patterns == nil {
+		return true
+	}
+
+	segments := splitPath(path)
+	for _, pattern := range s.patterns {
+		if matchSegments(pattern, segments) {
+			return true
+		}
+	}
+	return false
+}
+
+func matchSegments(pattern []string, segments []string) bool {
+	for i := 0; i < len(pattern) && i < len(segments); i++ {
+		if pattern[i] != "*" && pattern[i] != segments[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// wants reports whether a change at path should be broadcast to the client:
+// it must be subscribed to the path and allowed to read it
+func (c SocketConn) wants(path string) bool {
+	return c.subs.matches(path) && c.info.identity.Allowed(http.MethodGet, path)
 }
 
-func (c SocketConn) writer() {
+// send queues a reply to the client
+func (c SocketConn) send(obj interface{}) {
+	b, err := json.Marshal(obj)
+	if err != nil {
+		log.Printf("error marshalling socket message: %v", err)
+		return
+	}
+	c.enqueue(queuedMessage{data: (*json.RawMessage)(&b)})
+}
+
+// enqueue queues m without blocking and counts what the overflow policy did
+func (c SocketConn) enqueue(m queuedMessage) {
+	dropped, coalesced, ok := c.queue.push(m)
+	if dropped == 0 && coalesced == 0 && ok {
+		return
+	}
+
+	c.counters.add(func(s *SocketStats) {
+		s.Dropped += uint64(dropped)
+		s.Coalesced += uint64(coalesced)
+		if !ok {
+			s.Disconnected++
+		}
+	})
+	if !ok {
+		log.Printf("disconnecting slow websocket client %s", c.info.remoteAddr)
+		c.disconnect(websocket.CloseTryAgainLater, "client too slow")
+	}
+}
+
+// disconnect closes the connection once the writer has sent a close frame
+// with code and reason
+func (c SocketConn) disconnect(code int, reason string) {
+	c.info.setClose(code, reason)
+	c.queue.close()
+}
+
+// writer sends queued messages and a ping every ping interval, giving up on
+// any write that takes longer than writeTimeout
+func (c SocketConn) writer(ping time.Duration, writeTimeout time.Duration) {
+	// closing the connection ends the reader too, which removes it from the hub
+	defer c.conn.Close()
+
+	var tick <-chan time.Time
+	if ping > 0 {
+		ticker := time.NewTicker(ping)
+		defer ticker.Stop()
+		tick = ticker.C
+	}
+
 	for {
-		if msg, ok := <-c.messages; !ok {
-			break
-		} else if msg == nil {
-			// this shouldn't ever happen
-			log.Fatal("nil message passed to websocket")
-		} else if err := c.conn.WriteMessage(websocket.TextMessage, *msg); err != nil {
-			log.Printf("error writing to socket: %v", err)
+		select {
+		case <-c.queue.ready:
+		case <-tick:
+			if err := c.conn.WriteControl(websocket.PingMessage, nil, deadline(writeTimeout)); err != nil {
+				log.Printf("error pinging socket: %v", err)
+				return
+			}
+			continue
+		}
+
+		for {
+			msg, ok := c.queue.take()
+			if !ok {
+				break
+			} else if msg.data == nil {
+				// this shouldn't ever happen
+				log.Fatal("nil message passed to websocket")
+			}
+
+			c.conn.SetWriteDeadline(deadline(writeTimeout))
+			if err := c.conn.WriteMessage(websocket.TextMessage, *msg.data); err != nil {
+				log.Printf("error writing to socket: %v", err)
+				return
+			}
+			c.counters.add(func(s *SocketStats) { s.Sent++ })
+		}
+
+		if c.queue.done() {
 			break
 		}
 	}
 
+	code, reason := c.info.closeReason()
+	c.conn.WriteControl(websocket.CloseMessage, websocket.FormatCloseMessage(code, reason), deadline(writeTimeout))
+
 	log.Printf("writer ending")
 }
 
+// deadline returns the time d from now, or no deadline if d isn't positive
+func deadline(d time.Duration) time.Time {
+	if d <= 0 {
+		return time.Time{}
+	}
+	return time.Now().Add(d)
+}
+
 type ErrorMessage struct {
 	Error string `json:"error"`
 }
@@ -55,15 +290,45 @@ func MessageFromError(err error) ErrorMessage {
 	return ErrorMessage{Error: err.Error()}
 }
 
+// SocketConfig sets the limits of a websocket hub
+type SocketConfig struct {
+	// QueueSize is the number of messages queued for each connection before
+	// Overflow applies
+	QueueSize int
+	Overflow  OverflowPolicy
+	// HistorySize is the number of broadcasts kept for clients that resume
+	HistorySize int
+	// PingInterval is how often connections are pinged, 0 to never
+	PingInterval time.Duration
+	// IdleTimeout disconnects a client not heard from, not even a pong, for
+	// that long, 0 to wait forever
+	IdleTimeout time.Duration
+	// WriteTimeout disconnects a client that takes longer to accept a message
+	WriteTimeout time.Duration
+	// MaxConnections refuses connections beyond this many, 0 for no limit
+	MaxConnections int
+	// Origins are the origins whose pages may connect
+	Origins OriginPolicy
+}
+
 type Sockets struct {
 	locker      sync.Locker
 	upgrader    websocket.Upgrader
 	server      http.Handler
 	stopper     <-chan struct{}
-	connections map[*websocket.Conn]SocketConn
+	connections map[*connInfo]SocketConn
+	config      SocketConfig
+	counters    *socketCounters
+	history     *socketHistory
+	changed     chan struct{}
+	// readers counts the websocket readers still running, which can send
+	// changes, and closed stops new ones starting
+	readers *sync.WaitGroup
+	closed  bool
 }
 
-func NewSockets(state http.Handler, stopper <-chan struct{}) *Sockets {
+// NewSockets creates a websocket hub serving requests with state
+func NewSockets(state http.Handler, stopper <-chan struct{}, config SocketConfig) *Sockets {
 	ret := &Sockets{
 		locker:  &sync.Mutex{},
 		server:  state,
@@ -72,8 +337,51 @@ func NewSockets(state http.Handler, stopper <-chan struct{}) *Sockets {
 			ReadBufferSize:  1024,
 			WriteBufferSize: 1024,
 		},
-		connections: make(map[*websocket.Conn]SocketConn),
+		connections: make(map[*connInfo]SocketConn),
+		config:      config,
+		counters:    &socketCounters{locker: &sync.Mutex{}},
+		history:     newSocketHistory(config.HistorySize),
+		changed:     make(chan struct{}),
+		readers:     &sync.WaitGroup{},
 	}
+	ret.upgrader.CheckOrigin = ret.checkOrigin
+	return ret
+}
+
+func (socks *Sockets) checkOrigin(r *http.Request) bool {
+	socks.locker.Lock()
+	origins := socks.config.Origins
+	socks.locker.Unlock()
+
+	if origins.Allowed(r) {
+		return true
+	}
+	log.Printf("refusing websocket client %s from origin %s", r.RemoteAddr, r.Header.Get("Origin"))
+	return false
+}
+
+// SetOrigins changes the origins whose pages may connect, for clients
+// connecting from now on
+func (socks *Sockets) SetOrigins(origins OriginPolicy) {
+	socks.locker.Lock()
+	defer socks.locker.Unlock()
+	socks.config.Origins = origins
+}
+
+// Status returns the number of connections and messages sent and lost
+func (socks *Sockets) Status() SocketStats {
+	socks.locker.Lock()
+	connections, queued := len(socks.connections), 0
+	for _, c := range socks.connections {
+		queued += c.queue.Len()
+	}
+	socks.locker.Unlock()
+
+	socks.counters.locker.Lock()
+	defer socks.counters.locker.Unlock()
+
+	ret := socks.counters.stats
+	ret.Connections, ret.Queued = connections, queued
 	return ret
 }
 
@@ -81,6 +389,22 @@ func (socks *Sockets) Write(obj interface{}) error {
 	var b []byte
 	var err error
 
+	socks.locker.Lock()
+	defer socks.locker.Unlock()
+
+	// changes are numbered, kept for resuming and only go to the connections
+	// subscribed to their path
+	path, method, seq, routed := "", "", uint64(0), false
+	switch m := obj.(type) {
+	case StateMessage:
+		m.Type, m.Seq, m.Change = MessageBroadcast, socks.history.next(), 0
+		obj, path, method, seq, routed = m, m.Path, m.Method, m.Seq, true
+	case *StateMessage:
+		broadcast := *m
+		broadcast.Type, broadcast.Seq, broadcast.Change = MessageBroadcast, socks.history.next(), 0
+		obj, path, method, seq, routed = broadcast, m.Path, m.Method, broadcast.Seq, true
+	}
+
 	if b, err = json.Marshal(obj); err != nil {
 		return err
 	}
@@ -89,11 +413,25 @@ func (socks *Sockets) Write(obj interface{}) error {
 		return nil
 	}
 
-	socks.locker.Lock()
-	defer socks.locker.Unlock()
+	msg := queuedMessage{
+		broadcast: true,
+		method:    method,
+		path:      splitPath(path),
+		seq:       seq,
+		data:      (*json.RawMessage)(&b),
+	}
+	if routed {
+		socks.history.add(msg)
 
+		// wake anyone long-polling for a change
+		close(socks.changed)
+		socks.changed = make(chan struct{})
+	}
 	for _, c := range socks.connections {
-		c.messages <- (*json.RawMessage)(&b)
+		if routed && !c.wants(path) {
+			continue
+		}
+		c.enqueue(msg)
 	}
 	return nil
 }
@@ -101,18 +439,58 @@ func (socks *Sockets) Write(obj interface{}) error {
 func (socks *Sockets) reader(c SocketConn, stopper chan struct{}) {
 	defer func() {
 		close(stopper)
+		socks.readers.Done()
 	}()
 
-	msg := StateMessage{}
+	idle := socks.config.IdleTimeout
+	c.conn.SetReadDeadline(deadline(idle))
+	c.conn.SetPongHandler(func(string) error {
+		c.info.touch()
+		return c.conn.SetReadDeadline(deadline(idle))
+	})
 
 	for {
-		if _, b, err := c.conn.ReadMessage(); err != nil {
+		msg := StateMessage{}
+		w := newSocketResponse()
+
+		_, b, err := c.conn.ReadMessage()
+		if ne, ok := err.(net.Error); ok && ne.Timeout() {
+			log.Printf("websocket client %s idle for %v", c.info.remoteAddr, idle)
+			c.counters.add(func(s *SocketStats) { s.TimedOut++ })
+			c.disconnect(websocket.CloseGoingAway, "idle timeout")
+			break
+		} else if err != nil {
 			log.Printf("error from websocket: %v", err)
 			break
-		} else if err := json.Unmarshal(b, &msg); err != nil {
+		}
+
+		c.info.touch()
+		c.conn.SetReadDeadline(deadline(idle))
+
+		if err := json.Unmarshal(b, &msg); err != nil {
 			log.Printf("error unmarshalling message: %v", err)
-			buf, _ := json.Marshal(MessageFromError(err))
-			c.messages <- (*json.RawMessage)(&buf)
+			writeError(w, state.BadRequestError(err.Error()))
+			c.send(w.reply(""))
+			continue
+		}
+
+		switch msg.Method {
+		case MethodSubscribe:
+			c.subs.subscribe(msg.Path)
+			c.send(w.reply(msg.ID))
+			continue
+		case MethodUnsubscribe:
+			c.subs.unsubscribe(msg.Path)
+			c.send(w.reply(msg.ID))
+			continue
+		case MethodResume:
+			socks.resume(c, msg)
+			continue
+		}
+
+		if !safeMethod(msg.Method) && !c.info.verified {
+			writeError(w, state.ForbiddenError("missing or invalid CSRF token"))
+			c.send(w.reply(msg.ID))
 			continue
 		}
 
@@ -121,10 +499,21 @@ func (socks *Sockets) reader(c SocketConn, stopper chan struct{}) {
 			reader = bytes.NewReader(*msg.Body)
 		}
 		if r, err := http.NewRequest(msg.Method, msg.Path, reader); err != nil {
-			log.Fatalf("error constructing request: %v", err)
+			writeError(w, state.BadRequestError(err.Error()))
+		} else if r.URL.Query().Get("watch") != "" {
+			// waiting here would hold up reading the connection, and its
+			// changes are broadcast anyway
+			writeError(w, state.BadRequestError("watch is not supported over a websocket, changes are broadcast"))
 		} else {
-			socks.server.ServeHTTP(c, r)
+			// the state server checks what the connection is allowed to do
+			socks.server.ServeHTTP(w, r.WithContext(withIdentity(r.Context(), c.info.identity)))
 		}
+		status := w.status
+		if status == 0 {
+			status = http.StatusOK
+		}
+		socketRequests.Inc(metricsMethod(msg.Method), strconv.Itoa(status))
+		c.send(w.reply(msg.ID))
 	}
 
 	log.Printf("closing reader")
@@ -142,31 +531,54 @@ func (socks *Sockets) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 
 	c := SocketConn{
 		conn:     conn,
-		messages: make(chan *json.RawMessage),
+		queue:    newSocketQueue(socks.config.QueueSize, socks.config.Overflow),
+		subs:     newSubscriptions(),
+		counters: socks.counters,
+		info:     newConnInfo(r, "websocket"),
 	}
 
 	socks.locker.Lock()
-	socks.connections[conn] = c
+	if socks.closed {
+		socks.locker.Unlock()
+		conn.WriteControl(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseGoingAway, "server shutting down"), deadline(socks.config.WriteTimeout))
+		conn.Close()
+		return
+	}
+	if max := socks.config.MaxConnections; max > 0 && len(socks.connections) >= max {
+		socks.locker.Unlock()
+
+		log.Printf("refusing websocket client %s, already at %d connections", c.info.remoteAddr, max)
+		c.counters.add(func(s *SocketStats) { s.Refused++ })
+		conn.WriteControl(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseTryAgainLater, "too many connections"), deadline(socks.config.WriteTimeout))
+		conn.Close()
+		return
+	}
+	socks.connections[c.info] = c
+	socks.readers.Add(1)
 	socks.locker.Unlock()
 
-	go c.writer()
+	go c.writer(socks.config.PingInterval, socks.config.WriteTimeout)
 	go socks.reader(c, stopper)
 	go func() {
 		<-stopper
-		close(c.messages)
+		c.queue.close()
 
 		socks.locker.Lock()
 		defer socks.locker.Unlock()
 
-		delete(socks.connections, conn)
+		delete(socks.connections, c.info)
 	}()
 }
 
+// Close tells every client the server is going away and disconnects it,
+// returning once no websocket reader can send another change
 func (socks *Sockets) Close() {
 	socks.locker.Lock()
-	defer socks.locker.Unlock()
-
+	socks.closed = true
 	for _, sc := range socks.connections {
-		sc.conn.Close()
+		sc.disconnect(websocket.CloseGoingAway, "server shutting down")
 	}
+	socks.locker.Unlock()
+
+	socks.readers.Wait()
 }
@@ -0,0 +1,112 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// connInfo describes a client for the connections listing
+type connInfo struct {
+	locker   sync.Locker
+	kind     string
+	identity *Identity
+	// verified is whether the client isn't a page on another site, or proved
+	// it's one of ours, and so may change the state
+	verified     bool
+	remoteAddr   string
+	userAgent    string
+	connected    time.Time
+	lastActivity time.Time
+	closeCode    int
+	closeText    string
+}
+
+func newConnInfo(r *http.Request, kind string) *connInfo {
+	now := time.Now()
+	return &connInfo{
+		locker:       &sync.Mutex{},
+		kind:         kind,
+		identity:     identityFrom(r.Context()),
+		verified:     csrfVerified(r),
+		remoteAddr:   r.RemoteAddr,
+		userAgent:    r.UserAgent(),
+		connected:    now,
+		lastActivity: now,
+	}
+}
+
+// touch records that the client was heard from
+func (i *connInfo) touch() {
+	i.locker.Lock()
+	defer i.locker.Unlock()
+	i.lastActivity = time.Now()
+}
+
+// setClose sets the close frame sent when the connection ends, unless one was
+// already set
+func (i *connInfo) setClose(code int, text string) {
+	i.locker.Lock()
+	defer i.locker.Unlock()
+	if i.closeCode == 0 {
+		i.closeCode, i.closeText = code, text
+	}
+}
+
+func (i *connInfo) closeReason() (int, string) {
+	i.locker.Lock()
+	defer i.locker.Unlock()
+	if i.closeCode == 0 {
+		return websocket.CloseNormalClosure, ""
+	}
+	return i.closeCode, i.closeText
+}
+
+// ConnectionInfo describes a live websocket or event stream client
+type ConnectionInfo struct {
+	Kind         string    `json:"kind"`
+	Name         string    `json:"name,omitempty"`
+	Role         Role      `json:"role,omitempty"`
+	RemoteAddr   string    `json:"remoteAddr"`
+	UserAgent    string    `json:"userAgent,omitempty"`
+	Connected    time.Time `json:"connected"`
+	Age          string    `json:"age"`
+	LastActivity time.Time `json:"lastActivity"`
+	Queued       int       `json:"queued"`
+}
+
+// Connections lists the live clients, oldest first
+func (socks *Sockets) Connections(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not supported", http.StatusMethodNotAllowed)
+		return
+	}
+
+	socks.locker.Lock()
+	ret := make([]ConnectionInfo, 0, len(socks.connections))
+	for _, c := range socks.connections {
+		c.info.locker.Lock()
+		ret = append(ret, ConnectionInfo{
+			Kind:         c.info.kind,
+			Name:         c.info.identity.name(),
+			Role:         c.info.identity.role(),
+			RemoteAddr:   c.info.remoteAddr,
+			UserAgent:    c.info.userAgent,
+			Connected:    c.info.connected,
+			Age:          time.Since(c.info.connected).Round(time.Second).String(),
+			LastActivity: c.info.lastActivity,
+		})
+		c.info.locker.Unlock()
+		ret[len(ret)-1].Queued = c.queue.Len()
+	}
+	socks.locker.Unlock()
+
+	sort.Slice(ret, func(i, j int) bool { return ret[i].Connected.Before(ret[j].Connected) })
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(ret)
+}
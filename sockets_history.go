@@ -0,0 +1,156 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/donniet/mirror.4/state"
+)
+
+// MethodResume asks for the broadcasts missed since a sequence number
+const MethodResume = "resume"
+
+// ResumeRequest is the body of a resume message.  Sequence numbers start over
+// when the server restarts, so they are only meaningful within an epoch.
+type ResumeRequest struct {
+	Epoch string `json:"epoch"`
+	Seq   uint64 `json:"seq"`
+}
+
+// ResumeReply is the body of the reply to a resume message.  If the missed
+// broadcasts could be replayed they are sent before the reply; otherwise the
+// reply carries the whole state.
+type ResumeReply struct {
+	Epoch    string           `json:"epoch"`
+	Seq      uint64           `json:"seq"`
+	Resumed  bool             `json:"resumed"`
+	Replayed int              `json:"replayed"`
+	State    *json.RawMessage `json:"state,omitempty"`
+}
+
+// socketHistory is a ring buffer of the most recent broadcasts
+type socketHistory struct {
+	epoch string
+	seq   uint64
+	ring  []queuedMessage
+}
+
+func newSocketHistory(size int) *socketHistory {
+	return &socketHistory{
+		epoch: strconv.FormatInt(time.Now().UnixNano(), 36),
+		ring:  make([]queuedMessage, size),
+	}
+}
+
+// next returns the sequence number for the next broadcast
+func (h *socketHistory) next() uint64 {
+	h.seq++
+	return h.seq
+}
+
+func (h *socketHistory) add(m queuedMessage) {
+	if len(h.ring) > 0 {
+		h.ring[m.seq%uint64(len(h.ring))] = m
+	}
+}
+
+// since returns the broadcasts after seq, or false if some have rolled out of
+// the buffer or seq is from another epoch
+func (h *socketHistory) since(epoch string, seq uint64) ([]queuedMessage, bool) {
+	size := uint64(len(h.ring))
+	if epoch != h.epoch || seq > h.seq || h.seq-seq > size {
+		return nil, false
+	}
+
+	ret := make([]queuedMessage, 0, h.seq-seq)
+	for s := seq + 1; s <= h.seq; s++ {
+		ret = append(ret, h.ring[s%size])
+	}
+	return ret, true
+}
+
+// resume queues the broadcasts c missed since the request, or the whole state
+// if they are no longer available or too many for its queue
+func (socks *Sockets) resume(c SocketConn, msg StateMessage) {
+	w := newSocketResponse()
+
+	// a resume may answer with the whole state
+	if id := c.info.identity; !id.Allowed(http.MethodGet, "") {
+		writeError(w, id.accessError())
+		c.send(w.reply(msg.ID))
+		return
+	}
+
+	req := ResumeRequest{}
+	if msg.Body != nil {
+		if err := json.Unmarshal(*msg.Body, &req); err != nil {
+			writeError(w, state.BadRequestError(err.Error()))
+			c.send(w.reply(msg.ID))
+			return
+		}
+	}
+
+	// nothing can be broadcast until the reply is queued, so the client
+	// continues from exactly where the reply says
+	socks.locker.Lock()
+	defer socks.locker.Unlock()
+
+	res := socks.catchUp(c, req.Epoch, req.Seq)
+	if !res.Resumed {
+		full := socks.fullState()
+		if full.status != http.StatusOK {
+			c.send(full.reply(msg.ID))
+			return
+		}
+		b := json.RawMessage(full.body.Bytes())
+		res.State = &b
+	}
+
+	b, _ := json.Marshal(res)
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(b)
+	c.send(w.reply(msg.ID))
+}
+
+// catchUp queues the broadcasts c missed since seq, if they are still
+// available and fit in its queue.  It must be called with the hub locked.
+func (socks *Sockets) catchUp(c SocketConn, epoch string, seq uint64) ResumeReply {
+	res := ResumeReply{
+		Epoch: socks.history.epoch,
+		Seq:   socks.history.seq,
+	}
+
+	missed, ok := socks.history.since(epoch, seq)
+	if !ok {
+		return res
+	}
+
+	replay := make([]queuedMessage, 0, len(missed))
+	for _, m := range missed {
+		if c.wants(strings.Join(m.path, "/")) {
+			replay = append(replay, m)
+		}
+	}
+	if len(replay) < socks.config.QueueSize {
+		for _, m := range replay {
+			c.enqueue(m)
+		}
+		res.Resumed, res.Replayed = true, len(replay)
+	}
+	return res
+}
+
+// fullState gets the whole state for a client that couldn't catch up.  It must
+// be called with the hub locked.
+func (socks *Sockets) fullState() *socketResponse {
+	w := newSocketResponse()
+	r, _ := http.NewRequest(http.MethodGet, "/", nil)
+	socks.server.ServeHTTP(w, r.WithContext(withRevision(r.Context(), socks.history.seq)))
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	return w
+}
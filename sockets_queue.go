@@ -0,0 +1,280 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync"
+)
+
+// OverflowPolicy decides what happens when a connection's queue is full
+type OverflowPolicy string
+
+const (
+	// OverflowDropOldest discards the oldest queued broadcast
+	OverflowDropOldest OverflowPolicy = "drop-oldest"
+	// OverflowCoalesce discards queued broadcasts that the new one replaces,
+	// then the oldest if that wasn't enough
+	OverflowCoalesce OverflowPolicy = "coalesce"
+	// OverflowDisconnect closes the connection, leaving the client to
+	// reconnect and load the state again
+	OverflowDisconnect OverflowPolicy = "disconnect"
+)
+
+// ParseOverflowPolicy validates an overflow policy name
+func ParseOverflowPolicy(s string) (OverflowPolicy, error) {
+	switch p := OverflowPolicy(s); p {
+	case OverflowDropOldest, OverflowCoalesce, OverflowDisconnect:
+		return p, nil
+	}
+	return "", fmt.Errorf("unknown overflow policy '%s'", s)
+}
+
+// SocketStats counts what was sent to websocket clients and what was lost
+// because they could not keep up
+type SocketStats struct {
+	Connections  int    `json:"connections"`
+	Queued       int    `json:"queued"`
+	Sent         uint64 `json:"sent"`
+	Dropped      uint64 `json:"dropped"`
+	Coalesced    uint64 `json:"coalesced"`
+	Disconnected uint64 `json:"disconnected"`
+	TimedOut     uint64 `json:"timedOut"`
+	Refused      uint64 `json:"refused"`
+}
+
+// socketCounters is shared by the hub and its connections
+type socketCounters struct {
+	locker sync.Locker
+	stats  SocketStats
+}
+
+func (c *socketCounters) add(f func(s *SocketStats)) {
+	c.locker.Lock()
+	defer c.locker.Unlock()
+	f(&c.stats)
+}
+
+// queuedMessage is a marshalled message waiting to be written.  Broadcasts
+// keep their method and path so they can be coalesced.
+type queuedMessage struct {
+	broadcast bool
+	// resync marks where broadcasts were dropped, telling the client to
+	// resume from the last change it applied
+	resync bool
+	method string
+	path   []string
+	seq    uint64
+	data   *json.RawMessage
+}
+
+// MessageResync is the type of the message sent in place of broadcasts a slow
+// client missed
+const MessageResync = "resync"
+
+var resyncData = json.RawMessage(`{"type":"` + MessageResync + `"}`)
+
+// socketQueue buffers messages for one connection so a slow client never
+// holds up the others
+type socketQueue struct {
+	locker sync.Locker
+	ready  chan struct{}
+	items  []queuedMessage
+	size   int
+	policy OverflowPolicy
+	closed bool
+	// gap is whether a resync marker is queued, which doesn't count towards
+	// size so it can't be dropped in turn
+	gap bool
+}
+
+func newSocketQueue(size int, policy OverflowPolicy) *socketQueue {
+	return &socketQueue{
+		locker: &sync.Mutex{},
+		ready:  make(chan struct{}, 1),
+		size:   size,
+		policy: policy,
+	}
+}
+
+// push queues m without blocking, making room as the policy says.  It returns
+// the number of messages dropped and coalesced, and false if the connection is
+// too far behind and must be disconnected; the queue is left for the caller
+// to close.
+func (q *socketQueue) push(m queuedMessage) (dropped int, coalesced int, ok bool) {
+	q.locker.Lock()
+	defer q.locker.Unlock()
+
+	if q.closed {
+		return 0, 0, true
+	}
+
+	if q.queued() >= q.size {
+		switch q.policy {
+		case OverflowDisconnect:
+			return 0, 0, false
+		case OverflowCoalesce:
+			coalesced = q.coalesce(m)
+		}
+		for q.queued() >= q.size {
+			q.dropOldest()
+			dropped++
+		}
+	}
+
+	q.items = append(q.items, m)
+	select {
+	case q.ready <- struct{}{}:
+	default:
+	}
+	return dropped, coalesced, true
+}
+
+// coalesce removes queued broadcasts that m makes obsolete: those at or below
+// the path it replaces or deletes
+func (q *socketQueue) coalesce(m queuedMessage) int {
+	if !m.broadcast || (m.method != http.MethodPost && m.method != http.MethodDelete) {
+		return 0
+	}
+
+	first := -1
+	kept := q.items[:0]
+	for i, item := range q.items {
+		if item.broadcast && hasPathPrefix(item.path, m.path) {
+			if first < 0 {
+				first = i
+			}
+			continue
+		}
+		kept = append(kept, item)
+	}
+	n := len(q.items) - len(kept)
+	q.items = kept
+	if n > 0 {
+		q.markGap(first)
+	}
+	return n
+}
+
+// dropOldest removes the oldest broadcast, or the oldest reply if there are
+// only replies queued
+func (q *socketQueue) dropOldest() {
+	for i, item := range q.items {
+		if item.broadcast {
+			q.items = append(q.items[:i], q.items[i+1:]...)
+			q.markGap(i)
+			return
+		}
+	}
+	for i, item := range q.items {
+		if !item.resync {
+			q.items = append(q.items[:i], q.items[i+1:]...)
+			return
+		}
+	}
+}
+
+// markGap queues a resync marker at i, where a broadcast was removed, unless
+// one is already queued before it.  The client stops at the first marker, so
+// there only needs to be one, at the earliest gap.
+func (q *socketQueue) markGap(i int) {
+	if q.gap {
+		for j, item := range q.items {
+			if item.resync {
+				if j <= i {
+					return
+				}
+				q.items = append(q.items[:j], q.items[j+1:]...)
+				break
+			}
+		}
+	}
+	if i > len(q.items) {
+		i = len(q.items)
+	}
+
+	q.items = append(q.items, queuedMessage{})
+	copy(q.items[i+1:], q.items[i:])
+	q.items[i] = queuedMessage{resync: true, data: &resyncData}
+	q.gap = true
+}
+
+// queued is the number of messages that count towards the size
+func (q *socketQueue) queued() int {
+	if q.gap {
+		return len(q.items) - 1
+	}
+	return len(q.items)
+}
+
+func hasPathPrefix(path []string, prefix []string) bool {
+	if len(path) < len(prefix) {
+		return false
+	}
+	for i := range prefix {
+		if path[i] != prefix[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// take removes the next message without waiting, returning false if there
+// isn't one.  ready is signalled whenever one is pushed or the queue closes.
+func (q *socketQueue) take() (queuedMessage, bool) {
+	q.locker.Lock()
+	defer q.locker.Unlock()
+
+	if len(q.items) == 0 {
+		return queuedMessage{}, false
+	}
+	m := q.items[0]
+	q.items[0] = queuedMessage{}
+	q.items = q.items[1:]
+	if m.resync {
+		q.gap = false
+	}
+	return m, true
+}
+
+// done reports whether the queue was closed
+func (q *socketQueue) done() bool {
+	q.locker.Lock()
+	defer q.locker.Unlock()
+	return q.closed
+}
+
+// pop waits for the next message, returning false once the queue is closed
+func (q *socketQueue) pop() (queuedMessage, bool) {
+	for {
+		if m, ok := q.take(); ok {
+			return m, true
+		} else if q.done() {
+			return queuedMessage{}, false
+		}
+		<-q.ready
+	}
+}
+
+// Len returns the number of queued messages
+func (q *socketQueue) Len() int {
+	q.locker.Lock()
+	defer q.locker.Unlock()
+	return len(q.items)
+}
+
+func (q *socketQueue) close() {
+	q.locker.Lock()
+	defer q.locker.Unlock()
+	q.closeLocked()
+}
+
+func (q *socketQueue) closeLocked() {
+	q.closed = true
+	q.items = nil
+	q.gap = false
+	select {
+	case q.ready <- struct{}{}:
+	default:
+	}
+}
@@ -0,0 +1,296 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/donniet/mirror.4/state"
+	"github.com/gorilla/websocket"
+)
+
+// testConn is a connection to socks that queues messages without sending them
+func testConn(socks *Sockets) SocketConn {
+	return SocketConn{
+		queue:    newSocketQueue(socks.config.QueueSize, socks.config.Overflow),
+		subs:     newSubscriptions(),
+		counters: socks.counters,
+		info:     newConnInfo(httptest.NewRequest(http.MethodGet, "/websocket", nil), "test"),
+	}
+}
+
+func TestSocketSubscriptions(t *testing.T) {
+	socks := NewSockets(http.NotFoundHandler(), nil, SocketConfig{QueueSize: 10, Overflow: OverflowDisconnect, HistorySize: 10})
+
+	everything := testConn(socks)
+	remote := testConn(socks)
+	remote.subs.subscribe("/display")
+	remote.subs.subscribe("streams/*/name")
+
+	socks.connections[everything.info] = everything
+	socks.connections[remote.info] = remote
+
+	for _, path := range []string{"faces/detections", "display/powerStatus", "/display", "streams/0/name", "streams/0/url", ""} {
+		socks.Write(StateMessage{Method: http.MethodPost, Path: path})
+	}
+
+	if everything.queue.Len() != 6 {
+		t.Errorf("expected every message by default, got %d", everything.queue.Len())
+	}
+
+	got := []string{}
+	for remote.queue.Len() > 0 {
+		m, _ := remote.queue.pop()
+		msg := StateMessage{}
+		json.Unmarshal(*m.data, &msg)
+		got = append(got, msg.Path)
+	}
+	expected := []string{"display/powerStatus", "/display", "streams/0/name", ""}
+	if len(got) != len(expected) {
+		t.Fatalf("expected %v, got %v", expected, got)
+	}
+	for i := range got {
+		if got[i] != expected[i] {
+			t.Errorf("expected %v, got %v", expected, got)
+		}
+	}
+
+	remote.subs.unsubscribe("display")
+	socks.Write(StateMessage{Method: http.MethodPost, Path: "display/powerStatus"})
+	if remote.queue.Len() != 0 {
+		t.Errorf("unsubscribed path still delivered")
+	}
+}
+
+func TestSocketReplies(t *testing.T) {
+	local := &State{Faces: faces{People: People{}}}
+	messages := make(chan StateMessage, 10)
+	stopper := make(chan struct{})
+	defer close(stopper)
+
+	socks := NewSockets(&StateServer{messages: messages, server: state.NewServer(local)}, stopper, SocketConfig{QueueSize: 10, Overflow: OverflowCoalesce, HistorySize: 10})
+	server := httptest.NewServer(socks)
+	defer server.Close()
+
+	// changes are only taken from pages with the session's CSRF token
+	url := "ws" + strings.TrimPrefix(server.URL, "http")
+	header := http.Header{"Cookie": {csrfCookie + "=secret"}}
+	conn, _, err := websocket.DefaultDialer.Dial(url+"?"+csrfParam+"=secret", header)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	requests := []struct {
+		request  string
+		status   int
+		location string
+	}{
+		{`{"id":"1","method":"POST","path":"display/powerStatus","body":"off"}`, http.StatusOK, "display/powerStatus"},
+		{`{"id":"2","method":"POST","path":"nothing/here","body":1}`, http.StatusNotFound, ""},
+		{`{"id":"3","method":"PUT","path":"faces/people/sam","body":{"distance":1}}`, http.StatusOK, "faces/people/sam"},
+		{`{"id":"4","method":"subscribe","path":"display"}`, http.StatusOK, ""},
+		{`{"id":"5","method":"GET","path":"display?watch=1"}`, http.StatusBadRequest, ""},
+	}
+	for i, r := range requests {
+		if err := conn.WriteMessage(websocket.TextMessage, []byte(r.request)); err != nil {
+			t.Fatal(err)
+		}
+
+		reply := SocketReply{}
+		if err := conn.ReadJSON(&reply); err != nil {
+			t.Fatal(err)
+		}
+		if reply.Type != MessageReply || reply.ID != fmt.Sprint(i+1) || reply.Status != r.status {
+			t.Errorf("unexpected reply to %s: %#v", r.request, reply)
+		}
+		if l := reply.Headers.Get("Location"); l != r.location {
+			t.Errorf("expected location '%s' replying to %s, got '%s'", r.location, r.request, l)
+		}
+	}
+
+	if local.Display.PowerStatus != "off" || len(messages) != 2 {
+		t.Errorf("expected two changes, got %d", len(messages))
+	}
+}
+
+func TestSocketQueueOverflow(t *testing.T) {
+	broadcast := func(method, path string) queuedMessage {
+		b := json.RawMessage(`{}`)
+		return queuedMessage{broadcast: true, method: method, path: splitPath(path), data: &b}
+	}
+
+	q := newSocketQueue(3, OverflowCoalesce)
+	q.push(broadcast(http.MethodPost, "display/powerStatus"))
+	q.push(broadcast(http.MethodPost, "forecast"))
+	q.push(broadcast(http.MethodPost, "display/brightness"))
+	if dropped, coalesced, ok := q.push(broadcast(http.MethodPost, "display")); !ok || dropped != 0 || coalesced != 2 {
+		t.Errorf("expected 2 coalesced, got %d dropped %d coalesced", dropped, coalesced)
+	}
+	q.push(broadcast(http.MethodPut, "faces/detections"))
+	if dropped, _, _ := q.push(broadcast(http.MethodPut, "faces/detections")); dropped != 1 || q.queued() != 3 {
+		t.Errorf("expected the oldest to be dropped, got %d dropped and %d queued", dropped, q.queued())
+	}
+	// the gap left by coalescing comes first, and the later drop shares it
+	if m, _ := q.pop(); !m.resync || string(*m.data) != `{"type":"resync"}` {
+		t.Errorf("expected a resync marker first, got %#v", m)
+	}
+	if m, _ := q.pop(); m.path[0] != "display" {
+		t.Errorf("expected forecast to be dropped, got %v first", m.path)
+	}
+
+	// dropping marks the gap where the dropped broadcast was, and the marker
+	// is never dropped itself
+	q = newSocketQueue(2, OverflowDropOldest)
+	q.push(queuedMessage{data: broadcast("", "").data})
+	q.push(broadcast(http.MethodPut, "faces/detections"))
+	q.push(broadcast(http.MethodPost, "display"))
+	q.push(queuedMessage{data: broadcast("", "").data})
+	q.push(queuedMessage{data: broadcast("", "").data})
+	kinds := []string{}
+	for q.Len() > 0 {
+		switch m, _ := q.pop(); {
+		case m.resync:
+			kinds = append(kinds, "resync")
+		case m.broadcast:
+			kinds = append(kinds, "broadcast")
+		default:
+			kinds = append(kinds, "reply")
+		}
+	}
+	if strings.Join(kinds, ",") != "resync,reply,reply" {
+		t.Errorf("unexpected queue after dropping %v", kinds)
+	}
+
+	q = newSocketQueue(1, OverflowDisconnect)
+	q.push(broadcast(http.MethodPost, "display"))
+	if _, _, ok := q.push(broadcast(http.MethodPost, "display")); ok {
+		t.Errorf("expected a full queue to disconnect")
+	}
+}
+
+func TestSocketResume(t *testing.T) {
+	// with the hub set, as in main, the full state is read with the hub locked
+	server := &StateServer{server: state.NewServer(new(State))}
+	socks := NewSockets(server, nil, SocketConfig{QueueSize: 10, Overflow: OverflowCoalesce, HistorySize: 3})
+	server.hub = socks
+	c := testConn(socks)
+
+	broadcast := func(n int) {
+		for i := 0; i < n; i++ {
+			socks.Write(StateMessage{Method: http.MethodPost, Path: "display/powerStatus"})
+		}
+	}
+	resume := func(epoch string, seq uint64) (ResumeReply, []uint64) {
+		body := json.RawMessage(fmt.Sprintf(`{"epoch":%q,"seq":%d}`, epoch, seq))
+		socks.resume(c, StateMessage{ID: "r", Method: MethodResume, Body: &body})
+
+		replayed := []uint64{}
+		for {
+			m, _ := c.queue.pop()
+			if m.broadcast {
+				replayed = append(replayed, m.seq)
+				continue
+			}
+			reply := SocketReply{}
+			json.Unmarshal(*m.data, &reply)
+			res := ResumeReply{}
+			json.Unmarshal(*reply.Body, &res)
+			return res, replayed
+		}
+	}
+
+	broadcast(2)
+	epoch := socks.history.epoch
+
+	if res, replayed := resume(epoch, 1); !res.Resumed || res.Seq != 2 || len(replayed) != 1 || replayed[0] != 2 {
+		t.Errorf("expected seq 2 replayed, got %#v %v", res, replayed)
+	}
+	if res, _ := resume("", 0); res.Resumed || res.State == nil {
+		t.Errorf("expected the whole state for a new client, got %#v", res)
+	}
+
+	broadcast(3)
+	if res, replayed := resume(epoch, 1); res.Resumed || res.State == nil || len(replayed) != 0 {
+		t.Errorf("expected the whole state once the history rolled over, got %#v %v", res, replayed)
+	}
+	if res, replayed := resume(epoch, 2); !res.Resumed || len(replayed) != 3 || replayed[2] != 5 {
+		t.Errorf("expected seq 3 to 5 replayed, got %#v %v", res, replayed)
+	}
+}
+
+func TestSocketHeartbeat(t *testing.T) {
+	socks := NewSockets(http.NotFoundHandler(), nil, SocketConfig{
+		QueueSize:      10,
+		Overflow:       OverflowCoalesce,
+		PingInterval:   20 * time.Millisecond,
+		IdleTimeout:    100 * time.Millisecond,
+		WriteTimeout:   time.Second,
+		MaxConnections: 1,
+	})
+	server := httptest.NewServer(socks)
+	defer server.Close()
+	url := "ws" + strings.TrimPrefix(server.URL, "http")
+
+	// a client that reads answers pings and stays connected
+	live, _, err := websocket.DefaultDialer.Dial(url, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	readErr := make(chan error, 1)
+	go func() {
+		for {
+			if _, _, err := live.ReadMessage(); err != nil {
+				readErr <- err
+				return
+			}
+		}
+	}()
+
+	refused, _, err := websocket.DefaultDialer.Dial(url, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := refused.ReadMessage(); !websocket.IsCloseError(err, websocket.CloseTryAgainLater) {
+		t.Errorf("expected a connection over the limit to be closed, got %v", err)
+	}
+	refused.Close()
+
+	time.Sleep(250 * time.Millisecond)
+	select {
+	case err := <-readErr:
+		t.Fatalf("client answering pings was disconnected: %v", err)
+	default:
+	}
+
+	w := httptest.NewRecorder()
+	socks.Connections(w, httptest.NewRequest(http.MethodGet, "/api/_connections", nil))
+	conns := []ConnectionInfo{}
+	if err := json.Unmarshal(w.Body.Bytes(), &conns); err != nil || len(conns) != 1 {
+		t.Errorf("expected one connection listed, got %s", w.Body.String())
+	}
+
+	live.Close()
+	for socks.Status().Connections > 0 {
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	// a client that never answers pings times out
+	idle, _, err := websocket.DefaultDialer.Dial(url, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer idle.Close()
+	idle.SetPingHandler(func(string) error { return nil })
+
+	if _, _, err := idle.ReadMessage(); !websocket.IsCloseError(err, websocket.CloseGoingAway) {
+		t.Errorf("expected an idle timeout close, got %v", err)
+	}
+	if s := socks.Status(); s.TimedOut != 1 || s.Refused != 1 {
+		t.Errorf("unexpected status %#v", s)
+	}
+}
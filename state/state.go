@@ -48,6 +48,8 @@ type Server struct {
 	Data       interface{}
 	fieldCache map[reflect.Type]map[string]int
 	locker     sync.Locker
+	// revision counts the changes made
+	revision uint64
 }
 
 // DoLocked executes the task function while locked
@@ -58,6 +60,65 @@ func (s *Server) DoLocked(task func() error) error {
 	return task()
 }
 
+// Revision returns the number of changes made through Post, Put, Delete and
+// Apply.  It must be called within DoLocked, where it is the number of changes
+// in Data.
+func (s *Server) Revision() uint64 {
+	return s.revision
+}
+
+// Apply makes the change an http method describes, returning the path of what
+// was changed, the value stored there as it marshals, and the revision it
+// made.  The value is read before unlocking, so it is the one this change
+// stored even if another follows straight after; deletes store nothing.
+func (s *Server) Apply(method string, path string, body []byte) (string, []byte, uint64, error) {
+	// this is slow for now, we'll speed it up later
+	s.locker.Lock()
+	defer s.locker.Unlock()
+
+	var err error
+	switch method {
+	case http.MethodPost:
+		path, err = s.post(path, body)
+	case http.MethodPut:
+		path, err = s.put(path, body)
+	case http.MethodDelete:
+		path, err = "", s.remove(path)
+	default:
+		err = BadRequestError(fmt.Sprintf("cannot apply method '%s'", method))
+	}
+	if err != nil {
+		return "", nil, s.revision, err
+	}
+	s.revision++
+
+	var stored []byte
+	if path != "" {
+		if stored, err = s.get(path); err != nil {
+			return "", nil, s.revision, err
+		}
+	}
+	return path, stored, s.revision, nil
+}
+
+// Post replaces the value of a field in the wrapped interface
+func (s *Server) Post(path string, body []byte) (string, error) {
+	path, _, _, err := s.Apply(http.MethodPost, path, body)
+	return path, err
+}
+
+// Put adds a new element to map or slice
+func (s *Server) Put(path string, body []byte) (string, error) {
+	path, _, _, err := s.Apply(http.MethodPut, path, body)
+	return path, err
+}
+
+// Delete removes an item from a slice or map
+func (s *Server) Delete(path string) error {
+	_, _, _, err := s.Apply(http.MethodDelete, path, nil)
+	return err
+}
+
 // NewServer creates a new server from an interface{}
 func NewServer(dat interface{}) *Server {
 	return &Server{Data: dat, locker: new(sync.Mutex)}
@@ -143,6 +204,24 @@ func (e BadRequestError) Status() int { return http.StatusBadRequest }
 // Error returns an error message compatible with error
 func (e BadRequestError) Error() string { return string(e) }
 
+// UnauthorizedError returns a 401 status
+type UnauthorizedError string
+
+// Status returns http.StatusUnauthorized
+func (e UnauthorizedError) Status() int { return http.StatusUnauthorized }
+
+// Error returns an error message compatible with error
+func (e UnauthorizedError) Error() string { return string(e) }
+
+// ForbiddenError returns a 403 status
+type ForbiddenError string
+
+// Status returns http.StatusForbidden
+func (e ForbiddenError) Status() int { return http.StatusForbidden }
+
+// Error returns an error message compatible with error
+func (e ForbiddenError) Error() string { return string(e) }
+
 func (s *Server) nextValue(v reflect.Value, path string) (child reflect.Value, rest string, tag reflect.StructTag, err error) {
 	if v == (reflect.Value{}) {
 		err = InternalServerError("empty value")
@@ -205,6 +284,10 @@ func (s *Server) Get(path string) ([]byte, error) {
 	s.locker.Lock()
 	defer s.locker.Unlock()
 
+	return s.get(path)
+}
+
+func (s *Server) get(path string) ([]byte, error) {
 	v := reflect.ValueOf(s.Data)
 	rest := path
 	var err error
@@ -237,12 +320,7 @@ func (s *Server) Get(path string) ([]byte, error) {
 	}
 }
 
-// Post allows modification of a field in the wrapped interface
-func (s *Server) Post(path string, body []byte) (string, error) {
-	// this is slow for now, we'll speed it up later
-	s.locker.Lock()
-	defer s.locker.Unlock()
-
+func (s *Server) post(path string, body []byte) (string, error) {
 	v := reflect.ValueOf(s.Data)
 	rest := path
 	var err error
@@ -270,12 +348,16 @@ func (s *Server) Post(path string, body []byte) (string, error) {
 		}
 		v = v.Addr()
 	}
-	if !v.CanInterface() {
+	if !v.CanInterface() || v.IsNil() {
 		return "", notFound
 	}
-	if err := json.Unmarshal(body, v.Interface()); err != nil {
+	// decode into a fresh value so the body replaces the old one rather than
+	// adding to its maps and keeping the fields it leaves out
+	nv := reflect.New(v.Type().Elem())
+	if err := json.Unmarshal(body, nv.Interface()); err != nil {
 		return "", InternalServerError(err.Error())
 	}
+	v.Elem().Set(nv.Elem())
 	return path, nil
 }
 
@@ -297,12 +379,7 @@ func (a apiTag) Maximum() int {
 
 }
 
-// Put adds a new element to map or slice
-func (s *Server) Put(path string, body []byte) (string, error) {
-	// this is slow for now, we'll speed it up later
-	s.locker.Lock()
-	defer s.locker.Unlock()
-
+func (s *Server) put(path string, body []byte) (string, error) {
 	v := reflect.ValueOf(s.Data)
 	rest := path
 	tag := reflect.StructTag("")
@@ -384,12 +461,7 @@ func (s *Server) Put(path string, body []byte) (string, error) {
 	return "", BadRequestError("path not map or slice")
 }
 
-// Delete removes an item from a slice or map
-func (s *Server) Delete(path string) error {
-	// this is slow for now, we'll speed it up later
-	s.locker.Lock()
-	defer s.locker.Unlock()
-
+func (s *Server) remove(path string) error {
 	v := reflect.ValueOf(s.Data)
 	rest := path
 	var err error
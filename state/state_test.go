@@ -195,6 +195,41 @@ func TestPost(t *testing.T) {
 		t.Errorf("incorrect value")
 	}
 
+	// posting replaces maps and structs rather than merging into them
+	tester.Map = map[string]int{"old": 1}
+	if _, err := s.Post("Map", []byte(`{"new":2}`)); err != nil {
+		t.Error(err)
+	} else if len(tester.Map) != 1 || tester.Map["new"] != 2 {
+		t.Errorf("map not replaced: %v", tester.Map)
+	}
+	if _, err := s.Post("Struct", []byte(`{}`)); err != nil {
+		t.Error(err)
+	} else if tester.Struct.Bool {
+		t.Errorf("field left out of the body kept its value")
+	}
+}
+
+func TestApply(t *testing.T) {
+	tester := &TestStruct{Slice: []int{1}}
+	s := NewServer(tester)
+
+	if path, stored, rev, err := s.Apply(http.MethodPut, "Slice", []byte(" 2 ")); err != nil || rev != 1 {
+		t.Errorf("expected revision 1, got %d %v", rev, err)
+	} else if path != "Slice/1" || string(stored) != "2" {
+		t.Errorf("expected 2 stored at Slice/1, got '%s' at %s", stored, path)
+	}
+	if _, _, rev, err := s.Apply(http.MethodDelete, "Slice/5", nil); err == nil || rev != 1 {
+		t.Errorf("expected a failed change to leave revision 1, got %d %v", rev, err)
+	}
+	if _, err := s.Post("String", []byte(`"two"`)); err != nil {
+		t.Error(err)
+	}
+	s.DoLocked(func() error {
+		if s.Revision() != 2 || len(tester.Slice) != 2 || tester.String != "two" {
+			t.Errorf("expected revision 2, got %d with %#v", s.Revision(), tester)
+		}
+		return nil
+	})
 }
 
 func TestGet(t *testing.T) {
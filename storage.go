@@ -0,0 +1,143 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"strings"
+
+	"github.com/donniet/mirror.4/state"
+)
+
+// Storage persists the mirror state.  Changes are applied to the in-memory
+// State first and then handed to Append, not always in the order they were
+// applied; Save and Snapshot are called with the state server locked, so the
+// state may include changes not appended yet.  Both are given the state
+// server's revision, so the state includes every change numbered up to it.
+type Storage interface {
+	// Load reads the persisted state into s
+	Load(s *State) error
+	// Append records a change that has already been applied to the state
+	Append(msg StateMessage) error
+	// Save makes every appended change durable
+	Save(s *State, revision uint64) error
+	// Snapshot writes the complete state, discarding any incremental records
+	Snapshot(s *State, revision uint64) error
+	// Close releases the underlying files
+	Close() error
+}
+
+// OpenStorage opens the storage backend named kind: "json" rewrites the whole
+// state file on every save, "journal" appends changes to a journal next to the
+// state file and "kv" keeps the state in an embedded key-value database
+func OpenStorage(kind string, statePath string, policy SyncPolicy) (Storage, error) {
+	switch kind {
+	case "json":
+		return &jsonStorage{path: statePath}, nil
+	case "journal":
+		j, err := OpenJournal(statePath+".journal", policy)
+		if err != nil {
+			return nil, err
+		}
+		return &journalStorage{path: statePath, journal: j}, nil
+	case "kv":
+		return openKVStorage(strings.TrimSuffix(statePath, ".json")+".db", statePath, policy)
+	}
+	return nil, fmt.Errorf("unknown storage '%s'", kind)
+}
+
+// jsonStorage writes the whole state document on every save
+type jsonStorage struct {
+	path string
+}
+
+func (j *jsonStorage) Load(s *State) error {
+	if err := s.Load(j.path); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+func (j *jsonStorage) Append(msg StateMessage) error        { return nil }
+func (j *jsonStorage) Save(s *State, revision uint64) error { return s.Save(j.path) }
+func (j *jsonStorage) Close() error                         { return nil }
+
+func (j *jsonStorage) Snapshot(s *State, revision uint64) error {
+	return s.Save(j.path)
+}
+
+// journalStorage appends each change to a journal and periodically compacts
+// it into the state document
+type journalStorage struct {
+	path    string
+	journal *Journal
+}
+
+func (j *journalStorage) Load(s *State) error {
+	if err := s.Load(j.path); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	mark, err := readJournalMark(j.path)
+	if err != nil {
+		return err
+	}
+	if err := j.journal.Replay(state.NewServer(s), mark); err != nil {
+		return err
+	} else if n := j.journal.Len(); n > 0 {
+		log.Printf("replayed %d journal entries", n)
+	}
+
+	// the state server numbers changes from the start, so they go in a new
+	// generation
+	return j.Snapshot(s, 0)
+}
+
+func (j *journalStorage) Append(msg StateMessage) error {
+	return j.journal.Append(msg)
+}
+
+func (j *journalStorage) Save(s *State, revision uint64) error {
+	if j.journal.policy == SyncNever {
+		return nil
+	}
+	return j.journal.Sync()
+}
+
+// Snapshot renames the new state document into place before truncating the
+// journal.  The document is marked with the next generation, so if there is a
+// crash in between the journal is known to be in it and isn't replayed, and
+// with revision, so changes it includes that are appended after it aren't
+// either.
+func (j *journalStorage) Snapshot(s *State, revision uint64) error {
+	mark := journalMark{Generation: j.journal.generation + 1, Revision: revision}
+	if err := s.SaveSnapshot(j.path, mark); err != nil {
+		return err
+	}
+	return j.journal.Truncate()
+}
+
+// readJournalMark returns the mark of the snapshot at path, which is empty if
+// there is no snapshot or it isn't marked
+func readJournalMark(path string) (journalMark, error) {
+	doc := struct {
+		Journal journalMark `json:"journal"`
+	}{}
+
+	b, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return doc.Journal, nil
+	} else if err != nil {
+		return doc.Journal, err
+	}
+	if b, err = encryption.OpenDocument(b); err != nil {
+		return doc.Journal, err
+	}
+	err = json.Unmarshal(b, &doc)
+	return doc.Journal, err
+}
+
+func (j *journalStorage) Close() error {
+	return j.journal.Close()
+}
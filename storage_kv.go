@@ -0,0 +1,367 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"reflect"
+	"strings"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+// kvCollection is a slice of State that the key-value store keeps as one
+// record per element rather than inside the state document, so appending a
+// detection does not rewrite everything else
+type kvCollection struct {
+	path  string
+	field func(s *State) interface{}
+}
+
+var kvCollections = []kvCollection{
+	{"faces/detections", func(s *State) interface{} { return &s.Faces.Detections }},
+	{"motion/detections", func(s *State) interface{} { return &s.Motion.Detections }},
+}
+
+var (
+	kvStateBucket = []byte("state")
+	kvDocumentKey = []byte("document")
+	kvEpochKey    = []byte("epoch")
+)
+
+// kvStorage keeps the state in an embedded bolt database.  The document
+// without the collections lives under a single key and each collection has a
+// bucket of its elements, keyed by the run and change that added them so they
+// are kept in the order they were applied.
+type kvStorage struct {
+	db         *bolt.DB
+	importPath string
+	// epoch numbers the run, since changes are numbered from the start of
+	// each one
+	epoch uint64
+
+	documentDirty bool
+	// appended holds the changes that added elements to each collection
+	// since the last save
+	appended map[string][]StateMessage
+	rewrite  map[string]bool
+	// covered is the revision each collection was last rewritten at, so the
+	// changes it already includes aren't added again
+	covered map[string]uint64
+	// last is the highest change appended
+	last uint64
+}
+
+func openKVStorage(path string, importPath string, policy SyncPolicy) (*kvStorage, error) {
+	db, err := bolt.Open(path, 0660, &bolt.Options{Timeout: time.Second})
+	if err != nil {
+		return nil, err
+	}
+	db.NoSync = policy == SyncNever
+
+	return &kvStorage{
+		db:         db,
+		importPath: importPath,
+		appended:   make(map[string][]StateMessage),
+		rewrite:    make(map[string]bool),
+		covered:    make(map[string]uint64),
+	}, nil
+}
+
+func (kv *kvStorage) markAllDirty() {
+	kv.documentDirty = true
+	for _, c := range kvCollections {
+		kv.rewrite[c.path] = true
+	}
+}
+
+// Load assembles the state document and its collections, migrating it as a
+// whole.  An empty database is seeded from the JSON state file if there is one.
+func (kv *kvStorage) Load(s *State) error {
+	if err := kv.startEpoch(); err != nil {
+		return err
+	}
+
+	var doc map[string]interface{}
+	err := kv.db.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket(kvStateBucket)
+		if b == nil || b.Get(kvDocumentKey) == nil {
+			return nil
+		}
+
+		// the document must be opened before the collections are added, or an
+		// encrypted one is no longer recognizable as an envelope
+		opened, err := encryption.OpenDocument(b.Get(kvDocumentKey))
+		if err != nil {
+			return err
+		}
+		dec := json.NewDecoder(bytes.NewReader(opened))
+		dec.UseNumber()
+		if err := dec.Decode(&doc); err != nil {
+			return err
+		}
+
+		for _, c := range kvCollections {
+			items := []json.RawMessage{}
+			if cb := tx.Bucket([]byte(c.path)); cb != nil {
+				cb.ForEach(func(k, v []byte) error {
+					items = append(items, append(json.RawMessage{}, v...))
+					return nil
+				})
+			}
+			if err := setDocumentPath(doc, strings.Split(c.path, "/"), items); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	if doc == nil {
+		kv.markAllDirty()
+		if err := s.Load(kv.importPath); err != nil && !os.IsNotExist(err) {
+			return err
+		} else if err == nil {
+			log.Printf("imported state from %s", kv.importPath)
+		}
+		return nil
+	}
+
+	// each element of the collections is sealed on its own
+	b, err := json.Marshal(doc)
+	if err != nil {
+		return err
+	}
+	if b, err = encryption.OpenDocument(b); err != nil {
+		return err
+	}
+	migrated, version, err := migrateState(b)
+	if err != nil {
+		return err
+	}
+	if version != stateVersion() {
+		kv.markAllDirty()
+	}
+	return json.Unmarshal(migrated, s)
+}
+
+// startEpoch numbers this run after every earlier one
+func (kv *kvStorage) startEpoch() error {
+	return kv.db.Update(func(tx *bolt.Tx) error {
+		b, err := tx.CreateBucketIfNotExists(kvStateBucket)
+		if err != nil {
+			return err
+		}
+
+		epoch := uint64(0)
+		if v := b.Get(kvEpochKey); len(v) == 8 {
+			epoch = binary.BigEndian.Uint64(v)
+		}
+		kv.epoch = epoch + 1
+		return b.Put(kvEpochKey, kvKey(kv.epoch))
+	})
+}
+
+// Append notes which parts of the database msg makes stale, keeping the
+// elements it adds to collections, which it carries as they were stored
+func (kv *kvStorage) Append(msg StateMessage) error {
+	path := strings.Trim(msg.Path, "/")
+	inCollection := false
+	if msg.Change > kv.last {
+		kv.last = msg.Change
+	}
+
+	for _, c := range kvCollections {
+		switch {
+		case path == c.path && msg.Method == http.MethodPut:
+			kv.appended[c.path] = append(kv.appended[c.path], msg)
+			inCollection = true
+		case path == c.path || strings.HasPrefix(path, c.path+"/"):
+			kv.rewrite[c.path] = true
+			inCollection = true
+		case path == "" || strings.HasPrefix(c.path, path+"/"):
+			kv.rewrite[c.path] = true
+		}
+	}
+
+	if !inCollection {
+		kv.documentDirty = true
+	}
+	return nil
+}
+
+// Save writes the stale parts of the state in a single transaction.  Appended
+// elements are written as their changes carry them rather than read from s,
+// which may already hold elements whose changes haven't been appended yet.
+func (kv *kvStorage) Save(s *State, revision uint64) error {
+	err := kv.db.Update(func(tx *bolt.Tx) error {
+		if kv.documentDirty {
+			if err := kv.putDocument(tx, s); err != nil {
+				return err
+			}
+		}
+
+		for _, c := range kvCollections {
+			items := reflect.ValueOf(c.field(s)).Elem()
+
+			if kv.rewrite[c.path] {
+				if err := kv.rewriteCollection(tx, c.path, items, revision); err != nil {
+					return err
+				}
+			} else if msgs := kv.appended[c.path]; len(msgs) > 0 {
+				if err := kv.appendCollection(tx, c.path, items.Type().Elem(), msgs, items.Len()); err != nil {
+					return err
+				}
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	for path := range kv.rewrite {
+		kv.covered[path] = revision
+	}
+	kv.documentDirty = false
+	kv.appended = make(map[string][]StateMessage)
+	kv.rewrite = make(map[string]bool)
+	return nil
+}
+
+// Snapshot rewrites the whole state
+func (kv *kvStorage) Snapshot(s *State, revision uint64) error {
+	kv.markAllDirty()
+	return kv.Save(s, revision)
+}
+
+func (kv *kvStorage) Close() error {
+	return kv.db.Close()
+}
+
+func (kv *kvStorage) putDocument(tx *bolt.Tx, s *State) error {
+	b, err := tx.CreateBucketIfNotExists(kvStateBucket)
+	if err != nil {
+		return err
+	}
+
+	// leave the collections out of the document
+	doc := *s
+	for _, c := range kvCollections {
+		v := reflect.ValueOf(c.field(&doc)).Elem()
+		v.Set(reflect.Zero(v.Type()))
+	}
+
+	dat, err := doc.marshalVersioned(nil)
+	if err != nil {
+		return err
+	}
+	return b.Put(kvDocumentKey, dat)
+}
+
+// rewriteCollection replaces the elements stored for path with items, which
+// include every change up to revision
+func (kv *kvStorage) rewriteCollection(tx *bolt.Tx, path string, items reflect.Value, revision uint64) error {
+	if err := tx.DeleteBucket([]byte(path)); err != nil && err != bolt.ErrBucketNotFound {
+		return err
+	}
+	b, err := tx.CreateBucket([]byte(path))
+	if err != nil {
+		return err
+	}
+
+	for i := 0; i < items.Len(); i++ {
+		dat, err := json.Marshal(items.Index(i).Interface())
+		if err != nil {
+			return err
+		}
+		if err := kv.putElement(b, items.Type().Elem(), revision, dat); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// appendCollection stores the elements msgs added, unless the last rewrite
+// already included them, and then drops elements from the front of the bucket
+// until it is no longer than max
+func (kv *kvStorage) appendCollection(tx *bolt.Tx, path string, elem reflect.Type, msgs []StateMessage, max int) error {
+	b, err := tx.CreateBucketIfNotExists([]byte(path))
+	if err != nil {
+		return err
+	}
+
+	for _, msg := range msgs {
+		if msg.Body == nil || (msg.Change != 0 && msg.Change <= kv.covered[path]) {
+			continue
+		}
+		change := msg.Change
+		if change == 0 {
+			// unnumbered changes can only go after everything else
+			change = kv.last
+		}
+		if err := kv.putElement(b, elem, change, *msg.Body); err != nil {
+			return err
+		}
+	}
+
+	// collect the keys first since deleting moves the cursor
+	keys := [][]byte{}
+	b.ForEach(func(k, v []byte) error {
+		keys = append(keys, append([]byte{}, k...))
+		return nil
+	})
+	for i := 0; i < len(keys)-max; i++ {
+		if err := b.Delete(keys[i]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// putElement stores dat, an element of type elem added by change, in b
+func (kv *kvStorage) putElement(b *bolt.Bucket, elem reflect.Type, change uint64, dat []byte) error {
+	dat, err := encryption.SealDocument(dat, elem)
+	if err != nil {
+		return err
+	}
+	seq, err := b.NextSequence()
+	if err != nil {
+		return err
+	}
+
+	key := append(kvKey(kv.epoch), kvKey(change)...)
+	return b.Put(append(key, kvKey(seq)...), dat)
+}
+
+// kvKey encodes a number so keys sort in numeric order
+func kvKey(n uint64) []byte {
+	b := make([]byte, 8)
+	binary.BigEndian.PutUint64(b, n)
+	return b
+}
+
+// setDocumentPath sets the value at a '/' separated path in a decoded JSON
+// document, creating objects along the way
+func setDocumentPath(doc map[string]interface{}, path []string, value interface{}) error {
+	for len(path) > 1 {
+		child, ok := doc[path[0]].(map[string]interface{})
+		if !ok {
+			if doc[path[0]] != nil {
+				return fmt.Errorf("'%s' is not an object", path[0])
+			}
+			child = make(map[string]interface{})
+			doc[path[0]] = child
+		}
+		doc, path = child, path[1:]
+	}
+	doc[path[0]] = value
+	return nil
+}
@@ -0,0 +1,287 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/donniet/mirror.4/state"
+)
+
+func TestKVStorageRoundTrip(t *testing.T) {
+	path, cleanup := copyFixture(t, "state-v0.json")
+	defer cleanup()
+
+	storage, err := OpenStorage("kv", path, SyncNever)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// an empty database imports the JSON state file
+	local := new(State)
+	if err := storage.Load(local); err != nil {
+		t.Fatal(err)
+	} else if len(local.Faces.Detections) != 1 {
+		t.Fatalf("expected imported detections, got %#v", local.Faces)
+	}
+	if err := storage.Save(local, 0); err != nil {
+		t.Fatal(err)
+	}
+
+	server := state.NewServer(local)
+	msgs := []StateMessage{
+		{Method: http.MethodPost, Path: "display/powerStatus", Body: rawMessage(`"off"`)},
+		{Method: http.MethodPut, Path: "faces/detections", Body: rawMessage(`{"name":"sam","confidence":0.5}`)},
+		{Method: http.MethodPut, Path: "motion/detections", Body: rawMessage(`{"magnitude":3}`)},
+		{Method: http.MethodDelete, Path: "motion/detections/0"},
+	}
+	for _, m := range msgs {
+		if err := applyMessage(server, &m); err != nil {
+			t.Fatal(err)
+		}
+		if err := storage.Append(m); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := storage.Save(local, server.Revision()); err != nil {
+		t.Fatal(err)
+	}
+	storage.Close()
+
+	storage, err = OpenStorage("kv", path, SyncNever)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer storage.Close()
+
+	loaded := new(State)
+	if err := storage.Load(loaded); err != nil {
+		t.Fatal(err)
+	}
+
+	if loaded.Display.PowerStatus != "off" {
+		t.Errorf("expected powerStatus 'off' got '%s'", loaded.Display.PowerStatus)
+	}
+	if len(loaded.Faces.Detections) != 2 || loaded.Faces.Detections[1].Name != "sam" {
+		t.Errorf("unexpected detections %#v", loaded.Faces.Detections)
+	}
+	if len(loaded.Motion.Detections) != 1 || loaded.Motion.Detections[0].Magnitude != 3 {
+		t.Errorf("unexpected motion detections %#v", loaded.Motion.Detections)
+	}
+	if len(loaded.Streams) != 1 || len(loaded.Faces.People) != 1 {
+		t.Errorf("document not loaded: %#v", loaded)
+	}
+}
+
+func TestKVStorageInFlight(t *testing.T) {
+	path, cleanup := copyFixture(t, "state-v0.json")
+	defer cleanup()
+
+	storage, err := OpenStorage("kv", path, SyncNever)
+	if err != nil {
+		t.Fatal(err)
+	}
+	local := new(State)
+	if err := storage.Load(local); err != nil {
+		t.Fatal(err)
+	}
+	server := state.NewServer(local)
+
+	apply := func(name string) StateMessage {
+		m := StateMessage{Method: http.MethodPut, Path: "faces/detections", Body: rawMessage(`{"name":"` + name + `"}`)}
+		if err := applyMessage(server, &m); err != nil {
+			t.Fatal(err)
+		}
+		return m
+	}
+
+	// a rewrite that already includes a change appended after it
+	a := apply("a")
+	if err := storage.Snapshot(local, server.Revision()); err != nil {
+		t.Fatal(err)
+	}
+	storage.Append(a)
+
+	// and a change saved before an earlier one is appended
+	b, c := apply("b"), apply("c")
+	storage.Append(c)
+	if err := storage.Save(local, server.Revision()); err != nil {
+		t.Fatal(err)
+	}
+	storage.Append(b)
+	if err := storage.Save(local, server.Revision()); err != nil {
+		t.Fatal(err)
+	}
+	storage.Close()
+
+	storage, err = OpenStorage("kv", path, SyncNever)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer storage.Close()
+	loaded := new(State)
+	if err := storage.Load(loaded); err != nil {
+		t.Fatal(err)
+	}
+
+	names := []string{}
+	for _, d := range loaded.Faces.Detections {
+		names = append(names, d.Name)
+	}
+	if strings.Join(names, ",") != local.Faces.Detections[0].Name+",a,b,c" {
+		t.Errorf("expected each change stored once in order, got %v", names)
+	}
+}
+
+func TestKVStorageEncrypted(t *testing.T) {
+	path, cleanup := copyFixture(t, "state-v0.json")
+	defer cleanup()
+	defer func() { encryption = nil }()
+
+	for _, mode := range []EncryptMode{EncryptFields, EncryptFile} {
+		var err error
+		if encryption, err = LoadEncryption(mode, "", testKey1); err != nil {
+			t.Fatal(err)
+		}
+
+		storage, err := OpenStorage("kv", path, SyncNever)
+		if err != nil {
+			t.Fatal(err)
+		}
+		local := new(State)
+		if err := storage.Load(local); err != nil {
+			t.Fatal(err)
+		}
+		if err := storage.Snapshot(local, 0); err != nil {
+			t.Fatal(err)
+		}
+		storage.Close()
+
+		storage, err = OpenStorage("kv", path, SyncNever)
+		if err != nil {
+			t.Fatal(err)
+		}
+		loaded := new(State)
+		if err := storage.Load(loaded); err != nil {
+			t.Fatal(err)
+		}
+		storage.Close()
+
+		if len(loaded.Streams) != 1 || len(loaded.Faces.People) != 1 || len(loaded.Faces.Detections) != 1 {
+			t.Errorf("%s: state lost after reloading: %#v", mode, loaded)
+		} else if loaded.Faces.Detections[0].Image.Hash != local.Faces.Detections[0].Image.Hash {
+			t.Errorf("%s: detection not decrypted: %#v", mode, loaded.Faces.Detections[0])
+		}
+	}
+}
+
+func TestJournalStorageSnapshotCrash(t *testing.T) {
+	path, cleanup := copyFixture(t, "state-v0.json")
+	defer cleanup()
+
+	storage, err := OpenStorage("journal", path, SyncAlways)
+	if err != nil {
+		t.Fatal(err)
+	}
+	local := new(State)
+	if err := storage.Load(local); err != nil {
+		t.Fatal(err)
+	}
+
+	msg := StateMessage{Method: http.MethodPut, Path: "motion/detections", Body: rawMessage(`{"magnitude":3}`)}
+	if err := applyMessage(state.NewServer(local), &msg); err != nil {
+		t.Fatal(err)
+	}
+	if err := storage.Append(msg); err != nil {
+		t.Fatal(err)
+	}
+
+	// crash after writing the snapshot but before truncating the journal
+	js := storage.(*journalStorage)
+	if err := local.SaveSnapshot(path, journalMark{Generation: js.journal.generation + 1}); err != nil {
+		t.Fatal(err)
+	}
+	storage.Close()
+
+	storage, err = OpenStorage("journal", path, SyncAlways)
+	if err != nil {
+		t.Fatal(err)
+	}
+	loaded := new(State)
+	if err := storage.Load(loaded); err != nil {
+		t.Fatal(err)
+	}
+	if len(loaded.Motion.Detections) != len(local.Motion.Detections) {
+		t.Errorf("expected %d motion detections, got %d", len(local.Motion.Detections), len(loaded.Motion.Detections))
+	}
+
+	// changes after the reload are kept
+	if err := storage.Append(msg); err != nil {
+		t.Fatal(err)
+	}
+	storage.Close()
+
+	storage, err = OpenStorage("journal", path, SyncAlways)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer storage.Close()
+
+	reloaded := new(State)
+	if err := storage.Load(reloaded); err != nil {
+		t.Fatal(err)
+	} else if len(reloaded.Motion.Detections) != len(local.Motion.Detections)+1 {
+		t.Errorf("expected %d motion detections, got %d", len(local.Motion.Detections)+1, len(reloaded.Motion.Detections))
+	}
+}
+
+func TestJournalStorageAppendAfterSnapshot(t *testing.T) {
+	path, cleanup := copyFixture(t, "state-v0.json")
+	defer cleanup()
+
+	storage, err := OpenStorage("journal", path, SyncAlways)
+	if err != nil {
+		t.Fatal(err)
+	}
+	local := new(State)
+	if err := storage.Load(local); err != nil {
+		t.Fatal(err)
+	}
+	before := len(local.Motion.Detections)
+
+	server := state.NewServer(local)
+	put := func() StateMessage {
+		msg := StateMessage{Method: http.MethodPut, Path: "motion/detections", Body: rawMessage(`{"magnitude":3}`)}
+		if err := applyMessage(server, &msg); err != nil {
+			t.Fatal(err)
+		}
+		return msg
+	}
+
+	// the first change is in the snapshot but only reaches storage after it
+	first := put()
+	err = server.DoLocked(func() error { return storage.Snapshot(local, server.Revision()) })
+	if err != nil {
+		t.Fatal(err)
+	}
+	second := put()
+	for _, msg := range []StateMessage{first, second} {
+		if err := storage.Append(msg); err != nil {
+			t.Fatal(err)
+		}
+	}
+	storage.Close()
+
+	storage, err = OpenStorage("journal", path, SyncAlways)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer storage.Close()
+
+	loaded := new(State)
+	if err := storage.Load(loaded); err != nil {
+		t.Fatal(err)
+	} else if len(loaded.Motion.Detections) != before+2 {
+		t.Errorf("expected %d motion detections, got %d", before+2, len(loaded.Motion.Detections))
+	}
+}
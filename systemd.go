@@ -0,0 +1,108 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"strconv"
+	"time"
+)
+
+// sdListenFdsStart is the first file descriptor systemd passes for socket
+// activation
+const sdListenFdsStart = 3
+
+// sdNotify tells systemd about the service's state, like "READY=1" or
+// "STATUS=loading state".  It does nothing unless systemd started us with
+// NOTIFY_SOCKET set, as it does for Type=notify services.
+func sdNotify(state string) error {
+	socket := os.Getenv("NOTIFY_SOCKET")
+	if socket == "" {
+		return nil
+	}
+	// an @ means a socket in the abstract namespace
+	if socket[0] == '@' {
+		socket = "\x00" + socket[1:]
+	}
+
+	conn, err := net.DialUnix("unixgram", nil, &net.UnixAddr{Name: socket, Net: "unixgram"})
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	_, err = conn.Write([]byte(state))
+	return err
+}
+
+// sdStatus notifies systemd of a status line shown by systemctl status,
+// logging rather than failing if it can't
+func sdStatus(format string, args ...interface{}) {
+	if err := sdNotify("STATUS=" + fmt.Sprintf(format, args...)); err != nil {
+		log.Printf("error notifying systemd: %v", err)
+	}
+}
+
+// watchdogInterval returns how often systemd expects WATCHDOG=1, or 0 if the
+// watchdog isn't on for this process
+func watchdogInterval() time.Duration {
+	if pid := os.Getenv("WATCHDOG_PID"); pid != "" && pid != strconv.Itoa(os.Getpid()) {
+		return 0
+	}
+	usec, err := strconv.ParseInt(os.Getenv("WATCHDOG_USEC"), 10, 64)
+	if err != nil || usec <= 0 {
+		return 0
+	}
+	return time.Duration(usec) * time.Microsecond
+}
+
+// runWatchdog pings systemd's watchdog at half the interval it expects, as
+// long as alive reports the main loop answering.  If the loop hangs the pings
+// stop and systemd restarts us.
+func runWatchdog(interval time.Duration, alive func(timeout time.Duration) bool, stopper <-chan struct{}) {
+	ticker := time.NewTicker(interval / 2)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+		case <-stopper:
+			return
+		}
+
+		if !alive(interval / 4) {
+			log.Printf("message loop not answering, skipping watchdog ping")
+			continue
+		}
+		if err := sdNotify("WATCHDOG=1"); err != nil {
+			log.Printf("error pinging systemd watchdog: %v", err)
+		}
+	}
+}
+
+// systemdListener returns the socket systemd opened for us with socket
+// activation, or nil if it didn't
+func systemdListener() (net.Listener, error) {
+	if pid := os.Getenv("LISTEN_PID"); pid == "" || pid != strconv.Itoa(os.Getpid()) {
+		return nil, nil
+	}
+	n, err := strconv.Atoi(os.Getenv("LISTEN_FDS"))
+	if err != nil || n < 1 {
+		return nil, nil
+	}
+	if n > 1 {
+		log.Printf("systemd passed %d sockets, only using the first", n)
+	}
+
+	// don't pass them on to anything we start
+	os.Unsetenv("LISTEN_PID")
+	os.Unsetenv("LISTEN_FDS")
+	os.Unsetenv("LISTEN_FDNAMES")
+
+	f := os.NewFile(uintptr(sdListenFdsStart), "systemd socket")
+	defer f.Close()
+
+	// net.FileListener dups the descriptor, so f can be closed
+	return net.FileListener(f)
+}
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestSdNotify(t *testing.T) {
+	dir, err := ioutil.TempDir("", "systemd")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// without systemd nothing is sent
+	os.Unsetenv("NOTIFY_SOCKET")
+	if err := sdNotify("READY=1"); err != nil {
+		t.Errorf("expected nothing to be done outside systemd, got %v", err)
+	}
+
+	path := filepath.Join(dir, "notify")
+	conn, err := net.ListenUnixgram("unixgram", &net.UnixAddr{Name: path, Net: "unixgram"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	os.Setenv("NOTIFY_SOCKET", path)
+	defer os.Unsetenv("NOTIFY_SOCKET")
+
+	read := func() string {
+		b := make([]byte, 256)
+		conn.SetReadDeadline(time.Now().Add(time.Second))
+		n, err := conn.Read(b)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return string(b[:n])
+	}
+
+	sdStatus("loading %s", "state.json")
+	if msg := read(); msg != "STATUS=loading state.json" {
+		t.Errorf("unexpected notification '%s'", msg)
+	}
+
+	// the watchdog only pings while the loop answers
+	os.Setenv("WATCHDOG_USEC", "40000")
+	os.Setenv("WATCHDOG_PID", strconv.Itoa(os.Getpid()))
+	defer os.Unsetenv("WATCHDOG_USEC")
+	defer os.Unsetenv("WATCHDOG_PID")
+
+	interval := watchdogInterval()
+	if interval != 40*time.Millisecond {
+		t.Fatalf("expected a 40ms watchdog, got %v", interval)
+	}
+
+	answering := make(chan bool, 10)
+	stopper := make(chan struct{})
+	go runWatchdog(interval, func(time.Duration) bool { return <-answering }, stopper)
+	defer close(stopper)
+
+	answering <- false
+	answering <- true
+	if msg := read(); msg != "WATCHDOG=1" {
+		t.Errorf("unexpected notification '%s'", msg)
+	}
+
+	os.Setenv("WATCHDOG_PID", "1")
+	if watchdogInterval() != 0 {
+		t.Errorf("expected the watchdog for another process to be ignored")
+	}
+}
@@ -0,0 +1,118 @@
+package main
+
+import (
+	"bytes"
+	"html/template"
+	"io/fs"
+	"log"
+	"net/http"
+	"path"
+	"sync"
+	"time"
+)
+
+// version is the build, set with -ldflags "-X main.version=..."
+var version = "dev"
+
+// errorPage is shown instead of a page that couldn't be rendered
+var errorPage = template.Must(template.New("error").Parse(`<!DOCTYPE html>
+<html>
+<head><title>mirror error</title></head>
+<body style="background: black; color: white; font-family: sans-serif;">
+  <h1>Something went wrong</h1>
+  {{if .}}<pre>{{.}}</pre>{{else}}<p>The page could not be shown, see the server log.</p>{{end}}
+</body>
+</html>
+`))
+
+// Templates parses a page template once, or in dev mode again whenever its
+// file changes
+type Templates struct {
+	locker  sync.Locker
+	fsys    fs.FS
+	path    string
+	dev     bool
+	tmpl    *template.Template
+	modTime time.Time
+	err     error
+}
+
+// NewTemplates parses the template at path in fsys, which uses [[ ]]
+// delimiters so it can contain Vue's.  In dev mode a template that doesn't
+// parse is reported in the page until it's fixed, rather than stopping the
+// server.
+func NewTemplates(fsys fs.FS, path string, dev bool) (*Templates, error) {
+	t := &Templates{
+		locker: &sync.Mutex{},
+		fsys:   fsys,
+		path:   path,
+		dev:    dev,
+	}
+	if t.err = t.parse(); t.err != nil && !dev {
+		return nil, t.err
+	}
+	return t, nil
+}
+
+// parse reads the template file.  It must be called with t locked.
+func (t *Templates) parse() error {
+	info, err := fs.Stat(t.fsys, t.path)
+	if err != nil {
+		return err
+	}
+	t.modTime = info.ModTime()
+
+	tmpl, err := template.New(path.Base(t.path)).Delims("[[", "]]").ParseFS(t.fsys, t.path)
+	if err != nil {
+		return err
+	}
+	t.tmpl = tmpl
+	return nil
+}
+
+// current returns the parsed template, first reparsing it in dev mode if the
+// file changed
+func (t *Templates) current() (*template.Template, error) {
+	t.locker.Lock()
+	defer t.locker.Unlock()
+
+	if !t.dev {
+		return t.tmpl, t.err
+	}
+	if info, err := fs.Stat(t.fsys, t.path); err != nil || !info.ModTime().Equal(t.modTime) {
+		if t.err = t.parse(); t.err == nil {
+			log.Printf("reloaded template %s", t.path)
+		}
+	}
+	return t.tmpl, t.err
+}
+
+// Execute renders the template called name with data, or a 500 page if it
+// fails
+func (t *Templates) Execute(w http.ResponseWriter, name string, data interface{}) {
+	buf := &bytes.Buffer{}
+
+	tmpl, err := t.current()
+	if err == nil {
+		err = tmpl.ExecuteTemplate(buf, name, data)
+	}
+	if err != nil {
+		log.Printf("error rendering %s: %v", name, err)
+
+		// only developers get to see what broke
+		detail := ""
+		if t.dev {
+			detail = err.Error()
+		}
+		buf.Reset()
+		errorPage.Execute(buf, detail)
+
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write(buf.Bytes())
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Write(buf.Bytes())
+}
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestIndexTemplate(t *testing.T) {
+	client, err := ClientFS("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	templates, err := NewTemplates(client, "index.html", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	w := httptest.NewRecorder()
+	templates.Execute(w, "index.html", map[string]interface{}{
+		"WebsocketURL": "ws://mirror.local/websocket",
+		"CSRFToken":    "token",
+		"Version":      "1.2.3",
+		"State":        json.RawMessage(`{"display":{"powerStatus":"</script>"}}`),
+		"Config":       map[string]interface{}{"basePath": ""},
+	})
+	body := w.Body.String()
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected the page, got %d %s", w.Code, body)
+	}
+	if !strings.Contains(body, `websocketUrl: "ws://mirror.local/websocket"`) {
+		t.Errorf("expected the websocket URL in the page")
+	}
+	if strings.Contains(body, `"</script>"`) {
+		t.Errorf("expected the state to be escaped for the script")
+	}
+}
+
+func TestTemplateReload(t *testing.T) {
+	dir, err := ioutil.TempDir("", "templates")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "page.html")
+	write := func(content string, mod time.Time) {
+		if err := ioutil.WriteFile(path, []byte(content), 0660); err != nil {
+			t.Fatal(err)
+		}
+		os.Chtimes(path, mod, mod)
+	}
+	render := func(templates *Templates) (int, string) {
+		w := httptest.NewRecorder()
+		templates.Execute(w, "page.html", "world")
+		return w.Code, w.Body.String()
+	}
+
+	start := time.Now().Add(-time.Hour)
+	write(`hello [[.]]`, start)
+
+	fsys := os.DirFS(dir)
+	cached, err := NewTemplates(fsys, "page.html", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dev, err := NewTemplates(fsys, "page.html", true)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	write(`goodbye [[.]]`, start.Add(time.Minute))
+	if _, body := render(cached); body != "hello world" {
+		t.Errorf("expected the cached template, got '%s'", body)
+	}
+	if _, body := render(dev); body != "goodbye world" {
+		t.Errorf("expected the reloaded template, got '%s'", body)
+	}
+
+	// errors are a page, with the details only in dev mode
+	write(`broken [[.]`, start.Add(2*time.Minute))
+	if code, body := render(dev); code != http.StatusInternalServerError || !strings.Contains(body, "page.html") {
+		t.Errorf("expected an error page with the details, got %d %s", code, body)
+	}
+	if _, err := NewTemplates(fsys, "page.html", false); err == nil {
+		t.Errorf("expected a broken template to be refused outside dev mode")
+	}
+
+	write(`missing [[template "nothing"]]`, start.Add(3*time.Minute))
+	if cached, err = NewTemplates(fsys, "page.html", false); err != nil {
+		t.Fatal(err)
+	}
+	if code, body := render(cached); code != http.StatusInternalServerError || strings.Contains(body, "nothing") {
+		t.Errorf("expected an error page without the details, got %d %s", code, body)
+	}
+}
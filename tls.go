@@ -0,0 +1,311 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	tlsCAFile      = "ca.pem"
+	tlsCAKeyFile   = "ca-key.pem"
+	tlsCertFile    = "cert.pem"
+	tlsKeyFile     = "key.pem"
+	tlsCAValidity  = 10 * 365 * 24 * time.Hour
+	tlsValidity    = 825 * 24 * time.Hour
+	tlsRenewBefore = 30 * 24 * time.Hour
+)
+
+// LoadTLS loads the certificate and key in certFile and keyFile, or if they
+// aren't given, one generated in dir for hosts and signed by a CA also kept
+// there, so browsers only have to trust the CA once.  The CA may only sign for
+// hosts, and the server certificate is reissued when it nears expiry or
+// doesn't cover hosts.
+func LoadTLS(certFile, keyFile, dir string, hosts []string) (*tls.Config, error) {
+	if certFile != "" || keyFile != "" {
+		if certFile == "" || keyFile == "" {
+			return nil, fmt.Errorf("both a TLS certificate and key are needed")
+		}
+		cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+		if err != nil {
+			return nil, err
+		}
+		return &tls.Config{Certificates: []tls.Certificate{cert}}, nil
+	}
+
+	issuer, err := newTLSIssuer(dir, hosts)
+	if err != nil {
+		return nil, err
+	}
+	return &tls.Config{GetCertificate: issuer.GetCertificate}, nil
+}
+
+// tlsIssuer keeps the certificate generated in dir for hosts current
+type tlsIssuer struct {
+	dir   string
+	hosts []string
+	ca    *x509.Certificate
+	caKey *ecdsa.PrivateKey
+
+	locker  sync.Mutex
+	cert    *tls.Certificate
+	renewAt time.Time
+}
+
+func newTLSIssuer(dir string, hosts []string) (*tlsIssuer, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+
+	ca, caKey, err := loadOrCreateCA(dir, hosts)
+	if err != nil {
+		return nil, err
+	}
+	t := &tlsIssuer{dir: dir, hosts: hosts, ca: ca, caKey: caKey}
+
+	cert, err := tls.LoadX509KeyPair(t.certPaths())
+	if err == nil {
+		if leaf, perr := x509.ParseCertificate(cert.Certificate[0]); perr != nil || !certCovers(leaf, ca, hosts) {
+			err = fmt.Errorf("certificate needs reissuing")
+		} else {
+			t.cert, t.renewAt = &cert, leaf.NotAfter.Add(-tlsRenewBefore)
+		}
+	}
+	if err != nil {
+		if err := t.issue(); err != nil {
+			return nil, err
+		}
+	}
+	return t, nil
+}
+
+// GetCertificate returns the server certificate for tls.Config, first
+// reissuing it if it nears expiry.  If that fails the old one is kept and
+// reissuing is tried again later.
+func (t *tlsIssuer) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	t.locker.Lock()
+	defer t.locker.Unlock()
+
+	if time.Now().After(t.renewAt) {
+		if err := t.issue(); err != nil {
+			log.Printf("error renewing the TLS certificate: %v", err)
+			t.renewAt = time.Now().Add(time.Hour)
+		}
+	}
+	return t.cert, nil
+}
+
+func (t *tlsIssuer) certPaths() (certPath, keyPath string) {
+	return filepath.Join(t.dir, tlsCertFile), filepath.Join(t.dir, tlsKeyFile)
+}
+
+// issue creates and loads a new server certificate.  After newTLSIssuer it
+// must be called with t locked.
+func (t *tlsIssuer) issue() error {
+	certPath, keyPath := t.certPaths()
+	if err := createCert(t.ca, t.caKey, t.hosts, certPath, keyPath); err != nil {
+		return err
+	}
+	log.Printf("issued a TLS certificate for %s, signed by the CA in %s", strings.Join(t.hosts, ", "), filepath.Join(t.dir, tlsCAFile))
+
+	cert, err := tls.LoadX509KeyPair(certPath, keyPath)
+	if err != nil {
+		return err
+	}
+	leaf, err := x509.ParseCertificate(cert.Certificate[0])
+	if err != nil {
+		return err
+	}
+	t.cert, t.renewAt = &cert, leaf.NotAfter.Add(-tlsRenewBefore)
+	return nil
+}
+
+// certCovers reports whether cert was signed by ca, names every host and
+// isn't about to expire
+func certCovers(cert *x509.Certificate, ca *x509.Certificate, hosts []string) bool {
+	if cert.CheckSignatureFrom(ca) != nil || time.Now().Add(tlsRenewBefore).After(cert.NotAfter) {
+		return false
+	}
+	for _, h := range hosts {
+		if cert.VerifyHostname(h) != nil {
+			return false
+		}
+	}
+	return true
+}
+
+// caPermits reports whether ca is constrained to names and addresses that
+// include every host
+func caPermits(ca *x509.Certificate, hosts []string) bool {
+	if !ca.PermittedDNSDomainsCritical {
+		return false
+	}
+next:
+	for _, h := range hosts {
+		if ip := net.ParseIP(h); ip != nil {
+			for _, r := range ca.PermittedIPRanges {
+				if r.Contains(ip) {
+					continue next
+				}
+			}
+			return false
+		}
+		for _, d := range ca.PermittedDNSDomains {
+			if strings.EqualFold(h, d) || strings.HasSuffix(strings.ToLower(h), "."+strings.ToLower(d)) {
+				continue next
+			}
+		}
+		return false
+	}
+	return true
+}
+
+// constrainCA limits the CA in template to signing for hosts and their
+// subdomains, so a leaked CA key can't be used for other sites
+func constrainCA(template *x509.Certificate, hosts []string) {
+	template.PermittedDNSDomainsCritical = true
+	for _, h := range hosts {
+		if ip := net.ParseIP(h); ip == nil {
+			template.PermittedDNSDomains = append(template.PermittedDNSDomains, h)
+		} else if ip4 := ip.To4(); ip4 != nil {
+			template.PermittedIPRanges = append(template.PermittedIPRanges, &net.IPNet{IP: ip4, Mask: net.CIDRMask(32, 32)})
+		} else {
+			template.PermittedIPRanges = append(template.PermittedIPRanges, &net.IPNet{IP: ip, Mask: net.CIDRMask(128, 128)})
+		}
+	}
+
+	// permitting none of a kind leaves it unconstrained, so exclude them all
+	if len(template.PermittedDNSDomains) == 0 {
+		template.ExcludedDNSDomains = []string{""}
+	}
+	if len(template.PermittedIPRanges) == 0 {
+		template.ExcludedIPRanges = []*net.IPNet{
+			{IP: net.IPv4zero.To4(), Mask: net.CIDRMask(0, 32)},
+			{IP: net.IPv6zero, Mask: net.CIDRMask(0, 128)},
+		}
+	}
+}
+
+// loadOrCreateCA loads the CA in dir, or creates one if there isn't one or it
+// can't sign for hosts
+func loadOrCreateCA(dir string, hosts []string) (*x509.Certificate, *ecdsa.PrivateKey, error) {
+	certPath, keyPath := filepath.Join(dir, tlsCAFile), filepath.Join(dir, tlsCAKeyFile)
+
+	if pair, err := tls.LoadX509KeyPair(certPath, keyPath); err == nil {
+		ca, err := x509.ParseCertificate(pair.Certificate[0])
+		if err != nil {
+			return nil, nil, err
+		}
+		key, ok := pair.PrivateKey.(*ecdsa.PrivateKey)
+		if !ok {
+			return nil, nil, fmt.Errorf("%s: expected an ECDSA key", keyPath)
+		}
+		if caPermits(ca, hosts) {
+			return ca, key, nil
+		}
+		log.Printf("the TLS certificate authority in %s can't sign for %s, replacing it", certPath, strings.Join(hosts, ", "))
+	} else if !os.IsNotExist(err) {
+		return nil, nil, err
+	}
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, nil, err
+	}
+	serial, err := randomSerial()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	template := &x509.Certificate{
+		SerialNumber:          serial,
+		Subject:               pkix.Name{Organization: []string{"mirror"}, CommonName: "mirror CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(tlsCAValidity),
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageCRLSign,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+		MaxPathLenZero:        true,
+	}
+	constrainCA(template, hosts)
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		return nil, nil, err
+	}
+	if err := writePEM(keyPath, certPath, key, der); err != nil {
+		return nil, nil, err
+	}
+	log.Printf("created a TLS certificate authority in %s, install it on devices to trust the mirror", certPath)
+
+	ca, err := x509.ParseCertificate(der)
+	return ca, key, err
+}
+
+func createCert(ca *x509.Certificate, caKey *ecdsa.PrivateKey, hosts []string, certPath, keyPath string) error {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return err
+	}
+	serial, err := randomSerial()
+	if err != nil {
+		return err
+	}
+
+	template := &x509.Certificate{
+		SerialNumber: serial,
+		Subject:      pkix.Name{Organization: []string{"mirror"}},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(tlsValidity),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	for _, h := range hosts {
+		if ip := net.ParseIP(h); ip != nil {
+			template.IPAddresses = append(template.IPAddresses, ip)
+		} else {
+			template.DNSNames = append(template.DNSNames, h)
+		}
+	}
+	if len(hosts) > 0 {
+		template.Subject.CommonName = hosts[0]
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, ca, &key.PublicKey, caKey)
+	if err != nil {
+		return err
+	}
+	return writePEM(keyPath, certPath, key, der)
+}
+
+func randomSerial() (*big.Int, error) {
+	return rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+}
+
+// writePEM saves a key, readable only by us, and its certificate
+func writePEM(keyPath, certPath string, key *ecdsa.PrivateKey, der []byte) error {
+	b, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		return err
+	}
+	tmpPath := keyPath + ".tmp"
+	if err := ioutil.WriteFile(tmpPath, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: b}), 0600); err != nil {
+		return err
+	} else if err := os.Rename(tmpPath, keyPath); err != nil {
+		return err
+	}
+	return writeFileAtomic(certPath, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}))
+}
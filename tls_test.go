@@ -0,0 +1,168 @@
+package main
+
+import (
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestGeneratedTLS(t *testing.T) {
+	dir, err := ioutil.TempDir("", "tls")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	leafOf := func(config *tls.Config) *x509.Certificate {
+		cert, err := config.GetCertificate(nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		leaf, err := x509.ParseCertificate(cert.Certificate[0])
+		if err != nil {
+			t.Fatal(err)
+		}
+		return leaf
+	}
+	loadRoots := func() *x509.CertPool {
+		caPEM, err := ioutil.ReadFile(filepath.Join(dir, tlsCAFile))
+		if err != nil {
+			t.Fatal(err)
+		}
+		roots := x509.NewCertPool()
+		roots.AppendCertsFromPEM(caPEM)
+		return roots
+	}
+
+	hosts := []string{"mirror.local", "127.0.0.1"}
+	config, err := LoadTLS("", "", dir, hosts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	roots := loadRoots()
+
+	leaf := leafOf(config)
+	for _, h := range hosts {
+		if _, err := leaf.Verify(x509.VerifyOptions{DNSName: h, Roots: roots}); err != nil {
+			t.Errorf("expected the certificate to be trusted for %s: %v", h, err)
+		}
+	}
+
+	if info, err := os.Stat(filepath.Join(dir, tlsCAKeyFile)); err != nil {
+		t.Fatal(err)
+	} else if info.Mode().Perm()&0077 != 0 {
+		t.Errorf("expected the CA key to be private, got %v", info.Mode())
+	}
+
+	// the same certificate is loaded next time
+	if config, err = LoadTLS("", "", dir, hosts); err != nil {
+		t.Fatal(err)
+	} else if !bytes.Equal(leafOf(config).Raw, leaf.Raw) {
+		t.Errorf("expected the certificate to be reused")
+	}
+
+	// a subdomain gets a new certificate from the same CA
+	if config, err = LoadTLS("", "", dir, append(hosts, "kitchen.mirror.local")); err != nil {
+		t.Fatal(err)
+	} else if _, err := leafOf(config).Verify(x509.VerifyOptions{DNSName: "kitchen.mirror.local", Roots: roots}); err != nil {
+		t.Errorf("expected the reissued certificate to be trusted for kitchen.mirror.local: %v", err)
+	}
+
+	// another host needs a new CA, since the old one can't sign for it
+	if config, err = LoadTLS("", "", dir, append(hosts, "mirror.lan")); err != nil {
+		t.Fatal(err)
+	}
+	leaf = leafOf(config)
+	if _, err := leaf.Verify(x509.VerifyOptions{DNSName: "mirror.lan", Roots: roots}); err == nil {
+		t.Errorf("expected the old CA not to be trusted for mirror.lan")
+	} else if _, err := leaf.Verify(x509.VerifyOptions{DNSName: "mirror.lan", Roots: loadRoots()}); err != nil {
+		t.Errorf("expected the new CA to be trusted for mirror.lan: %v", err)
+	}
+}
+
+func TestTLSNameConstraints(t *testing.T) {
+	dir, err := ioutil.TempDir("", "tls")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	ca, caKey, err := loadOrCreateCA(dir, []string{"mirror.local", "127.0.0.1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	roots := x509.NewCertPool()
+	roots.AddCert(ca)
+
+	// certificates the CA signs for other names and addresses aren't trusted
+	tests := []struct {
+		host    string
+		trusted bool
+	}{
+		{"mirror.local", true},
+		{"kitchen.mirror.local", true},
+		{"127.0.0.1", true},
+		{"example.com", false},
+		{"10.0.0.1", false},
+		{"::1", false},
+	}
+	for _, test := range tests {
+		certPath, keyPath := filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem")
+		if err := createCert(ca, caKey, []string{test.host}, certPath, keyPath); err != nil {
+			t.Fatal(err)
+		}
+		pair, err := tls.LoadX509KeyPair(certPath, keyPath)
+		if err != nil {
+			t.Fatal(err)
+		}
+		leaf, err := x509.ParseCertificate(pair.Certificate[0])
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := leaf.Verify(x509.VerifyOptions{DNSName: test.host, Roots: roots}); (err == nil) != test.trusted {
+			t.Errorf("%s: expected trusted %v, got %v", test.host, test.trusted, err)
+		}
+	}
+}
+
+func TestTLSRenewal(t *testing.T) {
+	dir, err := ioutil.TempDir("", "tls")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	issuer, err := newTLSIssuer(dir, []string{"mirror.local"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := issuer.GetCertificate(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	leaf, err := x509.ParseCertificate(cert.Certificate[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !issuer.renewAt.Equal(leaf.NotAfter.Add(-tlsRenewBefore)) {
+		t.Errorf("expected renewal %v before expiry, got %v", tlsRenewBefore, leaf.NotAfter.Sub(issuer.renewAt))
+	}
+	if again, _ := issuer.GetCertificate(nil); again != cert {
+		t.Errorf("expected the certificate to be kept until it nears expiry")
+	}
+
+	// once it nears expiry, a running server gets a new one
+	issuer.renewAt = time.Now().Add(-time.Minute)
+	if renewed, err := issuer.GetCertificate(nil); err != nil {
+		t.Fatal(err)
+	} else if bytes.Equal(renewed.Certificate[0], cert.Certificate[0]) {
+		t.Errorf("expected the certificate to be reissued")
+	} else if !issuer.renewAt.After(time.Now()) {
+		t.Errorf("expected the next renewal to be in the future, got %v", issuer.renewAt)
+	}
+}
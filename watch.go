@@ -0,0 +1,311 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"reflect"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/donniet/mirror.4/state"
+)
+
+// ConflictPolicy decides which side wins when the state file and the running
+// state have both changed the same path
+type ConflictPolicy string
+
+const (
+	// ConflictDisk applies the edit made to the file
+	ConflictDisk ConflictPolicy = "disk"
+	// ConflictMemory keeps the unsaved change in memory
+	ConflictMemory ConflictPolicy = "memory"
+)
+
+// ParseConflictPolicy validates a conflict policy name
+func ParseConflictPolicy(s string) (ConflictPolicy, error) {
+	switch p := ConflictPolicy(s); p {
+	case ConflictDisk, ConflictMemory:
+		return p, nil
+	}
+	return "", fmt.Errorf("unknown conflict policy '%s'", s)
+}
+
+// WatcherStatus reports the edits picked up from the state file
+type WatcherStatus struct {
+	LastReload time.Time `json:"lastReload"`
+	Reloads    int       `json:"reloads"`
+	Conflicts  int       `json:"conflicts"`
+	LastError  string    `json:"lastError,omitempty"`
+}
+
+var errStateFileChanged = fmt.Errorf("state file changed on disk, waiting for it to be reloaded")
+
+// StateWatcher polls the state file for edits made by other programs and
+// merges them into the running state.  The last document read from or written
+// to the file is kept as the common ancestor: changes between it and the file
+// are the edit, changes between it and memory are unsaved changes, and the two
+// conflict where they touch the same path.
+type StateWatcher struct {
+	path     string
+	server   *state.Server
+	local    *State
+	messages chan<- StateMessage
+	policy   ConflictPolicy
+
+	// guarded by the server lock
+	base    interface{}
+	modTime time.Time
+	size    int64
+
+	locker sync.Locker
+	status WatcherStatus
+}
+
+// NewStateWatcher watches path, which has just been loaded into local
+func NewStateWatcher(path string, server *state.Server, local *State, messages chan<- StateMessage, policy ConflictPolicy) (*StateWatcher, error) {
+	w := &StateWatcher{
+		path:     path,
+		server:   server,
+		local:    local,
+		messages: messages,
+		policy:   policy,
+		locker:   &sync.Mutex{},
+	}
+	return w, server.DoLocked(w.rebaseline)
+}
+
+// Status returns the number of reloads and conflicts
+func (w *StateWatcher) Status() WatcherStatus {
+	w.locker.Lock()
+	defer w.locker.Unlock()
+
+	return w.status
+}
+
+// Run polls the state file every interval until stopper is closed
+func (w *StateWatcher) Run(interval time.Duration, stopper <-chan struct{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			if err := w.poll(); err != nil {
+				log.Printf("error reloading %s: %v", w.path, err)
+				w.locker.Lock()
+				w.status.LastError = err.Error()
+				w.locker.Unlock()
+			}
+		case <-stopper:
+			return
+		}
+	}
+}
+
+// rebaseline records the file as it is now, after it was loaded or saved.
+// It must be called with the server locked.
+func (w *StateWatcher) rebaseline() error {
+	fi, err := os.Stat(w.path)
+	if os.IsNotExist(err) {
+		w.base, w.modTime, w.size = nil, time.Time{}, 0
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	doc, err := w.readFile()
+	if err != nil {
+		return err
+	}
+	w.base, w.modTime, w.size = doc, fi.ModTime(), fi.Size()
+	return nil
+}
+
+// saved records st as the common ancestor once it has been written to the
+// file, without reading the file back.  Unless rewritten says the file was
+// written, saves that leave it alone, like appending to a journal, keep the
+// ancestor it already has.  It must be called with the server locked.
+func (w *StateWatcher) saved(st *State, rewritten bool) error {
+	fi, changed := w.changed()
+	if fi == nil {
+		return w.rebaseline()
+	} else if !changed && !rewritten {
+		return nil
+	}
+
+	b, err := json.Marshal(st)
+	if err != nil {
+		return err
+	}
+	doc, err := decodeDocument(b)
+	if err != nil {
+		return err
+	}
+	w.base, w.modTime, w.size = doc, fi.ModTime(), fi.Size()
+	return nil
+}
+
+// changed reports whether the file was modified since it was last seen.  It
+// must be called with the server locked.
+func (w *StateWatcher) changed() (os.FileInfo, bool) {
+	fi, err := os.Stat(w.path)
+	if err != nil {
+		return nil, false
+	}
+	return fi, !fi.ModTime().Equal(w.modTime) || fi.Size() != w.size
+}
+
+// readFile reads and migrates the state file, leaving out the version and
+// journal mark
+func (w *StateWatcher) readFile() (interface{}, error) {
+	b, err := ioutil.ReadFile(w.path)
+	if err != nil {
+		return nil, err
+	}
+	if b, err = encryption.OpenDocument(b); err != nil {
+		return nil, err
+	}
+	if b, _, err = migrateState(b); err != nil {
+		return nil, err
+	}
+	doc, err := decodeDocument(b)
+	if err != nil {
+		return nil, err
+	}
+	if m, ok := doc.(map[string]interface{}); ok {
+		delete(m, "version")
+		delete(m, "journal")
+	}
+	return doc, nil
+}
+
+func (w *StateWatcher) poll() error {
+	var base, ours, theirs interface{}
+
+	err := w.server.DoLocked(func() error {
+		fi, changed := w.changed()
+		if !changed {
+			return nil
+		}
+		// only report a broken edit once
+		w.modTime, w.size = fi.ModTime(), fi.Size()
+
+		doc, err := w.readFile()
+		if err != nil {
+			return err
+		}
+		if err := validateDocument(reflect.TypeOf(State{}), doc); err != nil {
+			return err
+		}
+
+		b, err := json.Marshal(w.local)
+		if err != nil {
+			return err
+		}
+		if ours, err = decodeDocument(b); err != nil {
+			return err
+		}
+
+		base, theirs = w.base, doc
+		w.base = doc
+		return nil
+	})
+	if err != nil || theirs == nil {
+		return err
+	}
+
+	t := reflect.TypeOf(State{})
+	edits := diffDocuments("", t, base, theirs)
+	unsaved := diffDocuments("", t, base, ours)
+
+	applied, conflicts := 0, 0
+	for _, msg := range edits {
+		tv, tok := documentAt(theirs, msg.Path)
+		ov, ook := documentAt(ours, msg.Path)
+		if tok == ook && reflect.DeepEqual(tv, ov) {
+			continue
+		}
+
+		if overlapsMessages(msg.Path, unsaved) {
+			conflicts++
+			log.Printf("conflicting change to %s on disk and in memory, keeping %s", msg.Path, w.policy)
+			if w.policy == ConflictMemory {
+				continue
+			}
+		}
+
+		if err := applyMessage(w.server, &msg); err != nil {
+			return fmt.Errorf("applying %s %s: %v", msg.Method, msg.Path, err)
+		}
+		w.messages <- msg
+		applied++
+	}
+
+	log.Printf("reloaded %s: %d changes applied, %d conflicts", w.path, applied, conflicts)
+
+	w.locker.Lock()
+	defer w.locker.Unlock()
+	w.status.LastReload = time.Now()
+	w.status.Reloads++
+	w.status.Conflicts += conflicts
+	w.status.LastError = ""
+	return nil
+}
+
+// documentAt returns the value at a '/' separated path in a decoded document
+func documentAt(doc interface{}, path string) (interface{}, bool) {
+	for _, segment := range strings.Split(path, "/") {
+		if segment == "" {
+			continue
+		}
+		m, ok := doc.(map[string]interface{})
+		if !ok {
+			return nil, false
+		}
+		if doc, ok = m[segment]; !ok {
+			return nil, false
+		}
+	}
+	return doc, true
+}
+
+// overlapsMessages reports whether any message changes path or a parent or
+// child of it
+func overlapsMessages(path string, msgs []StateMessage) bool {
+	for _, m := range msgs {
+		if m.Path == path || strings.HasPrefix(m.Path, path+"/") || strings.HasPrefix(path, m.Path+"/") {
+			return true
+		}
+	}
+	return false
+}
+
+// watchedStorage refuses to overwrite the state file while it holds an edit
+// that has not been reloaded yet, and records each save as the new common
+// ancestor
+type watchedStorage struct {
+	Storage
+	watcher *StateWatcher
+}
+
+func (s watchedStorage) Save(st *State, revision uint64) error {
+	if _, changed := s.watcher.changed(); changed {
+		return errStateFileChanged
+	} else if err := s.Storage.Save(st, revision); err != nil {
+		return err
+	}
+	return s.watcher.saved(st, false)
+}
+
+func (s watchedStorage) Snapshot(st *State, revision uint64) error {
+	if _, changed := s.watcher.changed(); changed {
+		return errStateFileChanged
+	} else if err := s.Storage.Snapshot(st, revision); err != nil {
+		return err
+	}
+	return s.watcher.saved(st, true)
+}
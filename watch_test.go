@@ -0,0 +1,85 @@
+package main
+
+import (
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/donniet/mirror.4/state"
+)
+
+func TestStateWatcherMergesEdits(t *testing.T) {
+	for _, policy := range []ConflictPolicy{ConflictDisk, ConflictMemory} {
+		path, cleanup := copyFixture(t, "state-v0.json")
+
+		local := new(State)
+		if err := local.Load(path); err != nil {
+			t.Fatal(err)
+		}
+		server := state.NewServer(local)
+		messages := make(chan StateMessage, 100)
+
+		w, err := NewStateWatcher(path, server, local, messages, policy)
+		if err != nil {
+			t.Fatal(err)
+		}
+		storage := watchedStorage{&jsonStorage{path: path}, w}
+
+		// an unsaved change in memory
+		if _, err := server.Post("display/powerStatus", []byte(`"off"`)); err != nil {
+			t.Fatal(err)
+		}
+
+		// and an edit on disk touching the same path and another one
+		b, _ := ioutil.ReadFile(path)
+		edited := strings.Replace(string(b), `"front door"`, `"back door"`, 1)
+		edited = strings.Replace(edited, `"powerStatus": "on"`, `"powerStatus": "standby"`, 1)
+		if err := ioutil.WriteFile(path, []byte(edited), 0660); err != nil {
+			t.Fatal(err)
+		}
+		later := time.Now().Add(time.Minute)
+		os.Chtimes(path, later, later)
+
+		if err := storage.Save(local, server.Revision()); err != errStateFileChanged {
+			t.Errorf("%s: expected save to wait for the reload, got %v", policy, err)
+		}
+
+		if err := w.poll(); err != nil {
+			t.Fatal(err)
+		}
+
+		if local.Streams[0].Name != "back door" {
+			t.Errorf("%s: edit not applied, stream is '%s'", policy, local.Streams[0].Name)
+		}
+		if policy == ConflictDisk && local.Display.PowerStatus != "standby" {
+			t.Errorf("%s: expected the edit to win, got '%s'", policy, local.Display.PowerStatus)
+		} else if policy == ConflictMemory && local.Display.PowerStatus != "off" {
+			t.Errorf("%s: expected memory to win, got '%s'", policy, local.Display.PowerStatus)
+		}
+		if s := w.Status(); s.Reloads != 1 || s.Conflicts != 1 {
+			t.Errorf("%s: unexpected status %#v", policy, s)
+		}
+
+		found := false
+		for len(messages) > 0 {
+			if m := <-messages; m.Method == http.MethodPost && m.Path == "streams" {
+				found = true
+			}
+		}
+		if !found {
+			t.Errorf("%s: expected the edit to be broadcast", policy)
+		}
+
+		// once reloaded, saving works again and isn't mistaken for an edit
+		if err := storage.Save(local, server.Revision()); err != nil {
+			t.Errorf("%s: %v", policy, err)
+		} else if err := w.poll(); err != nil || w.Status().Reloads != 1 {
+			t.Errorf("%s: own save treated as an edit", policy)
+		}
+
+		cleanup()
+	}
+}